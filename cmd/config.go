@@ -0,0 +1,772 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// Config is everything a Server is set up from.
+type Config struct {
+	TargetServer string   //the first backend.
+	Backends     []string //the backends next to TargetServer.
+	SkipVerify   bool     //skips verifying backend certificates.
+	Options      []proxy.Option
+
+	//MaxBackends and DefaultScheme are also passed through Options, they
+	//are repeated for validating the configuration.
+	MaxBackends   int
+	DefaultScheme string
+
+	Hosts          []string //addresses the proxy listens on.
+	Listen         proxy.ListenConfig
+	MaxConnsPerIP  int            //no limit when zero.
+	TrustedProxies []netip.Prefix //exempt from MaxConnsPerIP.
+	TCPHealthCheck string         //load balancer probes sent as plain TCP.
+	TLS            *tls.Config
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration //the request timeout unless REQUEST_TIMEOUT is set, streams are exempt.
+	DrainTimeout    time.Duration //how long clients are told to reconnect before shutting down.
+	ShutdownTimeout time.Duration
+
+	//background tasks, their Proxy is set by the Server.
+	DNSRefresher  *proxy.DNSRefresher
+	SRVResolver   *proxy.SRVResolver
+	HealthChecker *proxy.HealthChecker
+	CacheJanitor  *proxy.CacheJanitor
+
+	WarmupTimeout time.Duration //no warmup when zero.
+	WarmupPath    string
+
+	PassthroughHost string
+	Passthrough     *proxy.Passthrough
+
+	HTTP3Host string //UDP address served over HTTP/3, needs a build with the http3 tag.
+
+	AdminHost  string
+	AdminToken string
+
+	Logger *slog.Logger
+}
+
+// configFromEnv reads the Config from the environment.
+func configFromEnv() (*Config, error) {
+	env := os.Getenv("ENVIRONMENT")
+	if env == "" {
+		env = "development"
+	}
+
+	backends, err := parseBackends(os.Getenv("BACKENDS"))
+	if err != nil {
+		return nil, err
+	}
+
+	//BACKENDS alone names every backend, the first one takes the place of TARGET_SERVER.
+	targetServer := os.Getenv("TARGET_SERVER")
+	if targetServer == "" {
+		if len(backends) == 0 {
+			return nil, errors.New("TARGET_SERVER or BACKENDS is required environment variable")
+		}
+		targetServer, backends = backends[0], backends[1:]
+	}
+	host := os.Getenv("HOST")
+	if host == "" {
+		return nil, errors.New("HOST is required environment variable")
+	}
+	readTimeoutSTR := os.Getenv("READ_TIMEOUT")
+	if readTimeoutSTR == "" {
+		readTimeoutSTR = "5s"
+	}
+
+	readTimeout, err := time.ParseDuration(readTimeoutSTR)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid duration: %w", readTimeoutSTR, err)
+	}
+
+	writeTimeoutSTR := os.Getenv("WRITE_TIMEOUT")
+	if writeTimeoutSTR == "" {
+		writeTimeoutSTR = "10s"
+	}
+
+	writeTimeout, err := time.ParseDuration(writeTimeoutSTR)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid duration: %w", writeTimeoutSTR, err)
+	}
+
+	shutdownTimeoutSTR := os.Getenv("SHUTDOWN_TIMEOUT")
+	if shutdownTimeoutSTR == "" {
+		shutdownTimeoutSTR = "20s"
+	}
+
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutSTR)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid duration: %w", shutdownTimeoutSTR, err)
+	}
+
+	var drainTimeout time.Duration
+	if drainTimeoutSTR := os.Getenv("DRAIN_TIMEOUT"); drainTimeoutSTR != "" {
+		drainTimeout, err = time.ParseDuration(drainTimeoutSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", drainTimeoutSTR, err)
+		}
+	}
+
+	var logHandler slog.Handler = slog.NewTextHandler(os.Stderr, nil)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		logHandler = slog.NewJSONHandler(os.Stderr, nil)
+	}
+	logger := slog.New(logHandler)
+
+	opts := []proxy.Option{proxy.WithLogger(logger)}
+	if os.Getenv("DEBUG") == "true" {
+		opts = append(opts, proxy.WithDebug(true))
+	}
+
+	if serverName := os.Getenv("TARGET_SERVER_NAME"); serverName != "" {
+		opts = append(opts, proxy.WithServerName(serverName))
+	}
+
+	if os.Getenv("DISABLE_KEEP_ALIVES") == "true" {
+		opts = append(opts, proxy.WithDisableKeepAlives(true))
+	}
+
+	if idleConnTimeoutSTR := os.Getenv("IDLE_CONN_TIMEOUT"); idleConnTimeoutSTR != "" {
+		idleConnTimeout, err := time.ParseDuration(idleConnTimeoutSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", idleConnTimeoutSTR, err)
+		}
+		opts = append(opts, proxy.WithIdleConnTimeout(idleConnTimeout))
+	}
+
+	if maxConnsPerHostSTR := os.Getenv("MAX_CONNS_PER_HOST"); maxConnsPerHostSTR != "" {
+		maxConnsPerHost, err := strconv.Atoi(maxConnsPerHostSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", maxConnsPerHostSTR, err)
+		}
+		opts = append(opts, proxy.WithMaxConnsPerHost(maxConnsPerHost))
+	}
+
+	if connLifetimeSTR := os.Getenv("CONN_LIFETIME"); connLifetimeSTR != "" {
+		connLifetime, err := time.ParseDuration(connLifetimeSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", connLifetimeSTR, err)
+		}
+		opts = append(opts, proxy.WithConnLifetime(connLifetime))
+	}
+
+	if expectContinueSTR := os.Getenv("EXPECT_CONTINUE_TIMEOUT"); expectContinueSTR != "" {
+		expectContinue, err := time.ParseDuration(expectContinueSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", expectContinueSTR, err)
+		}
+		opts = append(opts, proxy.WithExpectContinueTimeout(expectContinue))
+	}
+
+	if responseHeaderSTR := os.Getenv("RESPONSE_HEADER_TIMEOUT"); responseHeaderSTR != "" {
+		responseHeader, err := time.ParseDuration(responseHeaderSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", responseHeaderSTR, err)
+		}
+		opts = append(opts, proxy.WithResponseHeaderTimeout(responseHeader))
+	}
+
+	trusted, err := parsePrefixes(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, proxy.WithTrustedProxies(trusted...))
+
+	allowIPs, err := parsePrefixes(os.Getenv("IP_ALLOWLIST"))
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, proxy.WithIPAllowlist(allowIPs...))
+
+	denyIPs, err := parsePrefixes(os.Getenv("IP_DENYLIST"))
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, proxy.WithIPDenylist(denyIPs...))
+
+	if forwardHostsSTR := os.Getenv("FORWARD_PROXY_HOSTS"); forwardHostsSTR != "" {
+		opts = append(opts, proxy.WithForwardProxy(splitList(forwardHostsSTR)...))
+	}
+
+	if connectPortsSTR := os.Getenv("FORWARD_CONNECT_PORTS"); connectPortsSTR != "" {
+		var ports []int
+		for _, portSTR := range splitList(connectPortsSTR) {
+			port, err := strconv.Atoi(portSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", portSTR, err)
+			}
+			ports = append(ports, port)
+		}
+		opts = append(opts, proxy.WithForwardConnectPorts(ports...))
+	}
+
+	if os.Getenv("PRESERVE_HOST_HEADER") == "true" {
+		opts = append(opts, proxy.WithPreserveHostHeader(true))
+	}
+
+	if os.Getenv("PRESERVE_HEADER_CASE") == "true" {
+		opts = append(opts, proxy.WithPreserveHeaderCase(true))
+	}
+
+	//backends given as host:port are dialed with this scheme.
+	defaultScheme := os.Getenv("DEFAULT_UPSTREAM_SCHEME")
+	if defaultScheme != "" {
+		opts = append(opts, proxy.WithDefaultUpstreamScheme(defaultScheme))
+	}
+
+	if pagePath := os.Getenv("MAINTENANCE_PAGE"); pagePath != "" {
+		page, err := os.ReadFile(pagePath)
+		if err != nil {
+			return nil, fmt.Errorf("read maintenance page: %w", err)
+		}
+		opts = append(opts, proxy.WithMaintenancePage(page))
+	}
+
+	//pairs such as 308=301 for clients not knowing the backend status.
+	if rewritesSTR := os.Getenv("STATUS_REWRITES"); rewritesSTR != "" {
+		rewrites := make(map[int]int)
+		for _, pair := range splitList(rewritesSTR) {
+			fromSTR, toSTR, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s is not a valid status=status pair", pair)
+			}
+
+			from, err := strconv.Atoi(fromSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", fromSTR, err)
+			}
+
+			to, err := strconv.Atoi(toSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", toSTR, err)
+			}
+			rewrites[from] = to
+		}
+		opts = append(opts, proxy.WithStatusRewrite(rewrites))
+	}
+
+	if os.Getenv("ACCESS_LOG") == "true" {
+		opts = append(opts, proxy.WithAccessLog(os.Getenv("BACKEND_REQUEST_ID_HEADER")))
+	}
+
+	//advertises an HTTP/3 frontend other than HTTP3_HOST, the proxy handler itself does not speak QUIC.
+	if altSvcPortSTR := os.Getenv("ALT_SVC_H3_PORT"); altSvcPortSTR != "" {
+		altSvcPort, err := strconv.Atoi(altSvcPortSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", altSvcPortSTR, err)
+		}
+
+		var altSvcMaxAge time.Duration
+		if maxAgeSTR := os.Getenv("ALT_SVC_MAX_AGE"); maxAgeSTR != "" {
+			altSvcMaxAge, err = time.ParseDuration(maxAgeSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %w", maxAgeSTR, err)
+			}
+		}
+		opts = append(opts, proxy.WithAltSvc(altSvcPort, altSvcMaxAge))
+	}
+
+	//backends only reachable through a SOCKS5 server.
+	if socks5Addr := os.Getenv("SOCKS5_PROXY"); socks5Addr != "" {
+		opts = append(opts, proxy.WithSOCKS5(socks5Addr, os.Getenv("SOCKS5_USERNAME"), os.Getenv("SOCKS5_PASSWORD")))
+	}
+
+	if cookie := os.Getenv("STICKY_SESSION_COOKIE"); cookie != "" {
+		opts = append(opts, proxy.WithStickySessions(cookie))
+	}
+
+	if maxConcurrentSTR := os.Getenv("MAX_CONCURRENT"); maxConcurrentSTR != "" {
+		var limit proxy.ConcurrencyLimit
+		limit.Max, err = strconv.Atoi(maxConcurrentSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", maxConcurrentSTR, err)
+		}
+
+		if queueSizeSTR := os.Getenv("QUEUE_SIZE"); queueSizeSTR != "" {
+			limit.QueueSize, err = strconv.Atoi(queueSizeSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", queueSizeSTR, err)
+			}
+		}
+
+		if queueTimeoutSTR := os.Getenv("QUEUE_TIMEOUT"); queueTimeoutSTR != "" {
+			limit.QueueTimeout, err = time.ParseDuration(queueTimeoutSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %w", queueTimeoutSTR, err)
+			}
+		}
+
+		//the limit then starts at MAX_CONCURRENT and backs off towards ADAPTIVE_MIN as latency climbs.
+		if os.Getenv("ADAPTIVE_CONCURRENCY") == "true" {
+			limit.Adaptive = &proxy.AdaptiveLimit{}
+			if adaptiveMinSTR := os.Getenv("ADAPTIVE_MIN"); adaptiveMinSTR != "" {
+				limit.Adaptive.Min, err = strconv.Atoi(adaptiveMinSTR)
+				if err != nil {
+					return nil, fmt.Errorf("%s is not a valid number: %w", adaptiveMinSTR, err)
+				}
+			}
+		}
+
+		//requests carrying the header jump the queue.
+		if priorityHeader := os.Getenv("PRIORITY_HEADER"); priorityHeader != "" {
+			limit.Priorities = append(limit.Priorities, proxy.PriorityRule{Header: priorityHeader, Priority: 1})
+		}
+		opts = append(opts, proxy.WithConcurrencyLimit(limit))
+	}
+
+	if os.Getenv("COMPRESS_RESPONSES") == "true" {
+		opts = append(opts, proxy.WithCompression(true))
+	}
+
+	//request bodies are only gzipped for backends announcing they accept it.
+	if os.Getenv("COMPRESS_REQUESTS") == "true" {
+		opts = append(opts, proxy.WithRequestCompression(0))
+	}
+
+	if os.Getenv("COALESCE_REQUESTS") == "true" {
+		opts = append(opts, proxy.WithCoalescing(true))
+	}
+
+	//the proxy has a single cache, the later one would silently replace the other.
+	if os.Getenv("CACHE_ENTRIES") != "" && os.Getenv("CACHE_DIR") != "" {
+		return nil, errors.New("CACHE_ENTRIES and CACHE_DIR can not be used together")
+	}
+
+	var janitor *proxy.CacheJanitor
+	if cacheEntriesSTR := os.Getenv("CACHE_ENTRIES"); cacheEntriesSTR != "" {
+		cacheEntries, err := strconv.Atoi(cacheEntriesSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", cacheEntriesSTR, err)
+		}
+		//a cache without a bound grows with every distinct url.
+		if cacheEntries <= 0 {
+			return nil, fmt.Errorf("CACHE_ENTRIES must be positive, got %d", cacheEntries)
+		}
+		memoryCache := proxy.NewMemoryCache(cacheEntries)
+		opts = append(opts, proxy.WithCache(memoryCache))
+
+		if sweepSTR := os.Getenv("CACHE_SWEEP_INTERVAL"); sweepSTR != "" {
+			sweep, err := time.ParseDuration(sweepSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %w", sweepSTR, err)
+			}
+			janitor = &proxy.CacheJanitor{Cache: memoryCache, Interval: sweep, Logger: logger}
+		}
+	}
+
+	//large static assets are better kept on disk, where they also survive restarts.
+	if cacheDir := os.Getenv("CACHE_DIR"); cacheDir != "" {
+		var cacheMaxBytes int64
+		if maxBytesSTR := os.Getenv("CACHE_MAX_BYTES"); maxBytesSTR != "" {
+			cacheMaxBytes, err = strconv.ParseInt(maxBytesSTR, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", maxBytesSTR, err)
+			}
+		}
+
+		diskCache, err := proxy.NewDiskCache(cacheDir, cacheMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithCache(diskCache))
+	}
+
+	if statusesSTR := os.Getenv("CACHE_STATUSES"); statusesSTR != "" {
+		var statuses []int
+		for _, statusSTR := range splitList(statusesSTR) {
+			status, err := strconv.Atoi(statusSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", statusSTR, err)
+			}
+			statuses = append(statuses, status)
+		}
+		opts = append(opts, proxy.WithCacheStatuses(statuses...))
+	}
+
+	if methodsSTR := os.Getenv("CACHE_METHODS"); methodsSTR != "" {
+		opts = append(opts, proxy.WithCacheMethods(splitList(methodsSTR)...))
+	}
+
+	if idempotencyTTLSTR := os.Getenv("IDEMPOTENCY_TTL"); idempotencyTTLSTR != "" {
+		idempotencyTTL, err := time.ParseDuration(idempotencyTTLSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", idempotencyTTLSTR, err)
+		}
+
+		idempotencyMaxKeys := 10000
+		if maxKeysSTR := os.Getenv("IDEMPOTENCY_MAX_KEYS"); maxKeysSTR != "" {
+			idempotencyMaxKeys, err = strconv.Atoi(maxKeysSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", maxKeysSTR, err)
+			}
+		}
+		opts = append(opts, proxy.WithIdempotency(idempotencyTTL, idempotencyMaxKeys))
+	}
+
+	var maxBackends int
+	if maxBackendsSTR := os.Getenv("MAX_BACKENDS"); maxBackendsSTR != "" {
+		maxBackends, err = strconv.Atoi(maxBackendsSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", maxBackendsSTR, err)
+		}
+		opts = append(opts, proxy.WithMaxBackends(maxBackends))
+	}
+
+	if retriesSTR := os.Getenv("RETRIES"); retriesSTR != "" {
+		retries, err := strconv.Atoi(retriesSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", retriesSTR, err)
+		}
+		opts = append(opts, proxy.WithRetries(retries))
+	}
+
+	switch balancer := os.Getenv("BALANCER"); balancer {
+	case "", "round-robin":
+	case "peak-ewma":
+		var decay time.Duration
+		if decaySTR := os.Getenv("EWMA_DECAY"); decaySTR != "" {
+			decay, err = time.ParseDuration(decaySTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %w", decaySTR, err)
+			}
+		}
+		opts = append(opts, proxy.WithPeakEWMA(decay))
+	default:
+		return nil, fmt.Errorf("%s is not a known balancer, use round-robin or peak-ewma", balancer)
+	}
+
+	if requestTimeoutSTR := os.Getenv("REQUEST_TIMEOUT"); requestTimeoutSTR != "" {
+		requestTimeout, err := time.ParseDuration(requestTimeoutSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", requestTimeoutSTR, err)
+		}
+		opts = append(opts, proxy.WithRequestTimeout(requestTimeout))
+	}
+
+	//clients such as grpc ones say how long they are willing to wait.
+	if timeoutHeader := os.Getenv("TIMEOUT_HEADER"); timeoutHeader != "" {
+		maxTimeoutSTR := os.Getenv("TIMEOUT_HEADER_MAX")
+		if maxTimeoutSTR == "" {
+			maxTimeoutSTR = "30s"
+		}
+
+		maxTimeout, err := time.ParseDuration(maxTimeoutSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", maxTimeoutSTR, err)
+		}
+		opts = append(opts, proxy.WithTimeoutHeader(timeoutHeader, maxTimeout))
+	}
+
+	if methodsSTR := os.Getenv("ALLOWED_METHODS"); methodsSTR != "" {
+		opts = append(opts, proxy.WithAllowedMethods(splitList(methodsSTR)...))
+	}
+
+	switch normalize := os.Getenv("NORMALIZE_PATHS"); normalize {
+	case "":
+	case "true":
+		opts = append(opts, proxy.WithPathNormalization(false))
+	case "strict":
+		opts = append(opts, proxy.WithPathNormalization(true))
+	default:
+		return nil, fmt.Errorf("%s is not a valid path normalization mode, use true or strict", normalize)
+	}
+
+	if os.Getenv("REWRITE_COOKIES") == "true" {
+		opts = append(opts, proxy.WithCookieRewrite(proxy.CookieRewrite{
+			Domain:   os.Getenv("COOKIE_DOMAIN"),
+			FromPath: os.Getenv("COOKIE_FROM_PATH"),
+			ToPath:   os.Getenv("COOKIE_TO_PATH"),
+			Secure:   os.Getenv("COOKIE_SECURE") == "true",
+			HttpOnly: os.Getenv("COOKIE_HTTP_ONLY") == "true",
+		}))
+	}
+
+	if uploadLimitSTR := os.Getenv("UPLOAD_LIMIT"); uploadLimitSTR != "" {
+		uploadLimit, err := strconv.ParseInt(uploadLimitSTR, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", uploadLimitSTR, err)
+		}
+		opts = append(opts, proxy.WithUploadLimit(uploadLimit))
+	}
+
+	if downloadLimitSTR := os.Getenv("DOWNLOAD_LIMIT"); downloadLimitSTR != "" {
+		downloadLimit, err := strconv.ParseInt(downloadLimitSTR, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", downloadLimitSTR, err)
+		}
+		opts = append(opts, proxy.WithDownloadLimit(downloadLimit))
+	}
+
+	var maxHeaderBytes int64
+	if maxHeaderBytesSTR := os.Getenv("MAX_RESPONSE_HEADER_BYTES"); maxHeaderBytesSTR != "" {
+		maxHeaderBytes, err = strconv.ParseInt(maxHeaderBytesSTR, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", maxHeaderBytesSTR, err)
+		}
+	}
+
+	var maxHeaders int
+	if maxHeadersSTR := os.Getenv("MAX_RESPONSE_HEADERS"); maxHeadersSTR != "" {
+		maxHeaders, err = strconv.Atoi(maxHeadersSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", maxHeadersSTR, err)
+		}
+	}
+	opts = append(opts, proxy.WithResponseHeaderLimits(maxHeaderBytes, maxHeaders))
+
+	if copyBufferSTR := os.Getenv("COPY_BUFFER_SIZE"); copyBufferSTR != "" {
+		copyBuffer, err := strconv.Atoi(copyBufferSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", copyBufferSTR, err)
+		}
+		opts = append(opts, proxy.WithCopyBufferSize(copyBuffer))
+	}
+
+	var dnsRefresher *proxy.DNSRefresher
+	if dnsRefreshSTR := os.Getenv("DNS_REFRESH_INTERVAL"); dnsRefreshSTR != "" {
+		dnsRefresh, err := time.ParseDuration(dnsRefreshSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", dnsRefreshSTR, err)
+		}
+		dnsRefresher = &proxy.DNSRefresher{Interval: dnsRefresh, Logger: logger}
+		opts = append(opts, proxy.WithDNSRefresher(dnsRefresher))
+	}
+
+	tlsSettings := proxy.TLSSettings{
+		MinVersion:            os.Getenv("TLS_MIN_VERSION"),
+		DisableSessionTickets: os.Getenv("TLS_SESSION_TICKETS") == "false",
+	}
+	if ciphersSTR := os.Getenv("TLS_CIPHER_SUITES"); ciphersSTR != "" {
+		tlsSettings.CipherSuites = splitList(ciphersSTR)
+	}
+	if curvesSTR := os.Getenv("TLS_CURVES"); curvesSTR != "" {
+		tlsSettings.Curves = splitList(curvesSTR)
+	}
+
+	//clients present certificates issued by these CAs, their identity is forwarded to the backends.
+	if clientCAFile := os.Getenv("TLS_CLIENT_CA_FILE"); clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca file: %w", err)
+		}
+
+		tlsSettings.ClientCAs = x509.NewCertPool()
+		if !tlsSettings.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client ca file %s holds no certificates", clientCAFile)
+		}
+	}
+	tlsSettings.ClientAuth = os.Getenv("TLS_CLIENT_AUTH")
+
+	if os.Getenv("FORWARD_CLIENT_CERT") == "true" {
+		opts = append(opts, proxy.WithClientCertForwarding(true))
+	}
+
+	tlsConfig, err := proxy.ServerTLSConfig(tlsSettings)
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %w", err)
+	}
+
+	var srv *proxy.SRVResolver
+	if srvName := os.Getenv("SRV_NAME"); srvName != "" {
+		srvIntervalSTR := os.Getenv("SRV_INTERVAL")
+		if srvIntervalSTR == "" {
+			srvIntervalSTR = "30s"
+		}
+
+		srvInterval, err := time.ParseDuration(srvIntervalSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", srvIntervalSTR, err)
+		}
+
+		srv = &proxy.SRVResolver{
+			Name:     srvName,
+			Scheme:   os.Getenv("SRV_SCHEME"),
+			Interval: srvInterval,
+			Logger:   logger,
+		}
+	}
+
+	var checker *proxy.HealthChecker
+	healthPath := os.Getenv("HEALTH_CHECK_PATH")
+	healthTCP := os.Getenv("HEALTH_CHECK_TCP") == "true"
+	if healthPath != "" || healthTCP {
+		healthIntervalSTR := os.Getenv("HEALTH_CHECK_INTERVAL")
+		if healthIntervalSTR == "" {
+			healthIntervalSTR = "10s"
+		}
+
+		healthInterval, err := time.ParseDuration(healthIntervalSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", healthIntervalSTR, err)
+		}
+
+		var healthJitter float64
+		if jitterSTR := os.Getenv("HEALTH_CHECK_JITTER"); jitterSTR != "" {
+			healthJitter, err = strconv.ParseFloat(jitterSTR, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid number: %w", jitterSTR, err)
+			}
+		}
+
+		checker = &proxy.HealthChecker{
+			HealthCheck: proxy.HealthCheck{
+				TCP:  healthTCP,
+				Path: healthPath,
+				Body: os.Getenv("HEALTH_CHECK_BODY"),
+			},
+			Interval: healthInterval,
+			Logger:   logger,
+			//slow probes lower the share of requests a backend gets.
+			AdjustWeights: os.Getenv("HEALTH_CHECK_ADJUST_WEIGHTS") == "true",
+			Jitter:        healthJitter,
+		}
+
+		if patternSTR := os.Getenv("HEALTH_CHECK_BODY_PATTERN"); patternSTR != "" {
+			pattern, err := regexp.Compile(patternSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid pattern: %w", patternSTR, err)
+			}
+			checker.BodyPattern = pattern
+		}
+	}
+
+	var warmupTimeout time.Duration
+	if warmupTimeoutSTR := os.Getenv("WARMUP_TIMEOUT"); warmupTimeoutSTR != "" {
+		warmupTimeout, err = time.ParseDuration(warmupTimeoutSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", warmupTimeoutSTR, err)
+		}
+	}
+
+	listenConfig := proxy.ListenConfig{
+		//rolling restarts bind the new instance before the old one exits.
+		ReusePort: os.Getenv("REUSE_PORT") == "true",
+		Logger:    logger,
+	}
+
+	//probes find dead clients after idle plus a few intervals of silence.
+	if idleSTR := os.Getenv("TCP_KEEPALIVE_IDLE"); idleSTR != "" {
+		idle, err := time.ParseDuration(idleSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %w", idleSTR, err)
+		}
+		listenConfig.KeepAlive = net.KeepAliveConfig{Enable: true, Idle: idle}
+
+		if intervalSTR := os.Getenv("TCP_KEEPALIVE_INTERVAL"); intervalSTR != "" {
+			listenConfig.KeepAlive.Interval, err = time.ParseDuration(intervalSTR)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %w", intervalSTR, err)
+			}
+		}
+	}
+
+	maxConns := 0
+	if maxConnsSTR := os.Getenv("MAX_CONNS_PER_IP"); maxConnsSTR != "" {
+		maxConns, err = strconv.Atoi(maxConnsSTR)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid number: %w", maxConnsSTR, err)
+		}
+	}
+
+	var passthrough *proxy.Passthrough
+	passthroughHost := os.Getenv("PASSTHROUGH_HOST")
+	if passthroughHost != "" {
+		passthrough = &proxy.Passthrough{
+			Backends: make(map[string]string),
+			Default:  os.Getenv("PASSTHROUGH_DEFAULT"),
+			Logger:   logger,
+		}
+
+		for _, pair := range splitList(os.Getenv("PASSTHROUGH_BACKENDS")) {
+			name, addr, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s is not a valid server name=address pair", pair)
+			}
+			passthrough.Backends[name] = addr
+		}
+	}
+
+	adminHost := os.Getenv("ADMIN_HOST")
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminHost != "" && adminToken == "" {
+		return nil, errors.New("ADMIN_TOKEN is required when ADMIN_HOST is set")
+	}
+
+	return &Config{
+		TargetServer:    targetServer,
+		Backends:        backends,
+		SkipVerify:      env != "production",
+		Options:         opts,
+		MaxBackends:     maxBackends,
+		DefaultScheme:   defaultScheme,
+		Hosts:           splitList(host),
+		Listen:          listenConfig,
+		MaxConnsPerIP:   maxConns,
+		TrustedProxies:  trusted,
+		TCPHealthCheck:  os.Getenv("TCP_HEALTH_CHECK"),
+		TLS:             tlsConfig,
+		ReadTimeout:     readTimeout,
+		WriteTimeout:    writeTimeout,
+		DrainTimeout:    drainTimeout,
+		ShutdownTimeout: shutdownTimeout,
+		DNSRefresher:    dnsRefresher,
+		SRVResolver:     srv,
+		HealthChecker:   checker,
+		CacheJanitor:    janitor,
+		WarmupTimeout:   warmupTimeout,
+		WarmupPath:      os.Getenv("WARMUP_PATH"),
+		PassthroughHost: passthroughHost,
+		Passthrough:     passthrough,
+		HTTP3Host:       os.Getenv("HTTP3_HOST"),
+		AdminHost:       adminHost,
+		AdminToken:      adminToken,
+		Logger:          logger,
+	}, nil
+}
+
+// parseBackends parses a comma separated list of backends, each a url or a
+// host:port dialed with the default upstream scheme.
+func parseBackends(value string) ([]string, error) {
+	backends := splitList(value)
+	seen := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		if seen[backend] {
+			return nil, fmt.Errorf("backend %s is listed twice", backend)
+		}
+		seen[backend] = true
+
+		if !strings.Contains(backend, "://") {
+			if _, _, err := net.SplitHostPort(backend); err != nil {
+				return nil, fmt.Errorf("%s is not a valid backend: %w", backend, err)
+			}
+			continue
+		}
+
+		u, err := url.Parse(backend)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid backend: %w", backend, err)
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s is not a valid backend: want an http or https url with a host", backend)
+		}
+	}
+	return backends, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseBackends(t *testing.T) {
+	tests := map[string]struct {
+		value       string
+		expected    []string
+		expectedErr bool
+	}{
+		"urls and host:port": {
+			value:    "http://10.0.0.1:9000, https://api.internal ,10.0.0.3:9000",
+			expected: []string{"http://10.0.0.1:9000", "https://api.internal", "10.0.0.3:9000"},
+		},
+		"empty entries are skipped": {
+			value:    "http://10.0.0.1:9000,,",
+			expected: []string{"http://10.0.0.1:9000"},
+		},
+		"unsupported scheme": {
+			value:       "http://10.0.0.1:9000,ftp://10.0.0.2",
+			expectedErr: true,
+		},
+		"missing port": {
+			value:       "10.0.0.1",
+			expectedErr: true,
+		},
+		"listed twice": {
+			value:       "http://10.0.0.1:9000,http://10.0.0.1:9000",
+			expectedErr: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			backends, err := parseBackends(tt.value)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got backends %v", backends)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to parse backends: %s", err)
+			}
+
+			if !slices.Equal(backends, tt.expected) {
+				t.Errorf("backends=%v, got %v", tt.expected, backends)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnvBackends(t *testing.T) {
+	t.Setenv("HOST", "127.0.0.1:0")
+	t.Setenv("TARGET_SERVER", "")
+	t.Setenv("BACKENDS", "http://10.0.0.1:9000,http://10.0.0.2:9000,http://10.0.0.3:9000")
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		t.Fatalf("failed to read config: %s", err)
+	}
+
+	if cfg.TargetServer != "http://10.0.0.1:9000" {
+		t.Errorf("target=%s, got %s", "http://10.0.0.1:9000", cfg.TargetServer)
+	}
+
+	expected := []string{"http://10.0.0.2:9000", "http://10.0.0.3:9000"}
+	if !slices.Equal(cfg.Backends, expected) {
+		t.Errorf("backends=%v, got %v", expected, cfg.Backends)
+	}
+}
+
+func TestConfigFromEnvCache(t *testing.T) {
+	tests := map[string]struct {
+		entries string
+		dir     string
+		wantErr bool
+	}{
+		"bounded":     {entries: "100"},
+		"zero":        {entries: "0", wantErr: true},
+		"negative":    {entries: "-1", wantErr: true},
+		"not a num":   {entries: "many", wantErr: true},
+		"disk":        {dir: "cache"},
+		"memory+disk": {entries: "100", dir: "cache", wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("HOST", "127.0.0.1:0")
+			t.Setenv("TARGET_SERVER", "http://10.0.0.1:9000")
+			t.Setenv("CACHE_ENTRIES", tt.entries)
+			t.Setenv("CACHE_DIR", "")
+			if tt.dir != "" {
+				t.Setenv("CACHE_DIR", filepath.Join(t.TempDir(), tt.dir))
+			}
+
+			_, err := configFromEnv()
+			if tt.wantErr && err == nil {
+				t.Errorf("expected CACHE_ENTRIES=%q CACHE_DIR=%q to be rejected", tt.entries, tt.dir)
+			}
+
+			if !tt.wantErr && err != nil {
+				t.Errorf("failed to read config: %s", err)
+			}
+		})
+	}
+}
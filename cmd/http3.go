@@ -0,0 +1,31 @@
+//go:build http3
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server serves handler over HTTP/3 with the certificate the TCP
+// listeners serve, on top of base when it is not nil.
+func newHTTP3Server(handler http.Handler, base *tls.Config, certFile, keyFile string) (http3Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load http3 certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	return &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}, nil
+}
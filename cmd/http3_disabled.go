@@ -0,0 +1,14 @@
+//go:build !http3
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+// newHTTP3Server fails, quic-go is only compiled in with the http3 tag.
+func newHTTP3Server(handler http.Handler, base *tls.Config, certFile, keyFile string) (http3Server, error) {
+	return nil, errors.New("HTTP3_HOST needs a build with -tags http3")
+}
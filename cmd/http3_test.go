@@ -0,0 +1,116 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestServerHTTP3(t *testing.T) {
+	inTempDir(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	}))
+	defer backend.Close()
+
+	server, err := NewServer(&Config{
+		TargetServer: backend.URL,
+		Hosts:        []string{"127.0.0.1:0"},
+		HTTP3Host:    "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.Close()
+	client := http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("https://" + server.HTTP3Addr().String())
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+
+	if resp.ProtoMajor != 3 {
+		t.Errorf("proto=%s, got %s", "HTTP/3.0", resp.Proto)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if string(bs) != "Hello World!" {
+		t.Errorf("body=%s, got %s", "Hello World!", string(bs))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shut down: %s", err)
+	}
+}
+
+func TestServerAltSvc(t *testing.T) {
+	inTempDir(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	//the port is advertised before listening, so it has to be chosen up front.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a udp port: %s", err)
+	}
+	http3Host := conn.LocalAddr().String()
+	conn.Close()
+
+	server, err := NewServer(&Config{
+		TargetServer: backend.URL,
+		Hosts:        []string{"127.0.0.1:0"},
+		HTTP3Host:    http3Host,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	resp, err := client.Get("https://" + server.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	resp.Body.Close()
+
+	_, port, _ := net.SplitHostPort(http3Host)
+	expected := `h3=":` + port + `"`
+	if got := resp.Header.Get("Alt-Svc"); got != expected {
+		t.Errorf("alt-svc=%q, got %q", expected, got)
+	}
+}
@@ -2,167 +2,123 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
-	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"math/big"
-	"net"
-	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/hamidoujand/reverse-proxy/proxy"
 )
 
 func main() {
-	if err := run(); err != nil {
+	validate := flag.Bool("validate", false, "validate the configuration and exit without starting the server")
+	checkReachable := flag.Bool("check-reachable", false, "with -validate, also check that every backend accepts connections")
+	flag.Parse()
+
+	shutdown, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(shutdown, *validate, *checkReachable); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
-
-	env := os.Getenv("ENVIRONMENT")
-	if env == "" {
-		env = "development"
-	}
-
-	targetServer := os.Getenv("TARGET_SERVER")
-	if targetServer == "" {
-		return errors.New("TARGET_SERVER is required environment variable")
-	}
-	host := os.Getenv("HOST")
-	if host == "" {
-		return errors.New("HOST is required environment variable")
-	}
-	readTimeoutSTR := os.Getenv("READ_TIMEOUT")
-	if readTimeoutSTR == "" {
-		readTimeoutSTR = "5s"
-	}
-
-	readTimeout, err := time.ParseDuration(readTimeoutSTR)
-	if err != nil {
-		return fmt.Errorf("%s is not a valid duration: %w", readTimeoutSTR, err)
-	}
-
-	writeTimeoutSTR := os.Getenv("WRITE_TIMEOUT")
-	if writeTimeoutSTR == "" {
-		writeTimeoutSTR = "10s"
-	}
-
-	writeTimeout, err := time.ParseDuration(writeTimeoutSTR)
+// run serves the proxy configured from the environment until shutdown is
+// done, then shuts it down gracefully.
+func run(shutdown context.Context, validate, checkReachable bool) error {
+	cfg, err := configFromEnv()
 	if err != nil {
-		return fmt.Errorf("%s is not a valid duration: %w", writeTimeoutSTR, err)
-	}
-
-	shutdownTimeoutSTR := os.Getenv("SHUTDOWN_TIMEOUT")
-	if shutdownTimeoutSTR == "" {
-		shutdownTimeoutSTR = "20s"
+		return err
 	}
 
-	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutSTR)
-	if err != nil {
-		return fmt.Errorf("%s is not a valid duration: %w", shutdownTimeoutSTR, err)
+	if validate {
+		return validateConfig(cfg, checkReachable)
 	}
-	//==========================================================================
-	//TLS Support
 
-	//generate private key
-	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	server, err := NewServer(cfg)
 	if err != nil {
-		return fmt.Errorf("generate private key: %w", err)
-	}
-	now := time.Now()
-	then := now.Add(time.Hour * 24 * 365) //one year later
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName:   "reverse.proxy.name",
-			Organization: []string{"Reverse-Proxy"},
-		},
-		NotBefore:             now,
-		NotAfter:              then,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		DNSNames:              []string{"localhost"},
-		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		return err
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &private.PublicKey, private)
-	if err != nil {
-		return fmt.Errorf("create certificate: %w", err)
-	}
-
-	certFile, err := os.Create("certificate.cer")
-	if err != nil {
-		return fmt.Errorf("create cert file: %w", err)
+	shutdownServer := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		return server.Shutdown(ctx)
 	}
-	defer certFile.Close()
 
-	if err := pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}); err != nil {
-		return fmt.Errorf("encode into pem: %w", err)
+	if err := server.Start(context.Background()); err != nil {
+		shutdownServer()
+		return err
 	}
 
-	privateFile, err := os.Create("private.pem")
-	if err != nil {
-		return fmt.Errorf("create private file: %w", err)
+	select {
+	case err := <-server.Err():
+		shutdownServer()
+		return fmt.Errorf("server error: %w", err)
+	case <-shutdown.Done():
 	}
 
-	defer privateFile.Close()
+	server.Drain(context.Background())
+	return shutdownServer()
+}
 
-	if err := pem.Encode(privateFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}); err != nil {
-		return fmt.Errorf("encode private key: %w", err)
+// validateConfig reports the problems found in cfg, checking that every
+// backend accepts connections when checkReachable is set.
+func validateConfig(cfg *Config, checkReachable bool) error {
+	errs := proxy.ValidateConfig(context.Background(), proxy.Config{
+		Backends:       append([]string{cfg.TargetServer}, cfg.Backends...),
+		MaxBackends:    cfg.MaxBackends,
+		DefaultScheme:  cfg.DefaultScheme,
+		CheckReachable: checkReachable,
+	})
+
+	//the options are only checked by building the proxy, it stops at the
+	//first problem so it is left out once the backends alone are invalid.
+	if len(errs) == 0 {
+		p, err := proxy.New(cfg.TargetServer, cfg.SkipVerify, append(cfg.Options, proxy.WithBackends(cfg.Backends...))...)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			p.Close()
+		}
 	}
 
-	//==========================================================================
-	//Server
-	skipVerify := env != "production"
-	proxy, err := proxy.New(targetServer, skipVerify)
-
-	if err != nil {
-		return fmt.Errorf("new proxy handler: %w", err)
+	if len(errs) == 0 {
+		fmt.Println("configuration is valid")
+		return nil
 	}
 
-	server := http.Server{
-		Addr:        host,
-		Handler:     http.TimeoutHandler(proxy, writeTimeout, "timed out"),
-		ReadTimeout: readTimeout,
-		ErrorLog:    log.Default(),
+	fmt.Fprintln(os.Stderr, "configuration is invalid:")
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  - %s\n", err)
 	}
+	return fmt.Errorf("found %d configuration problems", len(errs))
+}
 
-	shutdownCh := make(chan os.Signal, 1)
-	signal.Notify(shutdownCh, syscall.SIGINT, syscall.SIGTERM)
-
-	serverErrs := make(chan error, 1)
-
-	go func() {
-		log.Printf("proxy server running on: %s\n", host)
-		if err := server.ListenAndServeTLS("certificate.cer", "private.pem"); err != nil {
-			serverErrs <- err
+// splitList splits a comma separated environment value.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
-	}()
-
-	select {
-	case err := <-serverErrs:
-		return fmt.Errorf("server error: %w", err)
-	case sig := <-shutdownCh:
-		log.Printf("received %s, shutting down\n", sig)
-		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
-		defer cancel()
+	}
+	return items
+}
 
-		if err := server.Shutdown(ctx); err != nil {
-			server.Close()
-			return fmt.Errorf("graceful shutdown: %w", err)
+// parsePrefixes parses a comma separated list of CIDR ranges.
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range splitList(value) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid cidr: %w", cidr, err)
 		}
+		prefixes = append(prefixes, prefix)
 	}
-	return nil
+	return prefixes, nil
 }
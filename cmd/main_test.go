@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := map[string]struct {
+		opts     []proxy.Option
+		expected bool
+	}{
+		"valid":                {expected: true},
+		"alt-svc out of range": {opts: []proxy.Option{proxy.WithAltSvc(70000, 0)}},
+		"unbounded idempotency": {
+			opts: []proxy.Option{proxy.WithIdempotency(time.Minute, 0)},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := Config{
+				TargetServer: "http://127.0.0.1:9000",
+				Options:      tt.opts,
+			}
+
+			err := validateConfig(&cfg, false)
+			if valid := err == nil; valid != tt.expected {
+				t.Errorf("valid=%t, got %t: %v", tt.expected, valid, err)
+			}
+		})
+	}
+}
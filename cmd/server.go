@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// Server runs the proxy on its listeners along with its background tasks,
+// the TLS passthrough, HTTP/3 and the admin API when configured.
+type Server struct {
+	cfg    *Config
+	logger *slog.Logger
+	proxy  *proxy.Proxy
+
+	server      http.Server
+	http3Server http3Server
+	adminServer *http.Server
+	errs        chan error
+
+	listeners           []net.Listener
+	passthroughListener net.Listener
+	http3Conn           net.PacketConn
+	adminListener       net.Listener
+
+	//background work is cancelled on shutdown.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+}
+
+// NewServer creates the proxy described by cfg and writes the certificate
+// it serves, nothing listens until Start.
+func NewServer(cfg *Config) (*Server, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	if err := writeCertificate("certificate.cer", "private.pem"); err != nil {
+		return nil, err
+	}
+
+	var opts []proxy.Option
+	//the write timeout bounds requests through their context, buffering the
+	//response to time it out would hold it in memory and keep it from
+	//flushing. REQUEST_TIMEOUT comes later in the options and wins.
+	if cfg.WriteTimeout > 0 {
+		opts = append(opts, proxy.WithRequestTimeout(cfg.WriteTimeout))
+	}
+	//responses advertise HTTP3_HOST unless ALT_SVC_H3_PORT names another
+	//endpoint, a port chosen when listening can not be known here.
+	if cfg.HTTP3Host != "" {
+		_, portSTR, err := net.SplitHostPort(cfg.HTTP3Host)
+		if err != nil {
+			return nil, fmt.Errorf("http3 host %s: %w", cfg.HTTP3Host, err)
+		}
+		if port, err := strconv.Atoi(portSTR); err == nil && port != 0 {
+			opts = append(opts, proxy.WithAltSvc(port, 0))
+		}
+	}
+	opts = append(opts, cfg.Options...)
+	opts = append(opts, proxy.WithBackends(cfg.Backends...))
+	p, err := proxy.New(cfg.TargetServer, cfg.SkipVerify, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("new proxy handler: %w", err)
+	}
+
+	s := Server{
+		cfg:    cfg,
+		logger: logger,
+		proxy:  p,
+		//listeners, passthrough, http3 and admin api each report at most one error.
+		errs: make(chan error, len(cfg.Hosts)+3),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.server = http.Server{
+		Handler:     p,
+		ReadTimeout: cfg.ReadTimeout,
+		ErrorLog:    slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		TLSConfig:   cfg.TLS,
+		//the proxy answers OPTIONS * itself with the methods it forwards.
+		DisableGeneralOptionsHandler: true,
+	}
+
+	if cfg.HTTP3Host != "" {
+		s.http3Server, err = newHTTP3Server(p, cfg.TLS, "certificate.cer", "private.pem")
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return &s, nil
+}
+
+// Listen binds every listener without serving on them yet, so the
+// addresses chosen for ports given as 0 can be read from Addr and Addrs.
+// Connections made before Start wait to be accepted.
+func (s *Server) Listen(ctx context.Context) error {
+	cfg := s.cfg
+
+	//HOST may list several addresses, one server accepts on all of them.
+	listeners, err := cfg.Listen.Listen(ctx, cfg.Hosts)
+	if err != nil {
+		return err
+	}
+
+	//tls passthrough runs next to the terminating server on its own address.
+	if cfg.Passthrough != nil {
+		s.passthroughListener, err = net.Listen("tcp", cfg.PassthroughHost)
+		if err != nil {
+			closeAll(listeners)
+			return fmt.Errorf("listen on %s: %w", cfg.PassthroughHost, err)
+		}
+	}
+
+	//http3 shares the proxy handler over QUIC on a udp socket.
+	if s.http3Server != nil {
+		s.http3Conn, err = net.ListenPacket("udp", cfg.HTTP3Host)
+		if err != nil {
+			closeAll(listeners)
+			if s.passthroughListener != nil {
+				s.passthroughListener.Close()
+				s.passthroughListener = nil
+			}
+			return fmt.Errorf("listen on %s: %w", cfg.HTTP3Host, err)
+		}
+	}
+
+	//the admin api runs on its own address so it stays reachable in maintenance mode.
+	if cfg.AdminHost != "" {
+		s.adminListener, err = net.Listen("tcp", cfg.AdminHost)
+		if err != nil {
+			closeAll(listeners)
+			if s.passthroughListener != nil {
+				s.passthroughListener.Close()
+				s.passthroughListener = nil
+			}
+			if s.http3Conn != nil {
+				s.http3Conn.Close()
+				s.http3Conn = nil
+			}
+			return fmt.Errorf("listen on %s: %w", cfg.AdminHost, err)
+		}
+	}
+
+	s.listeners = listeners
+	return nil
+}
+
+// Start runs the background tasks and warms up the backends, then serves on
+// the listeners, binding them first unless Listen already did. It returns
+// once clients can connect, errors of the servers afterwards are reported
+// on Err.
+func (s *Server) Start(ctx context.Context) error {
+	cfg := s.cfg
+
+	if cfg.DNSRefresher != nil {
+		s.runBackground("dns refresher", cfg.DNSRefresher.Run)
+	}
+
+	if cfg.SRVResolver != nil {
+		cfg.SRVResolver.Proxy = s.proxy
+		s.runBackground("srv resolver", cfg.SRVResolver.Run)
+	}
+
+	if cfg.HealthChecker != nil {
+		cfg.HealthChecker.Proxy = s.proxy
+		s.runBackground("health checker", cfg.HealthChecker.Run)
+	}
+
+	if cfg.CacheJanitor != nil {
+		s.runBackground("cache janitor", cfg.CacheJanitor.Run)
+	}
+
+	//warming up delays listening, a backend not answering in time only costs the timeout.
+	if cfg.WarmupTimeout > 0 {
+		warmupCtx, warmupCancel := context.WithTimeout(ctx, cfg.WarmupTimeout)
+		if err := s.proxy.Warmup(warmupCtx, cfg.WarmupPath); err != nil {
+			s.logger.Warn("warmup incomplete", "err", err)
+		}
+		warmupCancel()
+	}
+
+	if s.listeners == nil {
+		if err := s.Listen(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, listener := range s.listeners {
+		addr := listener.Addr().String()
+
+		//connections are counted as they are accepted, before probes get to
+		//hold them while sniffing.
+		if cfg.MaxConnsPerIP > 0 {
+			listener = proxy.NewConnLimitListener(listener, cfg.MaxConnsPerIP, cfg.TrustedProxies)
+		}
+
+		//load balancer probes are closed quietly instead of logging handshake errors.
+		listener = proxy.NewProbeListener(listener, cfg.TCPHealthCheck)
+
+		go func() {
+			s.logger.Info("proxy server running", "addr", addr)
+			if err := s.server.ServeTLS(listener, "certificate.cer", "private.pem"); !errors.Is(err, http.ErrServerClosed) {
+				s.errs <- err
+			}
+		}()
+	}
+
+	if s.passthroughListener != nil {
+		go func() {
+			s.logger.Info("tls passthrough running", "addr", s.passthroughListener.Addr().String())
+			if err := cfg.Passthrough.Serve(s.passthroughListener); err != nil {
+				s.errs <- err
+			}
+		}()
+	}
+
+	if s.http3Conn != nil {
+		go func() {
+			s.logger.Info("http3 server running", "addr", s.http3Conn.LocalAddr().String())
+			if err := s.http3Server.Serve(s.http3Conn); !errors.Is(err, http.ErrServerClosed) {
+				s.errs <- err
+			}
+		}()
+	}
+
+	if s.adminListener != nil {
+		s.adminServer = &http.Server{
+			Handler:     proxy.NewAdminHandler(s.proxy, cfg.AdminToken),
+			ReadTimeout: cfg.ReadTimeout,
+			ErrorLog:    s.server.ErrorLog,
+		}
+
+		go func() {
+			s.logger.Info("admin api running", "addr", s.adminListener.Addr().String())
+			if err := s.adminServer.Serve(s.adminListener); !errors.Is(err, http.ErrServerClosed) {
+				s.errs <- err
+			}
+		}()
+	}
+
+	s.logger.Info("proxy ready", "addrs", s.Addrs())
+	return nil
+}
+
+// http3Server serves the proxy over QUIC next to the TCP listeners.
+type http3Server interface {
+	Serve(conn net.PacketConn) error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+func (s *Server) runBackground(name string, run func(ctx context.Context) error) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if err := run(s.ctx); err != nil {
+			s.logger.Error("background task stopped", "task", name, "err", err)
+		}
+	}()
+}
+
+// Addr returns the first address the proxy accepts connections on, nil
+// until the listeners are bound.
+func (s *Server) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns every address the proxy accepts connections on, once the
+// listeners are bound.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// HTTP3Addr returns the address HTTP/3 is served on, nil without HTTP3Host
+// or until the listeners are bound.
+func (s *Server) HTTP3Addr() net.Addr {
+	if s.http3Conn == nil {
+		return nil
+	}
+	return s.http3Conn.LocalAddr()
+}
+
+// Err receives the errors servers stop with before Shutdown.
+func (s *Server) Err() <-chan error {
+	return s.errs
+}
+
+// Drain tells clients to reconnect elsewhere for the configured drain
+// timeout, while the load balancer stops sending new ones.
+func (s *Server) Drain(ctx context.Context) {
+	if s.cfg.DrainTimeout <= 0 {
+		return
+	}
+
+	s.logger.Info("draining connections", "timeout", s.cfg.DrainTimeout)
+	s.proxy.SetDraining(true)
+
+	timer := time.NewTimer(s.cfg.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Shutdown stops the background tasks and gracefully shuts down every
+// server, waiting for the requests in flight until ctx is done. Servers
+// still busy by then are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Info("shutting down")
+	s.cancel()
+
+	//both drain concurrently within the same shutdown timeout.
+	passthroughErr := make(chan error, 1)
+	go func() {
+		if s.cfg.Passthrough == nil {
+			passthroughErr <- nil
+			return
+		}
+		passthroughErr <- s.cfg.Passthrough.Shutdown(ctx)
+	}()
+
+	//HTTP/2 clients get GOAWAY and their open streams run to completion.
+	var errs []error
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+		errs = append(errs, err)
+	}
+
+	if err := <-passthroughErr; err != nil {
+		errs = append(errs, fmt.Errorf("passthrough: %w", err))
+	}
+
+	//the udp socket outlives the http3 server and is closed with the listeners.
+	if s.http3Server != nil {
+		if err := s.http3Server.Shutdown(ctx); err != nil {
+			s.http3Server.Close()
+			errs = append(errs, fmt.Errorf("http3: %w", err))
+		}
+	}
+
+	//health stays reachable until client traffic drained.
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			s.adminServer.Close()
+			errs = append(errs, fmt.Errorf("admin: %w", err))
+		}
+	}
+
+	//listeners bound but never served are left to close here.
+	closeAll(s.listeners)
+	for _, listener := range []net.Listener{s.passthroughListener, s.adminListener} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+	if s.http3Conn != nil {
+		s.http3Conn.Close()
+	}
+
+	s.background.Wait()
+	s.proxy.Close()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("graceful shutdown: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// writeCertificate generates the self-signed certificate the proxy serves
+// and writes it along with its key.
+func writeCertificate(certPath, keyPath string) error {
+	//generate private key
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("generate private key: %w", err)
+	}
+	now := time.Now()
+	then := now.Add(time.Hour * 24 * 365) //one year later
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:   "reverse.proxy.name",
+			Organization: []string{"Reverse-Proxy"},
+		},
+		NotBefore:             now,
+		NotAfter:              then,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &private.PublicKey, private)
+	if err != nil {
+		return fmt.Errorf("create certificate: %w", err)
+	}
+
+	certFile, err := os.Create(certPath)
+	if err != nil {
+		return fmt.Errorf("create cert file: %w", err)
+	}
+	defer certFile.Close()
+
+	if err := pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}); err != nil {
+		return fmt.Errorf("encode into pem: %w", err)
+	}
+
+	privateFile, err := os.Create(keyPath)
+	if err != nil {
+		return fmt.Errorf("create private file: %w", err)
+	}
+
+	defer privateFile.Close()
+
+	if err := pem.Encode(privateFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}); err != nil {
+		return fmt.Errorf("encode private key: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the test from a temporary directory, the server writes its
+// certificate to the working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working dir: %s", err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("failed to change working dir: %s", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestServer(t *testing.T) {
+	inTempDir(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	}))
+	defer backend.Close()
+
+	server, err := NewServer(&Config{
+		TargetServer:    backend.URL,
+		Hosts:           []string{"127.0.0.1:0"},
+		ReadTimeout:     time.Second,
+		WriteTimeout:    time.Second,
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	resp, err := client.Get("https://" + server.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if string(bs) != "Hello World!" {
+		t.Errorf("body=%s, got %s", "Hello World!", string(bs))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shut down: %s", err)
+	}
+
+	//the listener is closed once shut down.
+	if _, err := client.Get("https://" + server.Addrs()[0].String()); err == nil {
+		t.Error("expected requests to fail after shutdown")
+	}
+}
+
+func TestServerEphemeralPort(t *testing.T) {
+	inTempDir(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server, err := NewServer(&Config{
+		TargetServer: backend.URL,
+		Hosts:        []string{"127.0.0.1:0"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	if server.Addr() != nil {
+		t.Fatalf("expected no address before listening, got %s", server.Addr())
+	}
+
+	if err := server.Listen(context.Background()); err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	addr, ok := server.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("expected a port to be assigned, got %s", server.Addr())
+	}
+
+	//the port is bound already, the connection waits until the server serves.
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", addr, err)
+	}
+	conn.Close()
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+
+	if got := server.Addr().String(); got != addr.String() {
+		t.Errorf("addr=%s, got %s", addr, got)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	resp, err := client.Get("https://" + addr.String())
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestServerStreaming(t *testing.T) {
+	inTempDir(t)
+
+	received := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+
+		//the rest only comes once the client got the first chunk.
+		select {
+		case <-received:
+		case <-time.After(time.Second * 2):
+		}
+		io.WriteString(w, "second")
+	}))
+	defer backend.Close()
+
+	server, err := NewServer(&Config{
+		TargetServer:    backend.URL,
+		Hosts:           []string{"127.0.0.1:0"},
+		ReadTimeout:     time.Second,
+		WriteTimeout:    time.Second,
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	resp, err := client.Get("https://" + server.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, len("first"))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("failed to read the first chunk: %s", err)
+	}
+	if string(buf) != "first" {
+		t.Fatalf("first chunk=first, got %s", buf)
+	}
+	close(received)
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+
+	if string(rest) != "second" {
+		t.Errorf("rest=second, got %s", rest)
+	}
+}
+
+func TestServerConnLimitBeforeProbes(t *testing.T) {
+	inTempDir(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server, err := NewServer(&Config{
+		TargetServer:    backend.URL,
+		Hosts:           []string{"127.0.0.1:0"},
+		MaxConnsPerIP:   1,
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	addr := server.Addrs()[0].String()
+
+	//an idle connection still sniffed for probes holds the only slot.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", addr, err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	extra, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", addr, err)
+	}
+	defer extra.Close()
+
+	extra.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := extra.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection over the limit to be closed, got %v", err)
+	}
+}
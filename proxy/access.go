@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// peerAddr returns the address of the connection r arrived on.
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// trusted reports whether ip belongs to a proxy allowed to report client
+// addresses through X-Forwarded-For.
+func (p *Proxy) trusted(ip netip.Addr) bool {
+	return containsAddr(p.trustedProxies, ip)
+}
+
+// clientIP returns the address of the client sending r. Requests arriving
+// from a trusted proxy are attributed to the last X-Forwarded-For entry not
+// added by a trusted proxy.
+func (p *Proxy) clientIP(r *http.Request) (netip.Addr, bool) {
+	ip, ok := peerAddr(r)
+	if !ok || !p.trusted(ip) {
+		return ip, ok
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			//a malformed entry ends what can be believed.
+			break
+		}
+
+		ip = hop.Unmap()
+		if !p.trusted(ip) {
+			break
+		}
+	}
+	return ip, true
+}
+
+// forwardedFor returns the X-Forwarded-For value sent to the backend. The
+// chain reported by a trusted proxy is kept, anything else is replaced by
+// the peer address.
+func (p *Proxy) forwardedFor(r *http.Request) (string, error) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	prior := strings.Join(r.Header.Values("X-Forwarded-For"), ", ")
+	if ip, ok := peerAddr(r); ok && p.trusted(ip) && prior != "" {
+		return prior + ", " + peer, nil
+	}
+	return peer, nil
+}
+
+// clientAllowed reports whether the allow and deny lists let the client of
+// r through. Denied ranges win over allowed ones.
+func (p *Proxy) clientAllowed(r *http.Request) bool {
+	if len(p.allowIPs) == 0 && len(p.denyIPs) == 0 {
+		return true
+	}
+
+	ip, ok := p.clientIP(r)
+	if !ok {
+		return len(p.allowIPs) == 0
+	}
+
+	if containsAddr(p.denyIPs, ip) {
+		return false
+	}
+	return len(p.allowIPs) == 0 || containsAddr(p.allowIPs, ip)
+}
+
+// GeoHook looks up where ip is located, returning its country code and
+// whether it may reach the proxy. An empty country leaves the request
+// untagged.
+type GeoHook func(ip net.IP) (country string, allowed bool)
+
+// applyGeo runs the geo hook for the client of r, tagging r with the
+// country for the backend. It reports whether the client is allowed.
+func (p *Proxy) applyGeo(r *http.Request) bool {
+	//only the hook may tell the backend where a client is.
+	r.Header.Del("X-Geo-Country")
+
+	ip, ok := p.clientIP(r)
+	if !ok {
+		return true
+	}
+
+	country, allowed := p.geoHook(net.IP(ip.AsSlice()))
+	if !allowed {
+		return false
+	}
+
+	if country != "" {
+		r.Header.Set("X-Geo-Country", country)
+	}
+	return true
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
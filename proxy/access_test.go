@@ -0,0 +1,148 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestIPAccessLists(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false,
+		proxy.WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")),
+		proxy.WithIPAllowlist(netip.MustParsePrefix("192.168.0.0/16")),
+		proxy.WithIPDenylist(netip.MustParsePrefix("192.168.66.0/24")),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		remoteAddr     string
+		forwardedFor   string
+		expectedStatus int
+		expectedBody   string
+	}{
+		"allowed ip": {
+			remoteAddr:     "192.168.1.10:4000",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "192.168.1.10",
+		},
+		"denied cidr": {
+			remoteAddr:     "192.168.66.7:4000",
+			expectedStatus: http.StatusForbidden,
+		},
+		"not on the allowlist": {
+			remoteAddr:     "172.16.0.1:4000",
+			expectedStatus: http.StatusForbidden,
+		},
+		"allowed client behind a trusted proxy": {
+			remoteAddr:     "10.0.0.2:4000",
+			forwardedFor:   "192.168.1.10, 10.0.0.1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "192.168.1.10, 10.0.0.1, 10.0.0.2",
+		},
+		"denied client behind a trusted proxy": {
+			remoteAddr:     "10.0.0.2:4000",
+			forwardedFor:   "192.168.66.7",
+			expectedStatus: http.StatusForbidden,
+		},
+		"untrusted peer forwarding for an allowed ip": {
+			remoteAddr:     "172.16.0.1:4000",
+			forwardedFor:   "192.168.1.10",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, rec.Code)
+			}
+
+			if tt.expectedBody != "" && rec.Body.String() != tt.expectedBody {
+				t.Errorf("body=%q, got %q", tt.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGeoHook(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Geo-Country"))
+	}))
+	defer backend.Close()
+
+	hook := func(ip net.IP) (string, bool) {
+		switch ip.String() {
+		case "203.0.113.9":
+			return "XX", false
+		case "198.51.100.4":
+			return "NL", true
+		}
+		return "", true
+	}
+
+	p, err := proxy.New(backend.URL, false, proxy.WithGeoHook(hook))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		remoteAddr      string
+		expectedStatus  int
+		expectedCountry string
+	}{
+		"blocked": {
+			remoteAddr:     "203.0.113.9:4000",
+			expectedStatus: http.StatusForbidden,
+		},
+		"tagged": {
+			remoteAddr:      "198.51.100.4:4000",
+			expectedStatus:  http.StatusOK,
+			expectedCountry: "NL",
+		},
+		"unknown": {
+			remoteAddr:     "192.0.2.1:4000",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			//clients can not pick their own country.
+			req.Header.Set("X-Geo-Country", "spoofed")
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, rec.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK && rec.Body.String() != tt.expectedCountry {
+				t.Errorf("country=%q, got %q", tt.expectedCountry, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// accessRecorder captures the status and body size of a response for the
+// access log. It passes flushes and hijacks through so streams and upgrades
+// keep working.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessRecorder) WriteHeader(status int) {
+	//informational responses such as 100 Continue are followed by the real one.
+	if a.status == 0 && status >= http.StatusOK {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessRecorder) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessRecorder) Flush() {
+	http.NewResponseController(a.ResponseWriter).Flush()
+}
+
+func (a *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(a.ResponseWriter).Hijack()
+	if err == nil && a.status == 0 {
+		a.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (a *accessRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// serveLogged serves r and writes an access log line for it. When the
+// backend echoed a request ID of its own it is logged too, so proxy and
+// backend logs can be correlated. Responses aborted halfway are logged too
+// before the abort goes on.
+func (p *Proxy) serveLogged(w http.ResponseWriter, r *http.Request) {
+	method, path, remote := r.Method, r.URL.Path, r.RemoteAddr
+	start := time.Now()
+
+	rec := &accessRecorder{ResponseWriter: w}
+	defer func() {
+		aborted := recover()
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		attrs := []any{
+			"method", method,
+			"path", path,
+			"remote", remote,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+		}
+
+		if p.backendRequestID != "" {
+			if id := rec.Header().Get(p.backendRequestID); id != "" {
+				attrs = append(attrs, "backend_request_id", id)
+			}
+		}
+
+		if aborted != nil {
+			attrs = append(attrs, "aborted", true)
+		}
+		p.logger.Info("request", attrs...)
+
+		if aborted != nil {
+			panic(aborted)
+		}
+	}()
+
+	p.serve(rec, r)
+}
@@ -0,0 +1,139 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// recordHandler keeps every log record it handles.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+// attrs returns the attributes of the records with msg.
+func (h *recordHandler) attrs(msg string) []map[string]slog.Value {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var found []map[string]slog.Value
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		found = append(found, attrs)
+	}
+	return found
+}
+
+func TestAccessLogBackendRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Request-ID", "req-42")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "created")
+	}))
+	defer backend.Close()
+
+	var handler recordHandler
+	p, err := proxy.New(backend.URL, false,
+		proxy.WithLogger(slog.New(&handler)),
+		proxy.WithAccessLog("X-Backend-Request-ID"),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/items", nil))
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status=%d, got %d", http.StatusCreated, rec.Code)
+	}
+
+	entries := handler.attrs("request")
+	if len(entries) != 1 {
+		t.Fatalf("access log entries=1, got %d", len(entries))
+	}
+
+	expected := map[string]string{
+		"method":             "POST",
+		"path":               "/items",
+		"status":             "201",
+		"bytes":              "7",
+		"backend_request_id": "req-42",
+	}
+
+	for key, value := range expected {
+		if got := entries[0][key].String(); got != value {
+			t.Errorf("%s=%q, got %q", key, value, got)
+		}
+	}
+}
+
+func TestAccessLogAborted(t *testing.T) {
+	//the backend promises more than it sends, the copy to the client fails.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\ntruncated")
+		brw.Flush()
+	}))
+	defer backend.Close()
+
+	var handler recordHandler
+	p, err := proxy.New(backend.URL, false,
+		proxy.WithLogger(slog.New(&handler)),
+		proxy.WithAccessLog(""),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("expected the response to be aborted, got %v", recovered)
+			}
+		}()
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download", nil))
+	}()
+
+	entries := handler.attrs("request")
+	if len(entries) != 1 {
+		t.Fatalf("access log entries=1, got %d", len(entries))
+	}
+
+	if got := entries[0]["aborted"].String(); got != "true" {
+		t.Errorf("aborted=%q, got %q", "true", got)
+	}
+
+	if got := entries[0]["path"].String(); got != "/download" {
+		t.Errorf("path=%q, got %q", "/download", got)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SetMaintenance turns maintenance mode on or off, it is safe to call while
+// the proxy is serving. In maintenance mode every request is answered with
+// 503 and the maintenance page instead of being forwarded.
+func (p *Proxy) SetMaintenance(enabled bool) {
+	p.maintenance.Store(enabled)
+}
+
+// Maintenance reports whether the proxy is in maintenance mode.
+func (p *Proxy) Maintenance() bool {
+	return p.maintenance.Load()
+}
+
+// serveMaintenance answers a request while the proxy is in maintenance mode.
+func (p *Proxy) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if p.maintenancePage == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "service is under maintenance")
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(p.maintenancePage))
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.maintenancePage)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(p.maintenancePage)
+}
+
+// NewAdminHandler returns the admin API of p, meant to be served on its own
+// address away from client traffic:
+//
+//	GET    /health             200 while the proxy process is up, even in maintenance.
+//	GET    /admin/maintenance  reports whether maintenance mode is on.
+//	POST   /admin/maintenance  sets it from the enabled form value, toggling it when missing.
+//	DELETE /admin/cache        purges the response cached for the url form value, all of them when missing.
+//	GET    /admin/stats        reports the requests and body bytes served by every backend.
+//
+// The /admin endpoints require token as a bearer token.
+func NewAdminHandler(p *Proxy, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK\n"))
+	})
+
+	mux.HandleFunc("GET /admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeMaintenance(w, p.Maintenance())
+	})
+
+	mux.HandleFunc("POST /admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		enabled := !p.Maintenance()
+		if value := r.FormValue("enabled"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "enabled must be true or false")
+				return
+			}
+			enabled = parsed
+		}
+
+		p.SetMaintenance(enabled)
+		p.logger.Info("maintenance mode changed", "enabled", enabled, "remote", r.RemoteAddr)
+		writeMaintenance(w, enabled)
+	})
+
+	mux.HandleFunc("DELETE /admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("url")
+
+		var err error
+		if target == "" {
+			err = p.ClearCache()
+		} else {
+			err = p.PurgeCache(target)
+		}
+
+		if err != nil {
+			writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+
+		p.logger.Info("cache purged", "url", target, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Backends map[string]BackendStats `json:"backends"`
+		}{p.BackendStats()})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") && !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r carries token as its bearer token. An empty
+// token authorizes nobody.
+func authorized(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeMaintenance(w http.ResponseWriter, enabled bool) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Maintenance bool `json:"maintenance"`
+	}{enabled})
+}
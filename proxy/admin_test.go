@@ -0,0 +1,193 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	}))
+	defer server.Close()
+
+	page := []byte("<html><body>Back soon</body></html>")
+	p, err := proxy.New(server.URL, false, proxy.WithMaintenancePage(page))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+	admin := proxy.NewAdminHandler(p, "secret")
+
+	call := func(h http.Handler, method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if rec := call(p, http.MethodGet, "/", ""); rec.Code != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+
+	//only the token holder may toggle the mode.
+	if rec := call(admin, http.MethodPost, "/admin/maintenance?enabled=true", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status=%d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	if p.Maintenance() {
+		t.Fatalf("expected maintenance to stay off")
+	}
+
+	rec := call(admin, http.MethodPost, "/admin/maintenance?enabled=true", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"maintenance":true}` {
+		t.Errorf("body=%q, got %q", `{"maintenance":true}`, body)
+	}
+
+	rec = call(p, http.MethodGet, "/", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status=%d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	if rec.Body.String() != string(page) {
+		t.Errorf("body=%q, got %q", page, rec.Body.String())
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("content-type=%q, got %q", "text/html; charset=utf-8", ct)
+	}
+
+	if rec := call(admin, http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("health status=%d, got %d", http.StatusOK, rec.Code)
+	}
+
+	//without a value the mode is toggled.
+	if rec := call(admin, http.MethodPost, "/admin/maintenance", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+
+	if rec := call(p, http.MethodGet, "/", ""); rec.Code != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	p, err := proxy.New("http://localhost:8080", false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		configured string
+		sent       string
+		expected   int
+	}{
+		"missing":      {configured: "secret", expected: http.StatusUnauthorized},
+		"wrong":        {configured: "secret", sent: "Bearer nope", expected: http.StatusUnauthorized},
+		"not bearer":   {configured: "secret", sent: "Basic secret", expected: http.StatusUnauthorized},
+		"no token set": {sent: "Bearer ", expected: http.StatusUnauthorized},
+		"correct":      {configured: "secret", sent: "Bearer secret", expected: http.StatusOK},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/maintenance", nil)
+			if tt.sent != "" {
+				req.Header.Set("Authorization", tt.sent)
+			}
+			recorder := httptest.NewRecorder()
+			proxy.NewAdminHandler(p, tt.configured).ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expected {
+				t.Errorf("status=%d, got %d", tt.expected, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestAdminCachePurge(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithCache(proxy.NewMemoryCache(10)))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+	admin := proxy.NewAdminHandler(p, "secret")
+
+	get := func(path string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+		}
+	}
+
+	purge := func(query string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, "/admin/cache"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusNoContent {
+			t.Fatalf("status=%d, got %d", http.StatusNoContent, recorder.Code)
+		}
+	}
+
+	get("/a?v=1")
+	get("/b")
+	get("/a?v=1")
+	get("/b")
+	if hits.Load() != 2 {
+		t.Fatalf("backend hits=2, got %d", hits.Load())
+	}
+
+	purge("?url=" + url.QueryEscape("http://example.com/a?v=1"))
+	get("/a?v=1")
+	get("/b")
+	if hits.Load() != 3 {
+		t.Errorf("after purging /a backend hits=3, got %d", hits.Load())
+	}
+
+	purge("")
+	get("/a?v=1")
+	get("/b")
+	if hits.Load() != 5 {
+		t.Errorf("after clearing backend hits=5, got %d", hits.Load())
+	}
+}
+
+func TestAdminCachePurgeWithoutCache(t *testing.T) {
+	p, err := proxy.New("http://localhost:8080", false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/cache", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	proxy.NewAdminHandler(p, "secret").ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status=%d, got %d", http.StatusConflict, recorder.Code)
+	}
+}
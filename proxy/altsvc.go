@@ -0,0 +1,16 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// altSvc returns the Alt-Svc value advertising HTTP/3 on port. Clients
+// assume 24 hours when maxAge is zero.
+func altSvc(port int, maxAge time.Duration) string {
+	value := fmt.Sprintf(`h3=":%d"`, port)
+	if maxAge > 0 {
+		value += fmt.Sprintf("; ma=%d", int64(maxAge/time.Second))
+	}
+	return value
+}
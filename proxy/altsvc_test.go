@@ -0,0 +1,57 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestAltSvc(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":9443"`)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		opts     []proxy.Option
+		expected string
+	}{
+		"disabled": {
+			expected: `h3=":9443"`,
+		},
+		"port and max age": {
+			opts:     []proxy.Option{proxy.WithAltSvc(443, time.Hour)},
+			expected: `h3=":443"; ma=3600`,
+		},
+		"no max age": {
+			opts:     []proxy.Option{proxy.WithAltSvc(8443, 0)},
+			expected: `h3=":8443"`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, false, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if got := recorder.Header().Values("Alt-Svc"); len(got) != 1 || got[0] != tt.expected {
+				t.Errorf("alt-svc=%q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAltSvcInvalidPort(t *testing.T) {
+	if _, err := proxy.New("http://localhost:8080", false, proxy.WithAltSvc(70000, time.Hour)); err == nil {
+		t.Errorf("expected an error for an out of range port")
+	}
+}
@@ -0,0 +1,606 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errRequestTimeout is the cause of a request context cancelled because the
+// request timeout ran out.
+var errRequestTimeout = errors.New("request timeout exhausted")
+
+// attemptsKey is the context key of the counter of backend attempts made
+// for a request.
+type attemptsKey struct{}
+
+// withAttemptCounter returns a context that counts the backend attempts made
+// by roundTrip.
+func withAttemptCounter(ctx context.Context) (context.Context, *atomic.Int32) {
+	attempts := new(atomic.Int32)
+	return context.WithValue(ctx, attemptsKey{}, attempts), attempts
+}
+
+// Backend is an upstream server requests are forwarded to.
+type Backend struct {
+	//URL of the backend, its path is a base path prepended to forwarded
+	//request paths and its query is merged into theirs.
+	URL *url.URL
+
+	//Weight is the relative share of requests the backend receives, values
+	//below one count as one.
+	Weight int
+
+	//Priority groups backends, only the backends with the lowest value
+	//receive new requests, the others are used when retrying.
+	Priority int
+
+	//HealthCheck probes the backend instead of the health checker's own
+	//check when set.
+	HealthCheck *HealthCheck
+
+	//Protocol is the HTTP version requests are sent to the backend with,
+	//they follow the protocol of the client by default.
+	Protocol Protocol
+
+	//ServerName is the TLS server name sent and verified when dialing the
+	//backend, in place of the one set by WithServerName or its host.
+	ServerName string
+
+	//Headers are set on every request sent to the backend after the
+	//director ran, replacing the values of the same headers. They often
+	//hold credentials, so they are never logged.
+	Headers http.Header
+}
+
+func (b *Backend) weight() int {
+	return max(b.Weight, 1)
+}
+
+// LogValue logs the backend by its URL and the names of its headers only,
+// keeping their values out of the logs.
+func (b *Backend) LogValue() slog.Value {
+	names := make([]string, 0, len(b.Headers))
+	for name := range b.Headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return slog.GroupValue(
+		slog.String("url", b.URL.Redacted()),
+		slog.Any("headers", names),
+	)
+}
+
+// pool is a set of interchangeable backends with its balancing state.
+type pool struct {
+	mu       sync.RWMutex
+	backends []*Backend
+	balancer balancer
+	down     map[string]bool          //backends failing their health check, by backendKey.
+	latency  map[string]time.Duration //average health probe latency, by backendKey.
+}
+
+func newPool(backends []*Backend) *pool {
+	var p pool
+	p.balancer = newWeightedRoundRobin(p.effectiveWeight)
+	p.set(backends)
+	return &p
+}
+
+// set replaces the backends of the pool, empty lists are ignored.
+func (p *pool) set(backends []*Backend) {
+	if len(backends) == 0 {
+		return
+	}
+
+	sorted := slices.Clone(backends)
+	slices.SortStableFunc(sorted, func(a, b *Backend) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+
+	p.mu.Lock()
+	p.backends = sorted
+	for key := range p.latency {
+		if !slices.ContainsFunc(sorted, func(b *Backend) bool { return backendKey(b.URL) == key }) {
+			delete(p.latency, key)
+		}
+	}
+	p.mu.Unlock()
+
+	//balancers may ask the pool for weights, they are reset without holding its lock.
+	p.balancer.reset()
+}
+
+// track tells the balancer about a request sent to the backend at host
+// when it is steered by response times, the returned function records the
+// outcome.
+func (p *pool) track(host string) func(failed bool) {
+	if e, ok := p.balancer.(*peakEWMA); ok {
+		if backend, found := p.find(host); found {
+			return e.track(backendKey(backend))
+		}
+	}
+	return func(bool) {}
+}
+
+// list returns the backends of the pool ordered by priority.
+func (p *pool) list() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// next returns the backend for a new request, nil when the pool is empty.
+// Backends failing their health check are skipped unless none is healthy.
+func (p *pool) next() *url.URL {
+	backends := p.healthy()
+	if len(backends) == 0 {
+		return nil
+	}
+	return p.balancer.next(backends).URL
+}
+
+// healthy returns the backends of the pool not marked down, all of them when
+// every backend is down.
+func (p *pool) healthy() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.down) == 0 {
+		return p.backends
+	}
+
+	healthy := make([]*Backend, 0, len(p.backends))
+	for _, backend := range p.backends {
+		if !p.down[backendKey(backend.URL)] {
+			healthy = append(healthy, backend)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return p.backends
+	}
+	return healthy
+}
+
+// setHealthy records the health check result of backend.
+func (p *pool) setHealthy(backend *url.URL, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down == nil {
+		p.down = make(map[string]bool)
+	}
+
+	key := backendKey(backend)
+	if healthy {
+		delete(p.down, key)
+		return
+	}
+	p.down[key] = true
+}
+
+// isHealthy reports whether backend passed its last health check, backends
+// never checked are healthy.
+func (p *pool) isHealthy(backend *url.URL) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.down[backendKey(backend)]
+}
+
+// find returns the backend whose host is host.
+func (p *pool) find(host string) (*url.URL, bool) {
+	for _, backend := range p.list() {
+		if strings.EqualFold(backend.URL.Host, host) {
+			return backend.URL, true
+		}
+	}
+	return nil, false
+}
+
+// backend returns the backend u is addressed to.
+func (p *pool) backend(u *url.URL) (*Backend, bool) {
+	for _, backend := range p.list() {
+		if strings.EqualFold(backend.URL.Host, u.Host) && backend.URL.Scheme == u.Scheme {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+// after returns the backend following current in the pool, it is the one a
+// failed attempt against current is retried on.
+func (p *pool) after(current *url.URL) *url.URL {
+	backends := p.list()
+	for i, backend := range backends {
+		if backend.URL.Host == current.Host && backend.URL.Scheme == current.Scheme {
+			return backends[(i+1)%len(backends)].URL
+		}
+	}
+	return backends[0].URL
+}
+
+// SetBackends replaces the default backends requests are forwarded to, it
+// is safe to call while the proxy is serving. Empty lists are ignored.
+// Malformed and duplicate URLs are left out and logged, the rest of the list
+// is applied. The backends are left untouched when no valid one remains or
+// there are more than allowed by WithMaxBackends.
+func (p *Proxy) SetBackends(backends []*Backend) error {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	valid := make([]*Backend, 0, len(backends))
+	seen := make(map[string]bool)
+	for _, backend := range backends {
+		if backend.URL == nil {
+			p.logger.Warn("skipping backend", "err", "backend without url")
+			continue
+		}
+
+		if _, err := parseBackendURL(backend.URL.String()); err != nil {
+			p.logger.Warn("skipping backend", "err", err)
+			continue
+		}
+
+		if !validProtocol(backend.Protocol) {
+			p.logger.Warn("skipping backend", "err", fmt.Sprintf("backend %s: unknown protocol %q", backend.URL, backend.Protocol))
+			continue
+		}
+
+		key := backendKey(backend.URL)
+		if seen[key] {
+			p.logger.Warn("skipping backend", "err", fmt.Sprintf("backend %s is listed more than once", backend.URL))
+			continue
+		}
+		seen[key] = true
+		valid = append(valid, backend)
+	}
+
+	if len(valid) == 0 {
+		return fmt.Errorf("invalid backends: none of the %d backends is valid", len(backends))
+	}
+
+	if err := checkBackendCount(len(valid), p.maxBackends); err != nil {
+		return fmt.Errorf("invalid backends: %w", err)
+	}
+
+	p.pool.set(valid)
+	p.serverNames.set(valid)
+	return nil
+}
+
+// Backends returns the default backends requests are forwarded to, ordered
+// by priority.
+func (p *Proxy) Backends() []*Backend {
+	return p.pool.list()
+}
+
+// preferredBackendKey is the context key of the backend set by WithBackend.
+type preferredBackendKey struct{}
+
+// WithBackend returns a copy of ctx asking the proxy to forward the request
+// to backend instead of the one its balancer picks, for routing middleware
+// in front of the proxy. The request is balanced as usual when backend is
+// not one of the backends it may be forwarded to or failed its health check.
+func WithBackend(ctx context.Context, backend *url.URL) context.Context {
+	return context.WithValue(ctx, preferredBackendKey{}, backend)
+}
+
+// preferredBackend returns the backend of pl set for r by WithBackend, nil
+// when there is none or it can not be used.
+func preferredBackend(r *http.Request, pl *pool) *url.URL {
+	preferred, ok := r.Context().Value(preferredBackendKey{}).(*url.URL)
+	if !ok || preferred == nil {
+		return nil
+	}
+
+	backend, ok := pl.backend(preferred)
+	if !ok || !pl.isHealthy(backend.URL) {
+		return nil
+	}
+	return backend.URL
+}
+
+// poolKey is the context key of the pool a request is forwarded to.
+type poolKey struct{}
+
+// poolFor returns the pool r is forwarded to.
+func (p *Proxy) poolFor(r *http.Request) *pool {
+	if pl, ok := r.Context().Value(poolKey{}).(*pool); ok {
+		return pl
+	}
+	return p.pool
+}
+
+// balancer picks the backends of a pool for new requests.
+type balancer interface {
+	//next picks the backend for a request from backends sorted by priority.
+	next(backends []*Backend) *Backend
+	//reset drops the selection state, it is called when the backends change.
+	reset()
+}
+
+// weightedRoundRobin spreads requests across the backends of the preferred
+// priority group in proportion to their weights, using the smooth weighted
+// round-robin algorithm so heavier backends are not picked in bursts.
+type weightedRoundRobin struct {
+	weight func(*Backend) int
+
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func newWeightedRoundRobin(weight func(*Backend) int) *weightedRoundRobin {
+	return &weightedRoundRobin{
+		weight:  weight,
+		current: make(map[*Backend]int),
+	}
+}
+
+// next picks the backend for a request from backends sorted by priority.
+func (w *weightedRoundRobin) next(backends []*Backend) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, backend := range backends {
+		if backend.Priority != backends[0].Priority {
+			break
+		}
+
+		weight := w.weight(backend)
+		w.current[backend] += weight
+		total += weight
+		if best == nil || w.current[backend] > w.current[best] {
+			best = backend
+		}
+	}
+
+	w.current[best] -= total
+	return best
+}
+
+// reset drops the selection state, it must be called when the backends
+// change.
+func (w *weightedRoundRobin) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clear(w.current)
+}
+
+// roundTrip sends r to its backend, when that fails and r can be replayed
+// the following backends are tried until one responds or the configured
+// retries run out.
+func (p *Proxy) roundTrip(r *http.Request) (*http.Response, error) {
+	pl := p.poolFor(r)
+
+	attempts := 1
+	if canRetry(r) {
+		//r is already addressed to a backend, it is sent even when the pool
+		//emptied in the meantime.
+		attempts = max(1, min(1+p.retries, len(pl.list())))
+	}
+
+	var err error
+	for i := range attempts {
+		if i > 0 {
+			r = addressedTo(r, pl.after(r.URL), p.preserveHost)
+		}
+
+		if counter, ok := r.Context().Value(attemptsKey{}).(*atomic.Int32); ok {
+			counter.Add(1)
+		}
+
+		backend, _ := pl.backend(r.URL)
+		attempt := p.prepareAttempt(r, backend)
+
+		req, recordCasing := traceHeaderCasing(p.conns.trace(attempt))
+
+		release := func() {}
+		if p.connLifetime > 0 {
+			req, release = traceConnLifetime(req)
+		}
+
+		finish := pl.track(r.URL.Host)
+		start := time.Now()
+		var resp *http.Response
+		resp, err = p.clientFor(r, backend).Do(req)
+		//a request the client gave up on says nothing about the backend.
+		finish(err != nil && r.Context().Err() == nil)
+		if err == nil {
+			if p.concurrency != nil {
+				p.concurrency.observe(start, time.Since(start))
+			}
+			recordCasing()
+			p.recordRequestEncodings(backend, resp)
+			resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+		release()
+
+		//the request timeout or the client ended the request, no point in retrying.
+		if r.Context().Err() != nil {
+			break
+		}
+	}
+
+	if cause := context.Cause(r.Context()); errors.Is(cause, errRequestTimeout) {
+		return nil, cause
+	}
+	return nil, err
+}
+
+// prepareAttempt returns the request sent to backend for r once the director
+// ran and the backend headers and request compression were applied, r itself
+// when none of them applies.
+func (p *Proxy) prepareAttempt(r *http.Request, backend *Backend) *http.Request {
+	gzipBody := p.gzipsRequest(r, backend)
+	if p.director == nil && !gzipBody && (backend == nil || len(backend.Headers) == 0) {
+		return r
+	}
+
+	//every attempt starts over from the request addressed to its backend.
+	attempt := r.Clone(r.Context())
+	if p.director != nil {
+		p.director(attempt)
+	}
+
+	if backend != nil {
+		for name, values := range backend.Headers {
+			attempt.Header[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+		}
+	}
+
+	if gzipBody {
+		gzipRequestBody(attempt)
+	}
+	return attempt
+}
+
+// clientFor returns the client used to send r to backend, through the
+// transport of its protocol when it has one. gRPC calls may stream for as
+// long as the call lasts, so they are not bound by the client timeout.
+func (p *Proxy) clientFor(r *http.Request, backend *Backend) *http.Client {
+	client := p.backendClient(backend)
+	if !IsGRPC(r) {
+		return client
+	}
+
+	return &http.Client{
+		Transport:     client.Transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+	}
+}
+
+// backendClient returns the client requests to backend are sent with.
+func (p *Proxy) backendClient(backend *Backend) *http.Client {
+	if backend == nil {
+		return p.Client
+	}
+
+	transport := p.protocols.transport(backend)
+	if transport == nil {
+		return p.Client
+	}
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: p.Client.CheckRedirect,
+		Jar:           p.Client.Jar,
+	}
+}
+
+// IsGRPC reports whether r is a gRPC call. Like upgrades, gRPC calls
+// stream and must not be wrapped in handlers that buffer or time out the
+// response.
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// canRetry reports whether r can be sent again after a failed attempt, which
+// is only possible when it has no body or the body can be recreated.
+func canRetry(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// addressedTo returns a copy of r addressed to backend.
+func addressedTo(r *http.Request, backend *url.URL, preserveHost bool) *http.Request {
+	req := r.Clone(r.Context())
+	addressTo(req, backend, preserveHost)
+
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			req.Body = body
+		}
+	}
+	return req
+}
+
+// clientURLKey is the context key of the URL as the client sent it, before
+// the base path of a backend was added to it. Its host is the Host header of
+// the client.
+type clientURLKey struct{}
+
+// withClientURL records the URL of r as the client sent it.
+func withClientURL(r *http.Request) *http.Request {
+	clientURL := *r.URL
+	clientURL.Host = r.Host
+	return r.WithContext(context.WithValue(r.Context(), clientURLKey{}, &clientURL))
+}
+
+// clientHost returns the host the client sent r to, in lower case, the Host
+// of r may name the backend already.
+func clientHost(r *http.Request) string {
+	if u, ok := r.Context().Value(clientURLKey{}).(*url.URL); ok {
+		return strings.ToLower(u.Host)
+	}
+	return strings.ToLower(r.Host)
+}
+
+// addressTo points r at backend. The path of backend is a base path the
+// client path is appended to, and its query is merged with the client query.
+// With preserveHost the Host header stays the one the client sent, only the
+// URL names the backend to dial.
+func addressTo(r *http.Request, backend *url.URL, preserveHost bool) {
+	clientURL := r.URL
+	if u, ok := r.Context().Value(clientURLKey{}).(*url.URL); ok {
+		clientURL = u
+	}
+
+	if !preserveHost {
+		r.Host = backend.Host
+	}
+	r.URL.Host = backend.Host
+	r.URL.Scheme = backend.Scheme
+	r.URL.Path, r.URL.RawPath = joinURLPath(backend, clientURL)
+
+	switch {
+	case backend.RawQuery == "":
+		r.URL.RawQuery = clientURL.RawQuery
+	case clientURL.RawQuery == "":
+		r.URL.RawQuery = backend.RawQuery
+	default:
+		r.URL.RawQuery = backend.RawQuery + "&" + clientURL.RawQuery
+	}
+}
+
+// joinURLPath appends the path of client to the base path of backend with a
+// single slash between them, keeping the escaping of both.
+func joinURLPath(backend, client *url.URL) (string, string) {
+	if backend.Path == "" {
+		return client.Path, client.RawPath
+	}
+
+	basePath, clientPath := backend.EscapedPath(), client.EscapedPath()
+	baseSlash := strings.HasSuffix(basePath, "/")
+	clientSlash := strings.HasPrefix(clientPath, "/")
+
+	var path, rawPath string
+	switch {
+	case baseSlash && clientSlash:
+		path, rawPath = backend.Path+client.Path[1:], basePath+clientPath[1:]
+	case !baseSlash && !clientSlash:
+		path, rawPath = backend.Path+"/"+client.Path, basePath+"/"+clientPath
+	default:
+		path, rawPath = backend.Path+client.Path, basePath+clientPath
+	}
+
+	if backend.RawPath == "" && client.RawPath == "" {
+		//the default encoding of path is right, no raw path needed.
+		return path, ""
+	}
+	return path, rawPath
+}
@@ -0,0 +1,478 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestRetryNextBackend(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing.Close() //connections to it are refused.
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(failing.URL, true, proxy.WithBackends(server.URL), proxy.WithRetries(1))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing.Close()
+
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second * 3):
+			fmt.Fprint(w, "too late")
+		case <-r.Context().Done():
+		}
+	}
+
+	slow1 := httptest.NewServer(http.HandlerFunc(slow))
+	defer slow1.Close()
+
+	slow2 := httptest.NewServer(http.HandlerFunc(slow))
+	defer slow2.Close()
+
+	budget := time.Millisecond * 500
+	p, err := proxy.New(failing.URL, true,
+		proxy.WithBackends(slow1.URL, slow2.URL),
+		proxy.WithRetries(2),
+		proxy.WithRequestTimeout(budget),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+
+	start := time.Now()
+	p.ServeHTTP(recorder, req)
+	elapsed := time.Since(start)
+
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("status=%d, got %d", http.StatusGatewayTimeout, recorder.Code)
+	}
+
+	//a single attempt may take up to the 1s response header timeout, the budget must cut it short.
+	if elapsed > budget+time.Millisecond*250 {
+		t.Errorf("expected request to finish within %s, took %s", budget, elapsed)
+	}
+}
+
+func TestRequestTimeoutReleasesBackend(t *testing.T) {
+	tests := map[string]struct {
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectAbort    bool
+	}{
+		"slow headers": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(time.Second * 3):
+				case <-r.Context().Done():
+				}
+			},
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		"slow body": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "10")
+				fmt.Fprint(w, "Hello")
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(time.Second * 3):
+					fmt.Fprint(w, "World")
+				case <-r.Context().Done():
+				}
+			},
+			expectedStatus: http.StatusOK,
+			expectAbort:    true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			released := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(released)
+				tt.handler(w, r)
+			}))
+			defer server.Close()
+
+			budget := time.Millisecond * 200
+			p, err := proxy.New(server.URL, false, proxy.WithRequestTimeout(budget))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+
+			var aborted bool
+			start := time.Now()
+			func() {
+				defer func() {
+					aborted = recover() == http.ErrAbortHandler
+				}()
+				p.ServeHTTP(recorder, req)
+			}()
+			elapsed := time.Since(start)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			//the status is sent already, a cut body can only be told by aborting.
+			if aborted != tt.expectAbort {
+				t.Errorf("aborted=%t, got %t", tt.expectAbort, aborted)
+			}
+
+			if elapsed > budget+time.Millisecond*250 {
+				t.Errorf("expected request to finish within %s, took %s", budget, elapsed)
+			}
+
+			//the backend only returns early when the proxy dropped its connection.
+			select {
+			case <-released:
+			case <-time.After(time.Second):
+				t.Errorf("backend request was not cancelled")
+			}
+		})
+	}
+}
+
+func TestRetryCountHeader(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		debug    bool
+		expected string
+	}{
+		"debug enabled": {
+			debug:    true,
+			expected: "1",
+		},
+		"debug disabled": {
+			debug:    false,
+			expected: "",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(failing.URL, true,
+				proxy.WithBackends(server.URL),
+				proxy.WithRetries(1),
+				proxy.WithDebug(tt.debug),
+			)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+			}
+
+			if got := recorder.Header().Get("X-Proxy-Retry-Count"); got != tt.expected {
+				t.Errorf("X-Proxy-Retry-Count=%q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackendBasePath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	defer server.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing.Close()
+
+	tests := map[string]struct {
+		backend  string
+		opts     []proxy.Option
+		path     string
+		expected string
+	}{
+		"root": {
+			backend:  server.URL + "/service-a",
+			path:     "/",
+			expected: "/service-a/",
+		},
+		"trailing slash": {
+			backend:  server.URL + "/service-a/",
+			path:     "/users/1",
+			expected: "/service-a/users/1",
+		},
+		"queries": {
+			backend:  server.URL + "/service-a?version=2",
+			path:     "/users?id=1",
+			expected: "/service-a/users?version=2&id=1",
+		},
+		"escaped": {
+			backend:  server.URL + "/service-a",
+			path:     "/files/a%2Fb",
+			expected: "/service-a/files/a%2Fb",
+		},
+		"normalized first": {
+			backend:  server.URL + "/service-a",
+			opts:     []proxy.Option{proxy.WithPathNormalization(false)},
+			path:     "/public/../admin",
+			expected: "/service-a/admin",
+		},
+		"retried": {
+			backend:  failing.URL + "/service-a",
+			opts:     []proxy.Option{proxy.WithBackends(server.URL + "/service-b"), proxy.WithRetries(1)},
+			path:     "/users",
+			expected: "/service-b/users",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(tt.backend, true, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Body.String() != tt.expected {
+				t.Errorf("path=%s, got %s", tt.expected, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestProxyTargetHeader(t *testing.T) {
+	var servers []*httptest.Server
+	for _, name := range []string{"a", "b", "c"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Proxy-Target") != "" {
+				t.Errorf("expected X-Proxy-Target to be removed before forwarding")
+			}
+			if r.URL.Path == "/healthz" && name == "c" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, name)
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	tests := map[string]struct {
+		debug          bool
+		unhealthy      bool
+		target         string
+		expectedStatus int
+		expectedBodies []string
+	}{
+		"pinned": {
+			debug:          true,
+			target:         servers[2].Listener.Addr().String(),
+			expectedStatus: http.StatusOK,
+			expectedBodies: []string{"c", "c", "c"},
+		},
+		"unhealthy backend": {
+			debug:          true,
+			unhealthy:      true,
+			target:         servers[2].Listener.Addr().String(),
+			expectedStatus: http.StatusOK,
+			expectedBodies: []string{"a", "b", "a"},
+		},
+		"unknown backend": {
+			debug:          true,
+			target:         "10.0.0.1:80",
+			expectedStatus: http.StatusBadRequest,
+		},
+		"debug disabled": {
+			debug:          false,
+			target:         servers[2].Listener.Addr().String(),
+			expectedStatus: http.StatusOK,
+			expectedBodies: []string{"a", "b", "c"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(servers[0].URL, true,
+				proxy.WithBackends(servers[1].URL, servers[2].URL),
+				proxy.WithDebug(tt.debug),
+			)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			if tt.unhealthy {
+				checker := proxy.HealthChecker{Proxy: p, HealthCheck: proxy.HealthCheck{Path: "/healthz"}}
+				if err := checker.Check(context.Background()); err == nil {
+					t.Fatal("expected backend c to fail its check")
+				}
+			}
+
+			for i := range 3 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Proxy-Target", tt.target)
+				recorder := httptest.NewRecorder()
+				p.ServeHTTP(recorder, req)
+
+				if recorder.Code != tt.expectedStatus {
+					t.Fatalf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+				}
+
+				if tt.expectedBodies == nil {
+					return
+				}
+
+				if recorder.Body.String() != tt.expectedBodies[i] {
+					t.Errorf("backend=%s, got %s", tt.expectedBodies[i], recorder.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestBackendHeaders(t *testing.T) {
+	tokens := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Host + " " + r.Header.Get("X-Internal-Token")
+	})
+
+	a := httptest.NewServer(handler)
+	defer a.Close()
+
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	aURL, _ := url.Parse(a.URL)
+	bURL, _ := url.Parse(b.URL)
+
+	p, err := proxy.New(a.URL, false, proxy.WithDirector(func(r *http.Request) {
+		r.Header.Set("X-Internal-Token", "from the director")
+	}))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	backends := []*proxy.Backend{
+		{URL: aURL, Headers: http.Header{"X-Internal-Token": {"secret"}}},
+		{URL: bURL},
+	}
+	if err := p.SetBackends(backends); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	expected := map[string]bool{
+		aURL.Host + " secret":            true,
+		bURL.Host + " from the director": true,
+	}
+	for range 2 {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+		}
+
+		got := <-tokens
+		if !expected[got] {
+			t.Errorf("unexpected backend request %q", got)
+		}
+		delete(expected, got)
+	}
+
+	var logs strings.Builder
+	slog.New(slog.NewTextHandler(&logs, nil)).Info("backend", "backend", backends[0])
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("expected the header value to be left out of %q", logs.String())
+	}
+}
+
+func TestWithBackend(t *testing.T) {
+	var hits [2]atomic.Int32
+	var urls []*url.URL
+	for i := range hits {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+		}))
+		defer backend.Close()
+
+		u, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatalf("failed to parse backend url: %s", err)
+		}
+		urls = append(urls, u)
+	}
+
+	p, err := proxy.New(urls[0].String(), false, proxy.WithBackends(urls[1].String()))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		preferred *url.URL
+		expected  [2]int32
+	}{
+		{name: "forced backend", preferred: urls[1], expected: [2]int32{0, 4}},
+		{name: "unknown backend", preferred: &url.URL{Scheme: "http", Host: "unknown.internal"}, expected: [2]int32{2, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 4 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req = req.WithContext(proxy.WithBackend(req.Context(), tt.preferred))
+
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+				}
+			}
+
+			for i := range hits {
+				if got := hits[i].Load(); got != tt.expected[i] {
+					t.Errorf("backend %d: hits=%d, got %d", i, tt.expected[i], got)
+				}
+			}
+		})
+	}
+}
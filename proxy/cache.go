@@ -0,0 +1,616 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheBodySize is the largest response body that is stored in the cache.
+const maxCacheBodySize = 10 << 20
+
+// defaultCacheStatuses are the statuses stored in the cache unless
+// WithCacheStatuses says otherwise, those RFC 9110 makes cacheable by
+// default that the proxy can replay as they are.
+var defaultCacheStatuses = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusNotFound,
+	http.StatusGone,
+}
+
+// defaultCacheMethods are the methods served from the cache unless
+// WithCacheMethods says otherwise.
+var defaultCacheMethods = []string{http.MethodGet, http.MethodHead}
+
+// CacheEntry is a stored upstream response.
+type CacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Trailer    http.Header
+	StoredAt   time.Time
+	Expires    time.Time
+
+	//StaleWhileRevalidate is how long past Expires the entry may still be
+	//served while it is refreshed in the background.
+	StaleWhileRevalidate time.Duration
+
+	//StaleIfError is how long past Expires the entry may still be served
+	//when the backends fail.
+	StaleIfError time.Duration
+
+	//Vary lists the request headers the response varies on. An entry stored
+	//under the primary key with no body only records the Vary list, the
+	//response itself lives under the variant key.
+	Vary []string
+}
+
+// response returns the entry as an upstream response.
+func (e *CacheEntry) response(now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.StoredAt).Seconds())))
+
+	return &http.Response{
+		StatusCode: e.StatusCode,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(e.Body)),
+		Trailer:    e.Trailer.Clone(),
+	}
+}
+
+// usableUntil returns when the entry can no longer be served, not even
+// stale.
+func (e *CacheEntry) usableUntil() time.Time {
+	return e.Expires.Add(max(e.StaleWhileRevalidate, e.StaleIfError))
+}
+
+// Cache stores upstream responses by key.
+type Cache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string)
+	Clear()
+}
+
+// MemoryCache is an in-memory Cache bounded by number of entries, the least
+// recently used entry is evicted first.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// NewMemoryCache creates a MemoryCache holding at most maxEntries entries.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored under key.
+func (c *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+// Set stores entry under key, evicting the least recently used entry when
+// the cache is full.
+func (c *MemoryCache) Set(key string, entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*memoryItem).entry = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&memoryItem{key: key, entry: entry})
+
+	if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*memoryItem).key)
+	}
+}
+
+// Delete removes the entry stored under key.
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// Clear removes every entry.
+func (c *MemoryCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	clear(c.items)
+}
+
+// EvictExpired removes the entries that can no longer be served at now,
+// past their freshness lifetime and their stale-while-revalidate and
+// stale-if-error windows, and returns how many were removed.
+func (c *MemoryCache) EvictExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := 0
+	for key, el := range c.items {
+		entry := el.Value.(*memoryItem).entry
+		if now.Before(entry.usableUntil()) {
+			continue
+		}
+		c.ll.Remove(el)
+		delete(c.items, key)
+		evicted++
+	}
+	return evicted
+}
+
+// CacheJanitor sweeps the expired entries out of a MemoryCache, so stale
+// responses do not hold memory until they are requested again.
+type CacheJanitor struct {
+	Cache    *MemoryCache
+	Interval time.Duration //how often the cache is swept.
+	Clock    Clock         //the system clock when nil.
+	Logger   *slog.Logger  //slog.Default when nil.
+}
+
+// Run sweeps the cache on every interval until ctx is cancelled.
+func (j *CacheJanitor) Run(ctx context.Context) error {
+	if j.Interval <= 0 {
+		return errors.New("cache janitor interval must be positive")
+	}
+
+	clock := clockOrDefault(j.Clock)
+	for sleep(ctx, clock, j.Interval) {
+		if evicted := j.Cache.EvictExpired(clock.Now()); evicted > 0 {
+			loggerOrDefault(j.Logger).Debug("cache swept", "evicted", evicted)
+		}
+	}
+	return nil
+}
+
+// PurgeCache removes the cached response for target, a URL such as
+// https://example.com/a?v=1, so the next request for it goes to a backend.
+// The host is the one clients send, responses are cached per host and it
+// picks the route the response was cached for.
+func (p *Proxy) PurgeCache(target string) error {
+	if p.cache == nil {
+		return errors.New("cache is not enabled")
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("parse url: %w", err)
+	}
+
+	r := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)}
+	if rt := p.match(r); rt != nil {
+		r = r.WithContext(context.WithValue(context.Background(), routeKey{}, rt))
+	}
+
+	//variants are only found through the primary entry, dropping it is enough.
+	for _, method := range p.cacheMethods {
+		r.Method = method
+		key, _ := p.cacheKey(r)
+		p.cache.Delete(key)
+	}
+	return nil
+}
+
+// ClearCache removes every cached response.
+func (p *Proxy) ClearCache() error {
+	if p.cache == nil {
+		return errors.New("cache is not enabled")
+	}
+
+	p.cache.Clear()
+	return nil
+}
+
+// cacheKey returns the primary cache key of r and whether r may be served
+// from the cache.
+func (p *Proxy) cacheKey(r *http.Request) (string, bool) {
+	if !slices.Contains(p.cacheMethods, r.Method) {
+		return "", false
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		return "", false
+	}
+
+	if _, ok := parseCacheControl(r.Header)["no-store"]; ok {
+		return "", false
+	}
+
+	//requests are spread across backends, the client host keeps virtual
+	//hosts apart, not the backend host.
+	return routePrefix(r) + r.Method + " " + clientHost(r) + r.URL.RequestURI(), true
+}
+
+// variantKey extends the primary key with the values r has for the headers
+// the response varies on.
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the sorted, canonical header names listed in the Vary
+// response header.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fetch returns the response for r, served from the cache when a fresh
+// entry exists and stored in it when the response allows. A stale entry
+// stands in for the response when the backends fail.
+func (p *Proxy) fetch(r *http.Request) (*http.Response, error) {
+	if p.cache == nil {
+		return p.do(r)
+	}
+
+	key, ok := p.cacheKey(r)
+	if !ok {
+		return p.do(r)
+	}
+
+	if resp, fresh, ok := p.lookup(key, r); ok {
+		if !fresh {
+			p.revalidate(key, r)
+		}
+		return resp, nil
+	}
+
+	resp, err := p.do(r)
+	if err != nil || isServerError(resp.StatusCode) {
+		if stale, ok := p.lookupStale(key, r); ok {
+			if err == nil {
+				resp.Body.Close()
+				err = fmt.Errorf("backend answered %d", resp.StatusCode)
+			}
+			p.logger.Warn("serving stale cache entry", "key", key, "err", err)
+			return stale, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.store(key, r, resp)
+	return resp, nil
+}
+
+// lookup returns the cached response for r and whether it is still fresh.
+// Stale responses are only returned inside their stale-while-revalidate
+// window.
+func (p *Proxy) lookup(key string, r *http.Request) (*http.Response, bool, bool) {
+	now := p.cacheClock.Now()
+
+	entry, ok := p.entry(key, r)
+	if !ok {
+		return nil, false, false
+	}
+
+	if now.Before(entry.Expires) {
+		return entry.response(now), true, true
+	}
+
+	if now.Before(entry.Expires.Add(entry.StaleWhileRevalidate)) {
+		return entry.response(now), false, true
+	}
+
+	return nil, false, false
+}
+
+// lookupStale returns the cached response for r once the backends failed to
+// serve it, as long as it is inside its stale-if-error window. The response
+// warns it could not be revalidated.
+func (p *Proxy) lookupStale(key string, r *http.Request) (*http.Response, bool) {
+	now := p.cacheClock.Now()
+
+	entry, ok := p.entry(key, r)
+	if !ok || !now.Before(entry.Expires.Add(entry.StaleIfError)) {
+		return nil, false
+	}
+
+	resp := entry.response(now)
+	resp.Header.Add("Warning", `111 - "Revalidation Failed"`)
+	return resp, true
+}
+
+// entry returns the entry stored for r under key, following its Vary list.
+func (p *Proxy) entry(key string, r *http.Request) (*CacheEntry, bool) {
+	entry, ok := p.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	if len(entry.Vary) > 0 {
+		return p.cache.Get(variantKey(key, entry.Vary, r))
+	}
+	return entry, true
+}
+
+// serveStale answers r from the cache when no backend is available, stale
+// entries are served inside their stale-if-error window. It reports whether
+// r was answered.
+func (p *Proxy) serveStale(w http.ResponseWriter, r *http.Request) bool {
+	if p.cache == nil {
+		return false
+	}
+
+	key, ok := p.cacheKey(r)
+	if !ok {
+		return false
+	}
+
+	resp, _, ok := p.lookup(key, r)
+	if !ok {
+		if resp, ok = p.lookupStale(key, r); !ok {
+			return false
+		}
+	}
+	defer resp.Body.Close()
+
+	maps.Copy(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// isServerError reports whether status tells the backend failed, the
+// statuses a stale-if-error entry stands in for.
+func isServerError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// revalidate refreshes the entry for r in the background, at most one
+// refresh per key runs at a time.
+func (p *Proxy) revalidate(key string, r *http.Request) {
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	if _, loaded := p.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	//the client is served already, the refresh must outlive its request but not the proxy.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stop := context.AfterFunc(p.ctx, cancel)
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+
+	p.background.Add(1)
+	go func() {
+		defer p.background.Done()
+		defer p.revalidating.Delete(key)
+		defer stop()
+		defer cancel()
+
+		resp, err := p.do(req)
+		if err != nil {
+			p.logger.Error("revalidate cache entry", "key", key, "err", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		p.store(key, req, resp)
+		io.Copy(io.Discard, resp.Body)
+	}()
+}
+
+// store arranges for resp to be cached under key once its body has been
+// fully read by the client copy.
+func (p *Proxy) store(key string, r *http.Request, resp *http.Response) {
+	if !slices.Contains(p.cacheStatuses, resp.StatusCode) {
+		return
+	}
+
+	//a cookie set for one client must not be handed to the others.
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return
+	}
+
+	lifetime, ok := freshnessLifetime(resp.Header, p.cacheClock.Now())
+	if !ok {
+		return
+	}
+	cc := parseCacheControl(resp.Header)
+	staleWhileRevalidate := directiveSeconds(cc, "stale-while-revalidate")
+	staleIfError := directiveSeconds(cc, "stale-if-error")
+
+	vary := varyHeaders(resp.Header)
+	for _, name := range vary {
+		if name == "*" {
+			return
+		}
+	}
+
+	//capture the request values now, r can be reused once ServeHTTP returns.
+	storeKey := key
+	if len(vary) > 0 {
+		storeKey = variantKey(key, vary, r)
+	}
+
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		onEOF: func(body []byte) {
+			now := p.cacheClock.Now()
+			if len(vary) > 0 {
+				p.cache.Set(key, &CacheEntry{
+					StoredAt:             now,
+					Expires:              now.Add(lifetime),
+					StaleWhileRevalidate: staleWhileRevalidate,
+					StaleIfError:         staleIfError,
+					Vary:                 vary,
+				})
+			}
+
+			p.cache.Set(storeKey, &CacheEntry{
+				StatusCode:           resp.StatusCode,
+				Header:               resp.Header.Clone(),
+				Body:                 body,
+				Trailer:              resp.Trailer.Clone(),
+				StoredAt:             now,
+				Expires:              now.Add(lifetime),
+				StaleWhileRevalidate: staleWhileRevalidate,
+				StaleIfError:         staleIfError,
+				Vary:                 vary,
+			})
+		},
+	}
+}
+
+// freshnessLifetime returns how long a response may be served from the
+// cache, based on its Cache-Control and Expires headers. Responses without a
+// Date are taken as sent at now.
+func freshnessLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(h)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	if expires := h.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+
+		if lifetime := expiresAt.Sub(date); lifetime > 0 {
+			return lifetime, true
+		}
+	}
+
+	return 0, false
+}
+
+// directiveSeconds returns the value of a delta-seconds directive, zero when
+// absent or invalid.
+func directiveSeconds(cc map[string]string, directive string) time.Duration {
+	seconds, err := strconv.Atoi(cc[directive])
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parseCacheControl parses the Cache-Control header into its directives.
+func parseCacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, val, _ := strings.Cut(part, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+	}
+	return directives
+}
+
+// recordingBody keeps a copy of everything read from the body and hands it
+// to onEOF once the body was read completely.
+type recordingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	onEOF    func(body []byte)
+	overflow bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		b.buf.Write(p[:n])
+		if b.buf.Len() > maxCacheBodySize {
+			b.overflow = true
+			b.buf.Reset()
+		}
+	}
+
+	if err == io.EOF && !b.overflow && b.onEOF != nil {
+		b.onEOF(b.buf.Bytes())
+		b.onEOF = nil
+	}
+	return n, err
+}
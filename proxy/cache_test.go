@@ -0,0 +1,462 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestCacheVary(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		fmt.Fprint(w, r.Header.Get("Accept-Encoding"))
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCache(proxy.NewMemoryCache(10)))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		expectedBody   string
+		expectedHits   int32
+	}{
+		{name: "gzip miss", acceptEncoding: "gzip", expectedBody: "gzip", expectedHits: 1},
+		{name: "identity miss", acceptEncoding: "identity", expectedBody: "identity", expectedHits: 2},
+		{name: "gzip hit", acceptEncoding: "gzip", expectedBody: "gzip", expectedHits: 2},
+		{name: "identity hit", acceptEncoding: "identity", expectedBody: "identity", expectedHits: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			bs, err := io.ReadAll(recorder.Body)
+			if err != nil {
+				t.Fatalf("failed to read response body: %s", err)
+			}
+
+			if string(bs) != tt.expectedBody {
+				t.Errorf("body=%s, got %s", tt.expectedBody, string(bs))
+			}
+
+			if got := hits.Load(); got != tt.expectedHits {
+				t.Errorf("hits=%d, got %d", tt.expectedHits, got)
+			}
+		})
+	}
+}
+
+func TestCacheVaryStar(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "*")
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCache(proxy.NewMemoryCache(10)))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+	}
+
+	expectedHits := int32(2)
+	if got := hits.Load(); got != expectedHits {
+		t.Errorf("hits=%d, got %d", expectedHits, got)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit := hits.Add(1)
+		if hit > 1 {
+			//the refresh is slow, the stale response must not wait for it.
+			time.Sleep(time.Millisecond * 500)
+		}
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=10")
+		fmt.Fprintf(w, "version#%d", hit)
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCache(proxy.NewMemoryCache(10)))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	get := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		return recorder.Body.String()
+	}
+
+	if body := get(); body != "version#1" {
+		t.Fatalf("body=%s, got %s", "version#1", body)
+	}
+
+	//let the entry expire into its stale-while-revalidate window.
+	time.Sleep(time.Millisecond * 1100)
+
+	start := time.Now()
+	if body := get(); body != "version#1" {
+		t.Errorf("stale body=%s, got %s", "version#1", body)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Millisecond*250 {
+		t.Errorf("expected stale response to be served immediately, took %s", elapsed)
+	}
+
+	//wait for the background refresh to land in the cache.
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		body := get()
+		if body == "version#2" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected cache to be refreshed in the background, got %s", body)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	expectedHits := int32(2)
+	if got := hits.Load(); got != expectedHits {
+		t.Errorf("hits=%d, got %d", expectedHits, got)
+	}
+}
+
+func TestCacheableStatusesAndMethods(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "not found")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true,
+		proxy.WithCache(proxy.NewMemoryCache(10)),
+		proxy.WithCacheStatuses(http.StatusOK, http.StatusNotFound),
+		proxy.WithCacheMethods(http.MethodGet),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		expectedHits int32
+	}{
+		{name: "404 miss", method: http.MethodGet, path: "/missing", expectedHits: 1},
+		{name: "404 hit", method: http.MethodGet, path: "/missing", expectedHits: 1},
+		{name: "HEAD is not cacheable", method: http.MethodHead, path: "/missing", expectedHits: 2},
+		{name: "private miss", method: http.MethodGet, path: "/private", expectedHits: 3},
+		{name: "private is never stored", method: http.MethodGet, path: "/private", expectedHits: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("status=%d, got %d", http.StatusNotFound, recorder.Code)
+			}
+
+			if got := hits.Load(); got != tt.expectedHits {
+				t.Errorf("hits=%d, got %d", tt.expectedHits, got)
+			}
+		})
+	}
+}
+
+func TestCacheHead(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCache(proxy.NewMemoryCache(10)))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	for range 2 {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/resource", nil))
+	}
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("hits=1, got %d", got)
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	clock := newFakeClock()
+	cache := proxy.NewMemoryCache(0)
+
+	now := clock.Now()
+	cache.Set("short", &proxy.CacheEntry{StoredAt: now, Expires: now.Add(time.Minute)})
+	cache.Set("revalidating", &proxy.CacheEntry{StoredAt: now, Expires: now.Add(time.Minute), StaleWhileRevalidate: time.Hour})
+	cache.Set("long", &proxy.CacheEntry{StoredAt: now, Expires: now.Add(2 * time.Hour)})
+
+	janitor := proxy.CacheJanitor{Cache: cache, Interval: time.Minute, Clock: clock}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- janitor.Run(ctx) }()
+
+	//waits for the janitor to be parked on the clock between sweeps.
+	parked := func() {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for clock.waiting() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("janitor never waited for its next sweep")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		expected map[string]bool
+	}{
+		{name: "fresh", advance: 0, expected: map[string]bool{"short": true, "revalidating": true, "long": true}},
+		{name: "short expired", advance: time.Minute, expected: map[string]bool{"short": false, "revalidating": true, "long": true}},
+		{name: "revalidation window over", advance: time.Hour, expected: map[string]bool{"revalidating": false, "long": true}},
+		{name: "all expired", advance: time.Hour, expected: map[string]bool{"long": false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.advance > 0 {
+				parked()
+				clock.advance(tt.advance)
+				//the sweep is done once the janitor waits again.
+				parked()
+			}
+
+			for key, expected := range tt.expected {
+				if _, ok := cache.Get(key); ok != expected {
+					t.Errorf("%s cached=%t, got %t", key, expected, ok)
+				}
+			}
+		})
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("failed to run janitor: %s", err)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	var failing atomic.Bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		cc := "max-age=1"
+		if r.URL.Path == "/resilient" {
+			cc += ", stale-if-error=60"
+		}
+		w.Header().Set("Cache-Control", cc)
+		fmt.Fprint(w, "cached")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCache(proxy.NewMemoryCache(10)))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	for _, path := range []string{"/resilient", "/plain"} {
+		if rec := get(path); rec.Code != http.StatusOK {
+			t.Fatalf("%s status=%d, got %d", path, http.StatusOK, rec.Code)
+		}
+	}
+
+	//let the entries expire, then break the backend.
+	time.Sleep(time.Millisecond * 1100)
+	failing.Store(true)
+
+	if rec := get("/plain"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status without stale-if-error=%d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	assertStale := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("stale status=%d, got %d", http.StatusOK, rec.Code)
+		}
+
+		if body := rec.Body.String(); body != "cached" {
+			t.Errorf("stale body=%s, got %s", "cached", body)
+		}
+
+		expectedWarning := `111 - "Revalidation Failed"`
+		if got := rec.Header().Get("Warning"); got != expectedWarning {
+			t.Errorf("Warning=%s, got %s", expectedWarning, got)
+		}
+	}
+
+	//the backend answers with an error.
+	assertStale(get("/resilient"))
+
+	//the backend is gone altogether.
+	server.Close()
+	assertStale(get("/resilient"))
+}
+
+func TestCacheKeyedByHost(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/session" {
+			w.Header().Set("Set-Cookie", "session="+r.Host)
+		}
+		fmt.Fprint(w, r.Host)
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true,
+		proxy.WithCache(proxy.NewMemoryCache(10)),
+		proxy.WithPreserveHostHeader(true),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	get := func(host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	//virtual hosts behind the same backend get their own entries.
+	for range 2 {
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			if body := get(host, "/").Body.String(); body != host {
+				t.Errorf("body=%s, got %s", host, body)
+			}
+		}
+	}
+
+	if got := hits.Load(); got != 2 {
+		t.Errorf("hits=2, got %d", got)
+	}
+
+	//responses setting cookies are not cached.
+	get("a.example.com", "/session")
+	rec := get("a.example.com", "/session")
+	if got := hits.Load(); got != 4 {
+		t.Errorf("hits with cookies=4, got %d", got)
+	}
+
+	if cookie := rec.Header().Get("Set-Cookie"); cookie != "session=a.example.com" {
+		t.Errorf("Set-Cookie=%s, got %s", "session=a.example.com", cookie)
+	}
+}
+
+func TestCacheClock(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	p, err := proxy.New(server.URL, true,
+		proxy.WithCache(proxy.NewMemoryCache(10)),
+		proxy.WithClock(clock),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		advance      time.Duration
+		expectedHits int32
+		expectedAge  string
+	}{
+		{name: "miss", expectedHits: 1},
+		{name: "fresh", advance: 30 * time.Second, expectedHits: 1, expectedAge: "30"},
+		{name: "expired", advance: 31 * time.Second, expectedHits: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.advance(tt.advance)
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/resource", nil))
+
+			if got := hits.Load(); got != tt.expectedHits {
+				t.Errorf("hits=%d, got %d", tt.expectedHits, got)
+			}
+
+			if got := recorder.Header().Get("Age"); got != tt.expectedAge {
+				t.Errorf("age=%q, got %q", tt.expectedAge, got)
+			}
+		})
+	}
+}
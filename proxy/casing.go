@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+)
+
+// maxHeaderCapture bounds how many bytes of a response are inspected for
+// header names.
+const maxHeaderCapture = 64 << 10
+
+// casingConn records the header names of every response read from the
+// connection exactly as the backend wrote them, before the transport
+// canonicalizes them.
+type casingConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	capturing bool
+	buf       []byte
+	names     map[string]string //canonical name to name as sent.
+}
+
+func (c *casingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	//a request is being sent, the next bytes read start its response.
+	c.capturing = true
+	c.buf = c.buf[:0]
+	c.mu.Unlock()
+
+	return c.Conn.Write(p)
+}
+
+func (c *casingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mu.Lock()
+	if c.capturing {
+		c.buf = append(c.buf, p[:n]...)
+		c.capture()
+	}
+	c.mu.Unlock()
+
+	return n, err
+}
+
+// capture parses the header block once it has been read completely,
+// skipping interim 1xx responses.
+func (c *casingConn) capture() {
+	for {
+		end := bytes.Index(c.buf, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(c.buf) > maxHeaderCapture {
+				c.capturing = false
+				c.buf = c.buf[:0]
+			}
+			return
+		}
+
+		block := string(c.buf[:end])
+		c.buf = c.buf[end+4:]
+
+		statusLine, headers, _ := strings.Cut(block, "\r\n")
+		if strings.HasPrefix(statusLine, "HTTP/1.1 1") || strings.HasPrefix(statusLine, "HTTP/1.0 1") {
+			//interim response, the final one follows.
+			continue
+		}
+
+		names := make(map[string]string)
+		for _, line := range strings.Split(headers, "\r\n") {
+			name, _, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			names[http.CanonicalHeaderKey(name)] = name
+		}
+
+		c.names = names
+		c.capturing = false
+		c.buf = c.buf[:0]
+		return
+	}
+}
+
+// headerNames returns the header names of the last response read.
+func (c *casingConn) headerNames() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.names
+}
+
+// headerCasingKey is the context key of the headerCasing of a request.
+type headerCasingKey struct{}
+
+// headerCasing carries the original header names of the backend response
+// from roundTrip back to ServeHTTP.
+type headerCasing struct {
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func (h *headerCasing) set(names map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names = names
+}
+
+func (h *headerCasing) get() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.names
+}
+
+// withHeaderCasing returns a context collecting the original header names
+// of the backend response.
+func withHeaderCasing(ctx context.Context) (context.Context, *headerCasing) {
+	casing := new(headerCasing)
+	return context.WithValue(ctx, headerCasingKey{}, casing), casing
+}
+
+// traceHeaderCasing arranges for the original header names of the response
+// to r to be recorded in the headerCasing of its context. The returned
+// function must be called once the response headers are read.
+func traceHeaderCasing(r *http.Request) (*http.Request, func()) {
+	casing, ok := r.Context().Value(headerCasingKey{}).(*headerCasing)
+	if !ok {
+		return r, func() {}
+	}
+
+	var conn *casingConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, _ = info.Conn.(*casingConn)
+		},
+	}
+
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	return r, func() {
+		if conn != nil {
+			casing.set(conn.headerNames())
+		}
+	}
+}
+
+// preserveHeaderCasing makes the transport dial connections that record the
+// original response header names. TLS is done by the proxy so the recorded
+// bytes are plain text, which limits backend connections to HTTP/1.1.
+func preserveHeaderCasing(t *http.Transport, names *serverNames) {
+	dial := t.DialContext
+
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &casingConn{Conn: conn}, nil
+	}
+
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		tlsConn, err := dialTLS(ctx, dial, network, addr, names.config(t.TLSClientConfig, addr), t.TLSHandshakeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &casingConn{Conn: tlsConn}, nil
+	}
+}
@@ -0,0 +1,133 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestPreserveHeaderCase(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//assigning the map directly keeps the casing on the wire.
+		w.Header()["X-MiXeD-Case"] = []string{"1"}
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		preserve     bool
+		expectedName string
+	}{
+		"preserved": {
+			preserve:     true,
+			expectedName: "X-MiXeD-Case",
+		},
+		"canonical by default": {
+			preserve:     false,
+			expectedName: "X-Mixed-Case",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, true, proxy.WithPreserveHeaderCase(tt.preserve))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			//read the raw response, the http client would canonicalize names.
+			conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+			if err != nil {
+				t.Fatalf("failed to dial proxy server: %s", err)
+			}
+			defer conn.Close()
+
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+
+			reader := textproto.NewReader(bufio.NewReader(conn))
+			if _, err := reader.ReadLine(); err != nil {
+				t.Fatalf("failed to read status line: %s", err)
+			}
+
+			var names []string
+			for {
+				line, err := reader.ReadLine()
+				if err != nil {
+					t.Fatalf("failed to read header line: %s", err)
+				}
+				if line == "" {
+					break
+				}
+				name, _, _ := strings.Cut(line, ":")
+				names = append(names, name)
+			}
+
+			found := false
+			for _, name := range names {
+				if name == tt.expectedName {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("expected header %s in response, got %v", tt.expectedName, names)
+			}
+		})
+	}
+}
+
+func TestPreserveHeaderCaseHandshakeTimeout(t *testing.T) {
+	//accepts connections but never answers the tls handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer silent.Close()
+
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	p, err := proxy.New("https://"+silent.Addr().String(), true, proxy.WithPreserveHeaderCase(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+	//the transport gives up after its one second handshake timeout.
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the handshake to time out, it took %s", elapsed)
+	}
+
+	if recorder.Code == http.StatusOK {
+		t.Errorf("expected the request to fail, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestChunkedTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum, X-Parts")
+		w.WriteHeader(http.StatusOK)
+
+		//flushing without a content length makes the response chunked.
+		for i := range 3 {
+			fmt.Fprintf(w, "part %d\n", i)
+			w.(http.Flusher).Flush()
+		}
+
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Add("X-Parts", "1")
+		w.Header().Add("X-Parts", "2")
+		w.Header().Set(http.TrailerPrefix+"X-Unannounced", "late")
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+		t.Errorf("transfer encoding=[chunked], got %v", resp.TransferEncoding)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+
+	if string(body) != "part 0\npart 1\npart 2\n" {
+		t.Errorf("body=%q, got %q", "part 0\npart 1\npart 2\n", body)
+	}
+
+	expected := http.Header{
+		"X-Checksum":    {"abc123"},
+		"X-Parts":       {"1", "2"},
+		"X-Unannounced": {"late"},
+	}
+
+	for key, values := range expected {
+		if got := resp.Trailer.Values(key); !slices.Equal(got, values) {
+			t.Errorf("trailer %s=%v, got %v", key, values, got)
+		}
+	}
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	chunks := []string{"first chunk\n", "second\n", "the third and last chunk\n"}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range chunks {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+			//sooner than the proxy flushes streams of unknown length on its own.
+			time.Sleep(2 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	//the chunk framing is hidden by http.Client, it is read off the wire.
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", server.Listener.Addr())
+	br := bufio.NewReader(conn)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read response head: %s", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	var got []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read chunk size: %s", err)
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil {
+			t.Fatalf("failed to parse chunk size %q: %s", line, err)
+		}
+		if size == 0 {
+			break
+		}
+
+		chunk := make([]byte, size+2) //the chunk data is followed by a CRLF.
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			t.Fatalf("failed to read chunk: %s", err)
+		}
+		got = append(got, string(chunk[:size]))
+	}
+
+	if !slices.Equal(got, chunks) {
+		t.Errorf("chunks=%q, got %q", chunks, got)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Headers telling backends who the client is, from the certificate it
+// presented and the proxy verified.
+const (
+	clientCertCNHeader          = "X-Client-Cert-CN"
+	clientCertSANHeader         = "X-Client-Cert-SAN"
+	clientCertHeader            = "X-Client-Cert"
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// clientCertHeaders are dropped from every request before the proxy sets
+// the ones it vouches for.
+var clientCertHeaders = []string{
+	clientCertCNHeader,
+	clientCertSANHeader,
+	clientCertHeader,
+	clientCertSubjectHeader,
+	clientCertFingerprintHeader,
+}
+
+// setClientCertHeaders names the client of r in the client certificate
+// headers when it presented a verified certificate, along with the whole
+// certificate when WithClientCertForwarding asked for it. The values sent
+// by the client itself are always dropped, backends can trust the headers.
+func (p *Proxy) setClientCertHeaders(r *http.Request) {
+	for _, header := range clientCertHeaders {
+		r.Header.Del(header)
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		r.Header.Set(clientCertCNHeader, leaf.Subject.CommonName)
+	}
+
+	sans := append(slices.Clone(leaf.DNSNames), leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		sans = append(sans, uri.String())
+	}
+	if len(sans) > 0 {
+		r.Header.Set(clientCertSANHeader, strings.Join(sans, ","))
+	}
+
+	if !p.forwardClientCert {
+		return
+	}
+
+	//header values can not hold the line breaks of PEM.
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	r.Header.Set(clientCertHeader, url.QueryEscape(string(block)))
+	r.Header.Set(clientCertSubjectHeader, leaf.Subject.String())
+
+	sum := sha256.Sum256(leaf.Raw)
+	r.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(sum[:]))
+}
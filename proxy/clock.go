@@ -0,0 +1,24 @@
+package proxy
+
+import "time"
+
+// Clock tells time for the parts of the proxy that wait or measure, so tests
+// can move time forward without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// wallClock is the real clock.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                         { return time.Now() }
+func (wallClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockOrDefault returns c, or the wall clock when c is nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return wallClock{}
+	}
+	return c
+}
@@ -0,0 +1,154 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// waiting returns how many After channels have not fired yet.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// advance moves the clock forward by d and fires the channels that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+func TestRateLimitCooldownClock(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	clock := newFakeClock()
+	p, err := proxy.New(backend.URL, false,
+		proxy.WithClock(clock),
+		proxy.WithRoutes(proxy.Route{Name: "login", RateLimit: &proxy.RateLimit{Rate: 0.5, Burst: 1}}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+		return rec
+	}
+
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+
+	rec := send()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status=%d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After=2, got %q", got)
+	}
+
+	//half way through the cooldown the client is still limited.
+	clock.advance(time.Second)
+	if rec := send(); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status=%d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	clock.advance(2 * time.Second)
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestHealthCheckerClock(t *testing.T) {
+	var probes atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	clock := newFakeClock()
+	checker := proxy.HealthChecker{Proxy: p, Interval: time.Hour, Clock: clock}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checker.Run(ctx)
+
+	//waits for the checker to be parked on the clock after its probes.
+	parked := func(expected int32) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for clock.waiting() == 0 || probes.Load() < expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("probes=%d, got %d", expected, probes.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	parked(1)
+	for i := int32(2); i <= 3; i++ {
+		clock.advance(time.Hour)
+		parked(i)
+	}
+
+	if got := probes.Load(); got != 3 {
+		t.Errorf("probes=3, got %d", got)
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// maxSharedBodySize is the largest response body buffered to be shared
+// between coalesced requests.
+const maxSharedBodySize = 1 << 20
+
+// errNotShared is the result of a call whose response was too large to be
+// buffered, the waiting callers send their own requests instead.
+var errNotShared = errors.New("response too large to share")
+
+// sharedResponse is a fully read upstream response that can be replayed to
+// every request waiting on the same call.
+type sharedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	trailer    http.Header
+
+	//requestHeader is the header of the request the response was fetched
+	//for, waiters must match it on the headers the response varies on.
+	requestHeader http.Header
+}
+
+// sharedWith reports whether the response also answers a request carrying
+// header, the response may vary on headers left out of the key.
+func (s *sharedResponse) sharedWith(header http.Header) bool {
+	for _, name := range varyHeaders(s.header) {
+		if name == "*" {
+			return false
+		}
+		if !slices.Equal(s.requestHeader.Values(name), header.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns a fresh copy of the shared response for one waiter.
+func (s *sharedResponse) response() *http.Response {
+	return &http.Response{
+		StatusCode: s.statusCode,
+		Header:     s.header.Clone(),
+		Body:       io.NopCloser(bytes.NewReader(s.body)),
+		Trailer:    s.trailer.Clone(),
+	}
+}
+
+// call is an in-flight or completed upstream request.
+type call struct {
+	wg   sync.WaitGroup
+	resp *sharedResponse
+	err  error
+}
+
+// coalescer makes sure only one upstream request is in flight per key, all
+// the other callers wait for it and share its response.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		calls: make(map[string]*call),
+	}
+}
+
+// do executes fn once per key at a time, callers arriving while fn is in
+// flight receive the same result unless the response varies on a header
+// they sent another value of.
+func (c *coalescer) do(key string, header http.Header, fn func() (*http.Response, error)) (*http.Response, error) {
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		cl.wg.Wait()
+		if errors.Is(cl.err, errNotShared) {
+			return fn()
+		}
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		if !cl.resp.sharedWith(header) {
+			return fn()
+		}
+		return cl.resp.response(), nil
+	}
+
+	cl := new(call)
+	cl.wg.Add(1)
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	var own *http.Response
+	cl.resp, own, cl.err = readShared(fn)
+	if cl.resp != nil {
+		cl.resp.requestHeader = header
+	}
+	cl.wg.Done()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	if own != nil {
+		return own, nil
+	}
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	return cl.resp.response(), nil
+}
+
+// readShared runs fn and buffers the whole response so it can be shared.
+// Bodies larger than maxSharedBodySize are not buffered, the response is
+// returned to be streamed to the caller alone along with errNotShared.
+func readShared(fn func() (*http.Response, error)) (*sharedResponse, *http.Response, error) {
+	resp, err := fn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSharedBodySize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("read response body: %w", err)
+	}
+
+	if len(body) > maxSharedBodySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, resp, errNotShared
+	}
+	resp.Body.Close()
+
+	return &sharedResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+		body:       body,
+		trailer:    resp.Trailer, //trailers are only complete after the body is read.
+	}, nil, nil
+}
+
+// coalesceKey returns the key identical requests are grouped by and whether
+// the request may be coalesced at all. Only safe methods without
+// credentials qualify, since their responses can be shared between clients.
+func coalesceKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return "", false
+	}
+
+	//the encodings accepted are part of the key, the response usually varies on them.
+	return routePrefix(r) + r.Method + " " + clientHost(r) + r.URL.RequestURI() + " " + r.Header.Get("Accept-Encoding"), true
+}
@@ -0,0 +1,139 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestCoalescing(t *testing.T) {
+	var hits atomic.Int32
+	msg := "Hello World!"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		//keep the request in flight so the others pile up behind it.
+		time.Sleep(time.Millisecond * 200)
+		fmt.Fprint(w, msg)
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCoalescing(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		method       string
+		expectedHits int32
+	}{
+		"GET is coalesced": {
+			method:       http.MethodGet,
+			expectedHits: 1,
+		},
+		"POST is not coalesced": {
+			method:       http.MethodPost,
+			expectedHits: 5,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			hits.Store(0)
+
+			var wg sync.WaitGroup
+			for range 5 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					req := httptest.NewRequest(tt.method, "/resource", strings.NewReader(""))
+					recorder := httptest.NewRecorder()
+					p.ServeHTTP(recorder, req)
+
+					if recorder.Code != http.StatusOK {
+						t.Errorf("status=%d, got %d", http.StatusOK, recorder.Code)
+					}
+
+					bs, err := io.ReadAll(recorder.Body)
+					if err != nil {
+						t.Errorf("failed to read response body: %s", err)
+						return
+					}
+
+					if string(bs) != msg {
+						t.Errorf("message=%s, got %s", msg, string(bs))
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := hits.Load(); got != tt.expectedHits {
+				t.Errorf("hits=%d, got %d", tt.expectedHits, got)
+			}
+		})
+	}
+}
+
+func TestCoalescingVariants(t *testing.T) {
+	var hits atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(time.Millisecond * 200)
+		w.Header().Set("Vary", "Accept-Encoding, Accept-Language")
+		fmt.Fprintf(w, "%s|%s|%s", r.Host, r.Header.Get("Accept-Encoding"), r.Header.Get("Accept-Language"))
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithCoalescing(true), proxy.WithPreserveHostHeader(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	//only the first two requests are alike.
+	requests := []struct {
+		host     string
+		encoding string
+		language string
+	}{
+		{host: "a.example.com", encoding: "gzip", language: "en"},
+		{host: "a.example.com", encoding: "gzip", language: "en"},
+		{host: "a.example.com", encoding: "identity", language: "en"},
+		{host: "a.example.com", encoding: "gzip", language: "fr"},
+		{host: "b.example.com", encoding: "gzip", language: "en"},
+	}
+
+	var wg sync.WaitGroup
+	for _, tt := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+			req.Host = tt.host
+			req.Header.Set("Accept-Encoding", tt.encoding)
+			req.Header.Set("Accept-Language", tt.language)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			expected := tt.host + "|" + tt.encoding + "|" + tt.language
+			if body := recorder.Body.String(); body != expected {
+				t.Errorf("body=%s, got %s", expected, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := hits.Load(); got != 4 {
+		t.Errorf("hits=4, got %d", got)
+	}
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the smallest known body size worth compressing.
+const minCompressSize = 1024
+
+// acceptsGzip reports whether the Accept-Encoding header in h allows a gzip
+// response. A weight given to gzip itself wins over the one of "*".
+func acceptsGzip(h http.Header) bool {
+	gzipListed, gzipAccepted := false, false
+	starListed, starAccepted := false, false
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.TrimSpace(coding)
+
+			accepted := true
+			if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight <= 0 {
+					accepted = false
+				}
+			}
+
+			switch {
+			case strings.EqualFold(coding, "gzip"):
+				gzipListed, gzipAccepted = true, accepted
+			case coding == "*":
+				starListed, starAccepted = true, accepted
+			}
+		}
+	}
+
+	if gzipListed {
+		return gzipAccepted
+	}
+	return starListed && starAccepted
+}
+
+// compressible reports whether the proxy may compress resp. Responses
+// already carrying a content encoding are left alone so the body never gets
+// a second layer.
+func compressible(r *http.Request, resp *http.Response) bool {
+	if r.Method == http.MethodHead || resp.StatusCode < http.StatusOK ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	if coding := resp.Header.Get("Content-Encoding"); coding != "" && !strings.EqualFold(coding, "identity") {
+		return false
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength < minCompressSize {
+		return false
+	}
+
+	return compressibleType(resp.Header.Get("Content-Type"))
+}
+
+// compressibleType reports whether bodies of contentType shrink when
+// gzipped.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "text/event-stream":
+		//events have to reach the client as they are written.
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		mediaType == "application/javascript",
+		mediaType == "application/xml",
+		mediaType == "image/svg+xml",
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+// addVary adds value to the Vary header in h unless it is already listed.
+func addVary(h http.Header, value string) {
+	for _, existing := range h.Values("Vary") {
+		for _, field := range strings.Split(existing, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// negotiateEncoding decides whether the response to r gets gzipped by the
+// proxy and prepares the headers in w for it.
+func negotiateEncoding(w http.ResponseWriter, r *http.Request, resp *http.Response) bool {
+	if !compressible(r, resp) {
+		return false
+	}
+
+	//the proxy picks the encoding from Accept-Encoding, caches have to know.
+	addVary(w.Header(), "Accept-Encoding")
+	if !acceptsGzip(r.Header) {
+		return false
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	//the backend validator describes the uncompressed body.
+	if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("ETag", "W/"+etag)
+	}
+	return true
+}
+
+// gzipsRequest reports whether the body of r is gzipped before it is sent
+// to backend. Backends advertise they accept gzipped requests with an
+// Accept-Encoding header in their responses, so requests are only
+// compressed once the backend answered one.
+func (p *Proxy) gzipsRequest(r *http.Request, backend *Backend) bool {
+	if p.requestCompressSize <= 0 || backend == nil || r.ContentLength < p.requestCompressSize {
+		return false
+	}
+
+	if accepts, ok := p.requestEncodings.Load(backendKey(backend.URL)); !ok || !accepts.(bool) {
+		return false
+	}
+
+	if r.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return compressibleType(r.Header.Get("Content-Type"))
+}
+
+// recordRequestEncodings remembers whether backend accepts gzipped requests
+// when resp carries an Accept-Encoding header.
+func (p *Proxy) recordRequestEncodings(backend *Backend, resp *http.Response) {
+	if p.requestCompressSize <= 0 || backend == nil || len(resp.Header.Values("Accept-Encoding")) == 0 {
+		return
+	}
+	p.requestEncodings.Store(backendKey(backend.URL), acceptsGzip(resp.Header))
+}
+
+// gzipRequestBody replaces the body of r with its gzipped stream, the body
+// is compressed as the transport reads it.
+func gzipRequestBody(r *http.Request) {
+	body := r.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		//a transport done with the body closes pr, which ends the copy.
+		pw.CloseWithError(err)
+	}()
+
+	r.Body = pr
+	r.GetBody = nil
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	r.Header.Set("Content-Encoding", "gzip")
+}
@@ -0,0 +1,187 @@
+package proxy_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestCompression(t *testing.T) {
+	plain := strings.Repeat("Hello World!\n", 200)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/gzip" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, plain)
+			gz.Close()
+			return
+		}
+		io.WriteString(w, plain)
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithCompression(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	tests := map[string]struct {
+		path           string
+		acceptEncoding string
+		expectedCoding string
+		expectedVary   string
+	}{
+		"backend already compressed": {
+			path:           "/gzip",
+			acceptEncoding: "gzip",
+			expectedCoding: "gzip",
+		},
+		"compressed by the proxy": {
+			path:           "/plain",
+			acceptEncoding: "gzip, br",
+			expectedCoding: "gzip",
+			expectedVary:   "Accept-Encoding",
+		},
+		"client refuses gzip": {
+			path:           "/plain",
+			acceptEncoding: "gzip;q=0",
+			expectedVary:   "Accept-Encoding",
+		},
+		"client refuses gzip but not the rest": {
+			path:           "/plain",
+			acceptEncoding: "gzip;q=0, *",
+			expectedVary:   "Accept-Encoding",
+		},
+		"client accepts any coding": {
+			path:           "/plain",
+			acceptEncoding: "br, *;q=0.5",
+			expectedCoding: "gzip",
+			expectedVary:   "Accept-Encoding",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			//setting the header stops the client from decompressing on its own.
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Encoding"); got != tt.expectedCoding {
+				t.Errorf("content encoding=%q, got %q", tt.expectedCoding, got)
+			}
+
+			if got := resp.Header.Get("Vary"); got != tt.expectedVary {
+				t.Errorf("vary=%q, got %q", tt.expectedVary, got)
+			}
+
+			var body io.Reader = resp.Body
+			if tt.expectedCoding == "gzip" {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("failed to read gzip body: %s", err)
+				}
+				body = gz
+			}
+
+			//a single decompression has to give back the original body.
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+
+			if string(data) != plain {
+				t.Errorf("expected the body to be encoded once, got %q", data[:min(len(data), 32)])
+			}
+		})
+	}
+}
+
+func TestRequestCompression(t *testing.T) {
+	plain := strings.Repeat(`{"hello":"world"}`, 100)
+
+	type received struct {
+		encoding string
+		body     string
+	}
+	requests := make(chan received, 1)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+
+		bs, err := io.ReadAll(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requests <- received{encoding: r.Header.Get("Content-Encoding"), body: string(bs)}
+		w.Header().Set("Accept-Encoding", "gzip")
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithRequestCompression(0))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := []struct {
+		name             string
+		contentType      string
+		body             string
+		expectedEncoding string
+	}{
+		{name: "support not advertised yet", contentType: "application/json", body: plain},
+		{name: "compressed", contentType: "application/json", body: plain, expectedEncoding: "gzip"},
+		{name: "too small", contentType: "application/json", body: `{"hello":"world"}`},
+		{name: "not compressible", contentType: "image/png", body: plain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+			}
+
+			got := <-requests
+			if got.encoding != tt.expectedEncoding {
+				t.Errorf("encoding=%q, got %q", tt.expectedEncoding, got.encoding)
+			}
+
+			if got.body != tt.body {
+				t.Errorf("body=%q, got %q", tt.body, got.body)
+			}
+		})
+	}
+}
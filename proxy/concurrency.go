@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimit caps how many requests are forwarded at once. Requests
+// arriving at the limit wait in a queue ordered by priority, the highest
+// priority is admitted first and the lowest is shed first when the queue is
+// full.
+type ConcurrencyLimit struct {
+	Max          int           //requests forwarded at once, the ceiling of an adaptive limit.
+	QueueSize    int           //requests waiting for their turn, none when zero.
+	QueueTimeout time.Duration //how long a request waits at most, as long as its client when zero.
+
+	//Priorities classify the requests, the first matching rule wins and
+	//requests matching none have priority zero.
+	Priorities []PriorityRule
+
+	//Adaptive moves the limit with the latency of the requests, it stays
+	//at Max when nil.
+	Adaptive *AdaptiveLimit
+}
+
+// AdaptiveLimit backs a concurrency limit off when latency climbs and raises
+// it again while latency holds. The limit starts at Max so a fresh proxy is
+// not throttled before it saw any latency. Latency is the time backends take
+// to answer, responses served from the cache or replayed do not count. A
+// response taking more than Tolerance times the best latency seen multiplies
+// the limit by Backoff, at most once per round of requests, and the limit
+// grows by one request every limit answers taking at most that.
+type AdaptiveLimit struct {
+	Min       int     //the limit never drops below, 1 when zero.
+	Tolerance float64 //latency past the best one by this factor backs off, 2 when zero.
+	Backoff   float64 //factor the limit shrinks by, 0.9 when zero.
+}
+
+// PriorityRule gives the requests it matches a priority. A rule matches the
+// requests meeting all of its conditions.
+type PriorityRule struct {
+	Header     string //requests carrying the header.
+	Value      string //with this value, any value when empty.
+	PathPrefix string //requests whose path starts with it.
+	Priority   int    //higher priorities are admitted first.
+}
+
+// matches reports whether r meets the conditions of the rule.
+func (rule PriorityRule) matches(r *http.Request) bool {
+	if rule.Header != "" {
+		value := r.Header.Get(rule.Header)
+		if value == "" || (rule.Value != "" && value != rule.Value) {
+			return false
+		}
+	}
+	return strings.HasPrefix(r.URL.Path, rule.PathPrefix)
+}
+
+// errShed is returned for requests turned away because the proxy is at its
+// concurrency limit.
+var errShed = errors.New("too many concurrent requests")
+
+// queuedRequest is a request waiting for a slot, admitted receives true
+// once it got one and false when it was shed.
+type queuedRequest struct {
+	priority int
+	seq      uint64
+	admitted chan bool
+}
+
+// concurrencyLimiter admits requests up to a limit, the others wait in a
+// queue sorted by priority, highest first, then by arrival.
+type concurrencyLimiter struct {
+	limit ConcurrencyLimit
+
+	mu       sync.Mutex
+	inFlight int
+	queue    []*queuedRequest
+	seq      uint64
+
+	//max is the current limit, it only moves when adaptive.
+	max       float64
+	baseline  time.Duration
+	backedOff time.Time
+}
+
+func newConcurrencyLimiter(limit ConcurrencyLimit) *concurrencyLimiter {
+	l := &concurrencyLimiter{limit: limit, max: float64(limit.Max)}
+	if a := limit.Adaptive; a != nil {
+		adaptive := *a
+		adaptive.Min = min(max(adaptive.Min, 1), limit.Max)
+		if adaptive.Tolerance <= 0 {
+			adaptive.Tolerance = 2
+		}
+		if adaptive.Backoff <= 0 || adaptive.Backoff >= 1 {
+			adaptive.Backoff = 0.9
+		}
+		l.limit.Adaptive = &adaptive
+	}
+	return l
+}
+
+// current returns the current limit.
+func (l *concurrencyLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.max)
+}
+
+// priority returns the priority of r.
+func (l *concurrencyLimiter) priority(r *http.Request) int {
+	for _, rule := range l.limit.Priorities {
+		if rule.matches(r) {
+			return rule.Priority
+		}
+	}
+	return 0
+}
+
+// acquire waits for a slot for r and returns the function giving it back.
+// It fails with errShed when r was turned away or shed from the queue, and
+// with the context error when the client went away first.
+func (l *concurrencyLimiter) acquire(r *http.Request) (func(), error) {
+	priority := l.priority(r)
+
+	l.mu.Lock()
+	if l.inFlight < int(l.max) && len(l.queue) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+
+	if len(l.queue) >= l.limit.QueueSize {
+		//the newest of the lowest priority requests makes room, unless it is this one.
+		if len(l.queue) == 0 || l.queue[len(l.queue)-1].priority >= priority {
+			l.mu.Unlock()
+			return nil, errShed
+		}
+
+		shed := l.queue[len(l.queue)-1]
+		l.queue = l.queue[:len(l.queue)-1]
+		shed.admitted <- false
+	}
+
+	l.seq++
+	queued := &queuedRequest{priority: priority, seq: l.seq, admitted: make(chan bool, 1)}
+	i, _ := slices.BinarySearchFunc(l.queue, queued, func(a, b *queuedRequest) int {
+		return cmp.Or(cmp.Compare(b.priority, a.priority), cmp.Compare(a.seq, b.seq))
+	})
+	l.queue = slices.Insert(l.queue, i, queued)
+	l.mu.Unlock()
+
+	ctx := r.Context()
+	if l.limit.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.limit.QueueTimeout)
+		defer cancel()
+	}
+
+	select {
+	case ok := <-queued.admitted:
+		if !ok {
+			return nil, errShed
+		}
+		return l.release, nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if i := slices.Index(l.queue, queued); i >= 0 {
+		l.queue = slices.Delete(l.queue, i, i+1)
+	} else if <-queued.admitted {
+		//admitted while giving up, the slot goes to the next request.
+		l.inFlight--
+		l.admit()
+	}
+
+	if r.Context().Err() != nil {
+		return nil, r.Context().Err()
+	}
+	return nil, errShed
+}
+
+// release gives a slot back.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.admit()
+}
+
+// observe moves an adaptive limit after a backend sent at start answered
+// within latency.
+func (l *concurrencyLimiter) observe(start time.Time, latency time.Duration) {
+	a := l.limit.Adaptive
+	if a == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.baseline == 0 || latency < l.baseline {
+		l.baseline = latency
+	}
+
+	if float64(latency) > float64(l.baseline)*a.Tolerance {
+		//requests sent before the last back off saw the load it relieved.
+		if start.After(l.backedOff) {
+			l.max = max(l.max*a.Backoff, float64(a.Min))
+			l.backedOff = time.Now()
+		}
+
+		//at the minimum latency cannot get better, the backends got slower.
+		if int(l.max) <= a.Min {
+			l.baseline += (latency - l.baseline) / 10
+		}
+		return
+	}
+
+	//only a limit in use proves it can grow.
+	if l.inFlight >= int(l.max) {
+		l.max = min(l.max+1/l.max, float64(l.limit.Max))
+	}
+}
+
+// admit hands free slots to the queued requests, l.mu must be held.
+func (l *concurrencyLimiter) admit() {
+	for l.inFlight < int(l.max) && len(l.queue) > 0 {
+		next := l.queue[0]
+		l.queue = l.queue[1:]
+		l.inFlight++
+		next.admitted <- true
+	}
+}
+
+// ConcurrencyLimit returns how many requests are forwarded at once at most
+// right now, zero without a concurrency limit.
+func (p *Proxy) ConcurrencyLimit() int {
+	if p.concurrency == nil {
+		return 0
+	}
+	return p.concurrency.current()
+}
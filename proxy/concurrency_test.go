@@ -0,0 +1,210 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestConcurrencyLimitPriorities(t *testing.T) {
+	gate := make(chan struct{})
+	arrived := make(chan string, 4)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- r.Header.Get("X-Name")
+		if r.Header.Get("X-Name") == "first" {
+			<-gate
+		}
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithConcurrencyLimit(proxy.ConcurrencyLimit{
+		Max:        1,
+		QueueSize:  2,
+		Priorities: []proxy.PriorityRule{{Header: "X-Priority", Value: "high", Priority: 1}},
+	}))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	codes := make(map[string]int)
+	var mu sync.Mutex
+	send := func(name, priority string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Name", name)
+			if priority != "" {
+				r.Header.Set("X-Priority", priority)
+			}
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, r)
+
+			mu.Lock()
+			defer mu.Unlock()
+			codes[name] = rec.Code
+		}()
+	}
+
+	//the first request holds the only slot, the others queue in order.
+	send("first", "")
+	if name := <-arrived; name != "first" {
+		t.Fatalf("first request=first, got %q", name)
+	}
+
+	send("low-1", "")
+	time.Sleep(20 * time.Millisecond)
+	send("low-2", "")
+	time.Sleep(20 * time.Millisecond)
+	send("high", "high")
+	time.Sleep(20 * time.Millisecond)
+
+	//the full queue sheds the newest low priority request for the high one.
+	send("too-late", "")
+	time.Sleep(20 * time.Millisecond)
+
+	close(gate)
+	wg.Wait()
+	close(arrived)
+
+	order := []string{"first"}
+	for name := range arrived {
+		order = append(order, name)
+	}
+
+	expectedOrder := []string{"first", "high", "low-1"}
+	if !slices.Equal(order, expectedOrder) {
+		t.Errorf("order=%v, got %v", expectedOrder, order)
+	}
+
+	expectedCodes := map[string]int{
+		"first":    http.StatusOK,
+		"high":     http.StatusOK,
+		"low-1":    http.StatusOK,
+		"low-2":    http.StatusServiceUnavailable,
+		"too-late": http.StatusServiceUnavailable,
+	}
+	for name, code := range expectedCodes {
+		if codes[name] != code {
+			t.Errorf("%s status=%d, got %d", name, code, codes[name])
+		}
+	}
+}
+
+func TestAdaptiveConcurrencyLimit(t *testing.T) {
+	var inFlight atomic.Int64
+	var loaded atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		//once loaded, every request in flight slows the others down.
+		latency := 5 * time.Millisecond
+		if loaded.Load() {
+			latency *= time.Duration(n)
+		}
+		time.Sleep(latency)
+	}))
+	defer backend.Close()
+
+	const maxConcurrent = 20
+	p, err := proxy.New(backend.URL, false, proxy.WithConcurrencyLimit(proxy.ConcurrencyLimit{
+		Max:       maxConcurrent,
+		QueueSize: maxConcurrent,
+		Adaptive:  &proxy.AdaptiveLimit{Tolerance: 3, Backoff: 0.5},
+	}))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	//a fresh proxy is not throttled before it saw any latency.
+	if got := p.ConcurrencyLimit(); got != maxConcurrent {
+		t.Fatalf("initial limit=%d, got %d", maxConcurrent, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for range maxConcurrent {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		}()
+	}
+
+	//latency holding up, the limit stays close to the ceiling.
+	time.Sleep(500 * time.Millisecond)
+	if got := p.ConcurrencyLimit(); got <= maxConcurrent/2 {
+		t.Errorf("limit while latency holds>%d, got %d", maxConcurrent/2, got)
+	}
+
+	loaded.Store(true)
+	time.Sleep(time.Second)
+	if got := p.ConcurrencyLimit(); got > maxConcurrent/4 {
+		t.Errorf("limit once latency climbs<=%d, got %d", maxConcurrent/4, got)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAdaptiveConcurrencyLimitCacheHits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	const maxConcurrent = 20
+	p, err := proxy.New(backend.URL, false,
+		proxy.WithCache(proxy.NewMemoryCache(10)),
+		proxy.WithConcurrencyLimit(proxy.ConcurrencyLimit{
+			Max:       maxConcurrent,
+			QueueSize: maxConcurrent,
+			Adaptive:  &proxy.AdaptiveLimit{Tolerance: 3, Backoff: 0.5},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//cache hits are answered far faster than any backend, they must not
+	//make the backend look slow.
+	var wg sync.WaitGroup
+	for range maxConcurrent {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cached", nil))
+				p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+			}
+		}()
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if got := p.ConcurrencyLimit(); got <= maxConcurrent/2 {
+		t.Errorf("limit with cache hits>%d, got %d", maxConcurrent/2, got)
+	}
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config is the part of the proxy configuration that can be checked before
+// it is deployed.
+type Config struct {
+	Backends      []string
+	MaxBackends   int    //no limit when zero.
+	DefaultScheme string //scheme of backends given as host:port, see WithDefaultUpstreamScheme.
+	Routes        []Route
+
+	//CheckReachable makes ValidateConfig dial every backend.
+	CheckReachable bool
+	DialTimeout    time.Duration //one second when zero.
+}
+
+// ValidateConfig checks cfg without starting anything and returns every
+// problem it found, an empty result means the configuration is valid.
+func ValidateConfig(ctx context.Context, cfg Config) []error {
+	var errs []error
+
+	if len(cfg.Backends) == 0 {
+		errs = append(errs, fmt.Errorf("no backends configured"))
+	}
+
+	if cfg.DefaultScheme != "" {
+		backends := make([]string, len(cfg.Backends))
+		for i, backend := range cfg.Backends {
+			backends[i] = withDefaultScheme(backend, cfg.DefaultScheme)
+		}
+		cfg.Backends = backends
+	}
+	errs = append(errs, ValidateBackends(cfg.Backends, cfg.MaxBackends)...)
+
+	if cfg.CheckReachable {
+		errs = append(errs, checkReachable(ctx, cfg.Backends, cfg.DialTimeout)...)
+	}
+
+	errs = append(errs, ValidateRoutes(cfg.Routes)...)
+	return errs
+}
+
+// checkReachable dials every well formed backend.
+func checkReachable(ctx context.Context, backends []string, dialTimeout time.Duration) []error {
+	if dialTimeout <= 0 {
+		dialTimeout = time.Second
+	}
+
+	var errs []error
+	for _, backend := range backends {
+		u, err := parseBackendURL(backend)
+		if err != nil {
+			//reported by ValidateBackends.
+			continue
+		}
+
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", backendAddr(u))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backend %s is not reachable: %w", backend, err))
+			continue
+		}
+		conn.Close()
+	}
+	return errs
+}
+
+// ValidateBackends checks a list of backend URLs, reporting every malformed
+// or duplicate entry and lists holding more than maxBackends entries. Zero
+// means no limit.
+func ValidateBackends(backends []string, maxBackends int) []error {
+	var errs []error
+
+	seen := make(map[string]bool)
+	for _, backend := range backends {
+		u, err := parseBackendURL(backend)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		key := backendKey(u)
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("backend %s is listed more than once", backend))
+			continue
+		}
+		seen[key] = true
+	}
+
+	if err := checkBackendCount(len(backends), maxBackends); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// checkBackendCount fails when count exceeds maxBackends.
+func checkBackendCount(count, maxBackends int) error {
+	if maxBackends > 0 && count > maxBackends {
+		return fmt.Errorf("%d backends configured, at most %d are allowed", count, maxBackends)
+	}
+	return nil
+}
+
+// backendKey identifies a backend URL when looking for duplicates.
+func backendKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(backendAddr(u)) + strings.TrimSuffix(u.Path, "/")
+}
+
+// withDefaultScheme prefixes backend with scheme when it is a bare
+// host:port without one.
+func withDefaultScheme(backend, scheme string) string {
+	if strings.Contains(backend, "://") {
+		return backend
+	}
+	return scheme + "://" + backend
+}
+
+// parseBackendURL parses a backend URL, requiring an http or https scheme
+// and a host.
+func parseBackendURL(backend string) (*url.URL, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: parse url: %w", backend, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("backend %s: scheme must be http or https", backend)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("backend %s: missing host", backend)
+	}
+
+	return u, nil
+}
+
+// backendAddr returns the host:port dialed for u.
+func backendAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,231 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestValidateConfig(t *testing.T) {
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer reachable.Close()
+
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable.Close()
+
+	cfg := proxy.Config{
+		Backends: []string{
+			reachable.URL,
+			"localhost:9000",
+			"http://",
+			unreachable.URL,
+		},
+		CheckReachable: true,
+	}
+
+	errs := proxy.ValidateConfig(context.Background(), cfg)
+
+	expected := []string{
+		"backend localhost:9000: scheme must be http or https",
+		"backend http://: missing host",
+		"backend " + unreachable.URL + " is not reachable",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("errors=%d, got %d: %v", len(expected), len(errs), errs)
+	}
+
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), expected[i]) {
+			t.Errorf("error=%q, got %q", expected[i], err.Error())
+		}
+	}
+}
+
+func TestValidateConfigValid(t *testing.T) {
+	cfg := proxy.Config{
+		Backends:      []string{"http://localhost:9000", "https://backend.internal", "backend.internal:8443"},
+		DefaultScheme: "https",
+	}
+
+	if errs := proxy.ValidateConfig(context.Background(), cfg); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestValidateBackends(t *testing.T) {
+	tests := map[string]struct {
+		backends    []string
+		maxBackends int
+		expected    []string
+	}{
+		"duplicates": {
+			backends: []string{"http://a.internal:8080", "http://b.internal", "HTTP://A.internal:8080/"},
+			expected: []string{"backend HTTP://A.internal:8080/ is listed more than once"},
+		},
+		"schemeless": {
+			backends: []string{"a.internal:8080", "http://b.internal"},
+			expected: []string{"backend a.internal:8080: scheme must be http or https"},
+		},
+		"over the cap": {
+			backends:    []string{"http://a.internal", "http://b.internal", "http://c.internal"},
+			maxBackends: 2,
+			expected:    []string{"3 backends configured, at most 2 are allowed"},
+		},
+		"aggregated": {
+			backends:    []string{"http://a.internal", "http://a.internal", "b.internal"},
+			maxBackends: 2,
+			expected: []string{
+				"backend http://a.internal is listed more than once",
+				"backend b.internal: scheme must be http or https",
+				"3 backends configured, at most 2 are allowed",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			errs := proxy.ValidateBackends(tt.backends, tt.maxBackends)
+			if len(errs) != len(tt.expected) {
+				t.Fatalf("errors=%d, got %d: %v", len(tt.expected), len(errs), errs)
+			}
+
+			for i, err := range errs {
+				if err.Error() != tt.expected[i] {
+					t.Errorf("error=%q, got %q", tt.expected[i], err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestSetBackendsMax(t *testing.T) {
+	p, err := proxy.New("http://a.internal", true, proxy.WithMaxBackends(2))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	var backends []*proxy.Backend
+	for _, host := range []string{"a.internal", "b.internal", "c.internal"} {
+		backends = append(backends, &proxy.Backend{URL: &url.URL{Scheme: "http", Host: host}})
+	}
+
+	if err := p.SetBackends(backends); err == nil {
+		t.Fatal("expected setting more backends than allowed to fail")
+	}
+
+	if len(p.Backends()) != 1 {
+		t.Errorf("backends=1, got %d", len(p.Backends()))
+	}
+
+	if err := p.SetBackends(backends[:2]); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	if len(p.Backends()) != 2 {
+		t.Errorf("backends=2, got %d", len(p.Backends()))
+	}
+}
+
+func TestSetBackendsMalformed(t *testing.T) {
+	var hits [2]atomic.Int32
+	var servers []*url.URL
+	for i := range hits {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+		}))
+		defer backend.Close()
+
+		u, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatalf("failed to parse backend url: %s", err)
+		}
+		servers = append(servers, u)
+	}
+
+	p, err := proxy.New(servers[0].String(), false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	backends := []*proxy.Backend{
+		{URL: servers[0]},
+		{URL: &url.URL{Scheme: "ftp", Host: "bad.internal"}},
+		{URL: servers[1]},
+	}
+	if err := p.SetBackends(backends); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	if len(p.Backends()) != 2 {
+		t.Fatalf("backends=2, got %d", len(p.Backends()))
+	}
+
+	for range 4 {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	for i := range hits {
+		if got := hits[i].Load(); got != 2 {
+			t.Errorf("backend %d: hits=2, got %d", i, got)
+		}
+	}
+
+	//a reload without a single valid backend is rejected as a whole.
+	bad := []*proxy.Backend{
+		{URL: &url.URL{Scheme: "ftp", Host: "bad.internal"}},
+		{URL: &url.URL{Scheme: "http"}},
+	}
+	if err := p.SetBackends(bad); err == nil {
+		t.Fatal("expected setting only malformed backends to fail")
+	}
+
+	if len(p.Backends()) != 2 {
+		t.Errorf("backends=2, got %d", len(p.Backends()))
+	}
+}
+
+func TestNewWithoutBackends(t *testing.T) {
+	if _, err := proxy.New("", false); err == nil {
+		t.Fatal("expected creating a proxy without backends to fail")
+	}
+
+	p, err := proxy.New("", false, proxy.WithNoBackends(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status=%d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("failed to parse backend url: %s", err)
+	}
+
+	if err := p.SetBackends([]*proxy.Backend{{URL: u}}); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+}
@@ -0,0 +1,108 @@
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			//rejected before the body is read, so no 100 Continue is sent.
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("expect=100-continue, got %q", r.Header.Get("Expect"))
+		}
+
+		//reading the body sends 100 Continue.
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %s", body)
+	}))
+	defer backend.Close()
+
+	//a long timeout makes sure the proxy waits for the backend instead of giving up.
+	p, err := proxy.New(backend.URL, false, proxy.WithExpectContinueTimeout(10*time.Second))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	tests := map[string]struct {
+		authorization  string
+		expectContinue bool
+		expectedStatus int
+	}{
+		"accepted": {
+			authorization:  "Authorization: Bearer token\r\n",
+			expectContinue: true,
+			expectedStatus: http.StatusOK,
+		},
+		"rejected": {
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %s", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: proxy\r\n%sContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", tt.authorization)
+			reader := bufio.NewReader(conn)
+
+			if tt.expectContinue {
+				interim, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					t.Fatalf("failed to read interim response: %s", err)
+				}
+
+				if interim.StatusCode != http.StatusContinue {
+					t.Fatalf("status=%d, got %d", http.StatusContinue, interim.StatusCode)
+				}
+
+				//the body is only sent once the backend agreed.
+				fmt.Fprint(conn, "hello")
+			}
+
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			if !tt.expectContinue {
+				return
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+
+			if string(body) != "got hello" {
+				t.Errorf("body=got hello, got %s", body)
+			}
+		})
+	}
+}
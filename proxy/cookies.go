@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CookieRewrite adjusts the Set-Cookie headers of backend responses so the
+// cookies apply to the public host instead of the backend.
+type CookieRewrite struct {
+	//Domain replaces the Domain attribute, the public host of the request when empty.
+	Domain string
+
+	//Path attributes starting with FromPath get it replaced by ToPath.
+	FromPath string
+	ToPath   string
+
+	//attributes added to every cookie.
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+}
+
+// rewrite returns the Set-Cookie values with their attributes adjusted for
+// publicHost. Attributes it does not change are kept as the backend sent them.
+func (c *CookieRewrite) rewrite(values []string, publicHost string) []string {
+	domain := c.Domain
+	if domain == "" {
+		domain = publicHost
+	}
+
+	rewritten := make([]string, len(values))
+	for i, value := range values {
+		parts := strings.Split(value, ";")
+		var secure, httpOnly, sameSite bool
+
+		//the first part is the name=value pair, attributes follow.
+		for j := 1; j < len(parts); j++ {
+			name, attrValue, _ := strings.Cut(strings.TrimSpace(parts[j]), "=")
+
+			switch strings.ToLower(name) {
+			case "domain":
+				parts[j] = " Domain=" + domain
+			case "path":
+				if c.FromPath != "" && matchPrefix(c.FromPath, attrValue) {
+					parts[j] = " Path=" + path.Join("/", c.ToPath, strings.TrimPrefix(attrValue, c.FromPath))
+				}
+			case "secure":
+				secure = true
+			case "httponly":
+				httpOnly = true
+			case "samesite":
+				if c.SameSite != 0 {
+					parts[j] = " " + sameSiteAttr(c.SameSite)
+				}
+				sameSite = true
+			}
+		}
+
+		if c.Secure && !secure {
+			parts = append(parts, " Secure")
+		}
+		if c.HttpOnly && !httpOnly {
+			parts = append(parts, " HttpOnly")
+		}
+		if c.SameSite != 0 && !sameSite {
+			parts = append(parts, " "+sameSiteAttr(c.SameSite))
+		}
+
+		rewritten[i] = strings.Join(parts, ";")
+	}
+	return rewritten
+}
+
+func sameSiteAttr(s http.SameSite) string {
+	switch s {
+	case http.SameSiteLaxMode:
+		return "SameSite=Lax"
+	case http.SameSiteStrictMode:
+		return "SameSite=Strict"
+	case http.SameSiteNoneMode:
+		return "SameSite=None"
+	}
+	return "SameSite"
+}
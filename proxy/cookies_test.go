@@ -0,0 +1,49 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestCookieRewrite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=backend.internal; Path=/internal/app/login; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; Path=/other; SameSite=None")
+		w.Header().Add("Set-Cookie", "lang=en")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithCookieRewrite(proxy.CookieRewrite{
+		FromPath: "/internal/app",
+		ToPath:   "/",
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://www.example.com/", nil)
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	expected := []string{
+		"session=abc; Domain=www.example.com; Path=/login; HttpOnly; Secure; SameSite=Lax",
+		"theme=dark; Path=/other; SameSite=Lax; Secure",
+		"lang=en; Secure; SameSite=Lax",
+	}
+
+	cookies := recorder.Header().Values("Set-Cookie")
+	if len(cookies) != len(expected) {
+		t.Fatalf("cookies=%d, got %d: %v", len(expected), len(cookies), cookies)
+	}
+
+	for i, cookie := range cookies {
+		if cookie != expected[i] {
+			t.Errorf("cookie=%q, got %q", expected[i], cookie)
+		}
+	}
+}
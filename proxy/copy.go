@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultCopyBufferSize matches the buffer io.Copy allocates.
+const defaultCopyBufferSize = 32 << 10
+
+// bufferPool hands out copy buffers of one size.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+// copy copies src to dst through a pooled buffer.
+func (b *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := b.pool.Get().(*[]byte)
+	defer b.pool.Put(buf)
+
+	//hiding ReadFrom keeps the response writer from copying with a buffer of its own.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
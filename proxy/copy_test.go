@@ -0,0 +1,95 @@
+package proxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// staticTransport answers every request with body, without any network.
+type staticTransport struct {
+	body    []byte
+	chunked bool //send the body without a content length.
+}
+
+func (s staticTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	length := int64(len(s.body))
+	if s.chunked {
+		length = -1
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: length,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		//a plain reader, so the copy goes through the proxy buffer.
+		Body:    io.NopCloser(struct{ io.Reader }{bytes.NewReader(s.body)}),
+		Request: r,
+	}, nil
+}
+
+// discardWriter is a response writer dropping the body.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+func (d *discardWriter) Flush()                      {}
+
+func BenchmarkResponseCopy(b *testing.B) {
+	body := make([]byte, 1<<20)
+
+	for _, size := range []int{0, 4 << 10, 256 << 10} {
+		name := "default"
+		if size > 0 {
+			name = fmt.Sprintf("%dKB", size>>10)
+		}
+
+		b.Run(name, func(b *testing.B) {
+			p, err := proxy.New("http://backend.internal", false, proxy.WithCopyBufferSize(size))
+			if err != nil {
+				b.Fatalf("failed to create proxy: %s", err)
+			}
+			p.Client.Transport = staticTransport{body: body}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for range b.N {
+				p.ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+			}
+		})
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	tests := map[string]staticTransport{
+		"known length": {body: []byte("Hello World!")},
+		"streamed":     {body: []byte("Hello World!"), chunked: true},
+	}
+
+	for name, transport := range tests {
+		b.Run(name, func(b *testing.B) {
+			p, err := proxy.New("http://backend.internal", false)
+			if err != nil {
+				b.Fatalf("failed to create proxy: %s", err)
+			}
+			p.Client.Transport = transport
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			b.ReportAllocs()
+			for range b.N {
+				p.ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskEntrySuffix names the files holding cache entries, anything else in
+// the directory is left alone.
+const diskEntrySuffix = ".entry"
+
+// DiskCache is a Cache storing every entry in a file of its own under a
+// directory, bounded by the total size of those files. The least recently
+// used entry is evicted first. Entries found in the directory when the
+// cache is created are served again, so they survive restarts.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element //by file name.
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// diskRecord is what an entry file holds, the key is kept to tell apart
+// keys whose names collide.
+type diskRecord struct {
+	Key   string
+	Entry *CacheEntry
+}
+
+// NewDiskCache creates a DiskCache in dir holding at most maxBytes of
+// entries, no limit when zero. The directory is created when missing and
+// the entries already in it are indexed, least recently used first.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read cache dir: %w", err)
+	}
+
+	type found struct {
+		diskItem
+		used time.Time
+	}
+
+	var entries []found
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		//left behind by a write that never finished.
+		if strings.HasPrefix(file.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+
+		if !strings.HasSuffix(file.Name(), diskEntrySuffix) {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, found{diskItem{name: file.Name(), size: info.Size()}, info.ModTime()})
+	}
+
+	//reads touch the files, the oldest modification was used least recently.
+	slices.SortFunc(entries, func(a, b found) int { return a.used.Compare(b.used) })
+
+	c := DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range entries {
+		c.items[entry.name] = c.ll.PushFront(&diskItem{name: entry.name, size: entry.size})
+		c.size += entry.size
+	}
+	c.evict()
+
+	return &c, nil
+}
+
+// fileName returns the name of the file holding the entry stored under key.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskEntrySuffix
+}
+
+// Get returns the entry stored under key.
+func (c *DiskCache) Get(key string) (*CacheEntry, bool) {
+	name := fileName(key)
+
+	c.mu.Lock()
+	el, ok := c.items[name]
+	if ok {
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	file, err := os.Open(path)
+	if err != nil {
+		c.forget(name)
+		return nil, false
+	}
+	defer file.Close()
+
+	var record diskRecord
+	if err := gob.NewDecoder(file).Decode(&record); err != nil || record.Entry == nil {
+		c.forget(name)
+		return nil, false
+	}
+
+	if record.Key != key {
+		return nil, false
+	}
+
+	//keeps the eviction order across restarts.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return record.Entry, true
+}
+
+// Set stores entry under key, evicting the least recently used entries
+// until the cache fits its size again. Entries that can not be written are
+// not stored.
+func (c *DiskCache) Set(key string, entry *CacheEntry) {
+	name := fileName(key)
+
+	//written aside and renamed so readers never see half an entry.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+
+	if err := gob.NewEncoder(tmp).Encode(diskRecord{Key: key, Entry: entry}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return
+	}
+
+	info, err := tmp.Stat()
+	tmp.Close()
+	if err != nil || (c.maxBytes > 0 && info.Size() > c.maxBytes) {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	if el, ok := c.items[name]; ok {
+		item := el.Value.(*diskItem)
+		c.size += info.Size() - item.size
+		item.size = info.Size()
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[name] = c.ll.PushFront(&diskItem{name: name, size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict()
+}
+
+// Delete removes the entry stored under key.
+func (c *DiskCache) Delete(key string) {
+	c.forget(fileName(key))
+}
+
+// Clear removes every entry.
+func (c *DiskCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.ll.Len() > 0 {
+		c.remove(c.ll.Back())
+	}
+}
+
+// forget drops the entry stored in the file name.
+func (c *DiskCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+}
+
+// evict removes the least recently used entries while the cache is over
+// its size, c.mu must be held.
+func (c *DiskCache) evict() {
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove deletes the entry of el and its file, c.mu must be held.
+func (c *DiskCache) remove(el *list.Element) {
+	item := el.Value.(*diskItem)
+	c.ll.Remove(el)
+	delete(c.items, item.name)
+	c.size -= item.size
+	os.Remove(filepath.Join(c.dir, item.name))
+}
@@ -0,0 +1,154 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestDiskCachePersists(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/css")
+		fmt.Fprint(w, "body { color: red; }")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	send := func(cache proxy.Cache) *httptest.ResponseRecorder {
+		t.Helper()
+
+		p, err := proxy.New(server.URL, false, proxy.WithCache(cache))
+		if err != nil {
+			t.Fatalf("failed to create proxy: %s", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/static/site.css", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	cache, err := proxy.NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	send(cache)
+
+	//a restart starts from what is on disk.
+	reopened, err := proxy.NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %s", err)
+	}
+	recorder := send(reopened)
+
+	if hits.Load() != 1 {
+		t.Errorf("backend hits=1, got %d", hits.Load())
+	}
+
+	if body := recorder.Body.String(); body != "body { color: red; }" {
+		t.Errorf("body=%q, got %q", "body { color: red; }", body)
+	}
+
+	if ct := recorder.Header().Get("Content-Type"); ct != "text/css" {
+		t.Errorf("content-type=%q, got %q", "text/css", ct)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	entry := func(body string) *proxy.CacheEntry {
+		return &proxy.CacheEntry{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       []byte(body),
+			StoredAt:   time.Now(),
+			Expires:    time.Now().Add(time.Minute),
+		}
+	}
+
+	//room for two entries of about 5KB, not three.
+	cache, err := proxy.NewDiskCache(dir, 12<<10)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+
+	cache.Set("a", entry(strings.Repeat("a", 5<<10)))
+	cache.Set("b", entry(strings.Repeat("b", 5<<10)))
+
+	//a was used last, b goes first.
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatalf("expected a to be cached")
+	}
+	cache.Set("c", entry(strings.Repeat("c", 5<<10)))
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.Get(key); ok != expected {
+			t.Errorf("%s cached=%t, got %t", key, expected, ok)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read cache dir: %s", err)
+	}
+
+	if len(files) != 2 {
+		t.Errorf("files=2, got %d", len(files))
+	}
+
+	//the eviction order is kept on disk too.
+	cache.Get("a")
+	reopened, err := proxy.NewDiskCache(dir, 12<<10)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %s", err)
+	}
+	reopened.Set("d", entry(strings.Repeat("d", 5<<10)))
+
+	for key, expected := range map[string]bool{"a": true, "c": false, "d": true} {
+		if _, ok := reopened.Get(key); ok != expected {
+			t.Errorf("reopened %s cached=%t, got %t", key, expected, ok)
+		}
+	}
+}
+
+func TestDiskCacheDelete(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := proxy.NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Set(key, &proxy.CacheEntry{StatusCode: http.StatusOK, Body: []byte(key)})
+	}
+
+	cache.Delete("a")
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("expected a to be deleted")
+	}
+
+	if _, ok := cache.Get("b"); !ok {
+		t.Errorf("expected b to stay cached")
+	}
+
+	cache.Clear()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read cache dir: %s", err)
+	}
+
+	if len(files) != 0 {
+		t.Errorf("files=0, got %d", len(files))
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HostLookuper resolves host names to addresses, *net.Resolver implements
+// it.
+type HostLookuper interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSRefresher resolves backend host names for the proxy transport and
+// re-resolves them periodically. When the addresses of a host change, idle
+// connections are dropped so new requests dial the new addresses instead of
+// reusing connections to the old ones.
+type DNSRefresher struct {
+	Interval time.Duration //how often the known hosts are resolved again.
+	Lookuper HostLookuper  //net.DefaultResolver when nil.
+	Logger   *slog.Logger  //slog.Default when nil.
+
+	mu      sync.Mutex
+	addrs   map[string][]string
+	changed map[int]func() //called when addresses change, by subscription.
+	nextID  int
+}
+
+// onChange calls fn whenever the addresses of a host changed until the
+// returned func is called. Every proxy sharing the refresher subscribes on
+// its own.
+func (d *DNSRefresher) onChange(fn func()) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.changed == nil {
+		d.changed = make(map[int]func())
+	}
+	id := d.nextID
+	d.nextID++
+	d.changed[id] = fn
+
+	return func() {
+		d.mu.Lock()
+		delete(d.changed, id)
+		d.mu.Unlock()
+	}
+}
+
+func (d *DNSRefresher) lookuper() HostLookuper {
+	if d.Lookuper == nil {
+		return net.DefaultResolver
+	}
+	return d.Lookuper
+}
+
+// resolve returns the addresses of host, looking it up on first use.
+func (d *DNSRefresher) resolve(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	addrs, ok := d.addrs[host]
+	d.mu.Unlock()
+	if ok {
+		return addrs, nil
+	}
+
+	addrs, err := d.lookuper().LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	if d.addrs == nil {
+		d.addrs = make(map[string][]string)
+	}
+	d.addrs[host] = addrs
+	d.mu.Unlock()
+
+	return addrs, nil
+}
+
+// dialContext wraps dial so host names are dialed by the addresses the
+// refresher resolved for them.
+func (d *DNSRefresher) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := d.resolve(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// Refresh resolves every known host again. Hosts that fail to resolve keep
+// their previous addresses.
+func (d *DNSRefresher) Refresh(ctx context.Context) error {
+	d.mu.Lock()
+	hosts := make([]string, 0, len(d.addrs))
+	for host := range d.addrs {
+		hosts = append(hosts, host)
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	changed := false
+	for _, host := range hosts {
+		addrs, err := d.lookuper().LookupHost(ctx, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolve %s: %w", host, err))
+			continue
+		}
+
+		d.mu.Lock()
+		if !slices.Equal(d.addrs[host], addrs) {
+			d.addrs[host] = addrs
+			changed = true
+		}
+		d.mu.Unlock()
+	}
+
+	if !changed {
+		return errors.Join(errs...)
+	}
+
+	d.mu.Lock()
+	subscribers := make([]func(), 0, len(d.changed))
+	for _, fn := range d.changed {
+		subscribers = append(subscribers, fn)
+	}
+	d.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn()
+	}
+	return errors.Join(errs...)
+}
+
+// Run refreshes the known hosts on every interval until ctx is cancelled.
+func (d *DNSRefresher) Run(ctx context.Context) error {
+	if d.Interval <= 0 {
+		return errors.New("dns refresher interval must be positive")
+	}
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := d.Refresh(ctx); err != nil {
+				loggerOrDefault(d.Logger).Error("dns refresher", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+type stubHosts struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (s *stubHosts) LookupHost(ctx context.Context, host string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addrs, nil
+}
+
+func (s *stubHosts) set(addrs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs = addrs
+}
+
+func TestDNSRefresher(t *testing.T) {
+	//both servers share a port on different loopback addresses, only the resolved ip tells them apart.
+	newListener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("loopback address 127.0.0.2 not available: %s", err)
+	}
+	_, port, err := net.SplitHostPort(newListener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to split listener address: %s", err)
+	}
+
+	oldListener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		newListener.Close()
+		t.Skipf("port %s not available on 127.0.0.1: %s", port, err)
+	}
+
+	serve := func(l net.Listener, name string) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		server.Listener.Close()
+		server.Listener = l
+		server.Start()
+		return server
+	}
+
+	oldServer := serve(oldListener, "old")
+	defer oldServer.Close()
+
+	newServer := serve(newListener, "new")
+	defer newServer.Close()
+
+	hosts := &stubHosts{}
+	hosts.set("127.0.0.1")
+	refresher := &proxy.DNSRefresher{Lookuper: hosts}
+
+	//proxies sharing the refresher all drop their connections to the old ip.
+	var proxies []*proxy.Proxy
+	for range 2 {
+		p, err := proxy.New("http://backend.test:"+port, true, proxy.WithDNSRefresher(refresher))
+		if err != nil {
+			t.Fatalf("failed to create proxy: %s", err)
+		}
+		defer p.Close()
+		proxies = append(proxies, p)
+	}
+
+	get := func(p *proxy.Proxy) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		bs, err := io.ReadAll(recorder.Body)
+		if err != nil {
+			t.Fatalf("failed to read response body: %s", err)
+		}
+		return string(bs)
+	}
+
+	for _, p := range proxies {
+		if got := get(p); got != "old" {
+			t.Fatalf("backend=%s, got %s", "old", got)
+		}
+	}
+
+	//the ip changes, without a refresh the idle connection to the old ip is reused.
+	hosts.set("127.0.0.2")
+	for _, p := range proxies {
+		if got := get(p); got != "old" {
+			t.Fatalf("backend=%s, got %s", "old", got)
+		}
+	}
+
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatalf("failed to refresh: %s", err)
+	}
+
+	for _, p := range proxies {
+		if got := get(p); got != "new" {
+			t.Errorf("backend=%s, got %s", "new", got)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import "net/http"
+
+// SetDraining turns drain mode on or off, it is safe to call while the
+// proxy is serving. While draining, requests are still forwarded but
+// HTTP/1 responses carry Connection: close, so clients open their next
+// connection elsewhere, to an instance that is not about to go away.
+// HTTP/2 connections are left alone, their server announces the shutdown
+// with GOAWAY instead.
+func (p *Proxy) SetDraining(enabled bool) {
+	p.draining.Store(enabled)
+}
+
+// Draining reports whether the proxy is in drain mode.
+func (p *Proxy) Draining() bool {
+	return p.draining.Load()
+}
+
+// closeWhenDraining asks the client of r to close its connection after the
+// response while the proxy is draining. Upgrades and tunnels keep their
+// connection, it is taken over once the response is written.
+func (p *Proxy) closeWhenDraining(w http.ResponseWriter, r *http.Request) {
+	if !p.draining.Load() || r.ProtoMajor != 1 || IsUpgrade(r) || r.Method == http.MethodConnect {
+		return
+	}
+	w.Header().Set("Connection", "close")
+}
@@ -0,0 +1,163 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+	"golang.org/x/net/http2"
+)
+
+func TestDraining(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		http2         bool
+		draining      bool
+		expectedClose bool
+	}{
+		"HTTP/1.1 serving": {
+			expectedClose: false,
+		},
+		"HTTP/1.1 draining": {
+			draining:      true,
+			expectedClose: true,
+		},
+		"HTTP/2 draining": {
+			http2:         true,
+			draining:      true,
+			expectedClose: false,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			frontend := httptest.NewUnstartedServer(p)
+			frontend.EnableHTTP2 = tt.http2
+			frontend.StartTLS()
+			defer frontend.Close()
+
+			p.SetDraining(tt.draining)
+			defer p.SetDraining(false)
+
+			resp, err := frontend.Client().Get(frontend.URL)
+			if err != nil {
+				t.Fatalf("failed to send request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			if tt.http2 && resp.ProtoMajor != 2 {
+				t.Fatalf("proto=2, got %d", resp.ProtoMajor)
+			}
+
+			if resp.Close != tt.expectedClose {
+				t.Errorf("close=%t, got %t", tt.expectedClose, resp.Close)
+			}
+		})
+	}
+}
+
+func TestShutdownHTTP2GoAway(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	frontend := httptest.NewUnstartedServer(p)
+	frontend.EnableHTTP2 = true
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	conn, err := tls.Dial("tcp", frontend.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %s", err)
+	}
+
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("failed to create client conn: %s", err)
+	}
+	defer cc.Close()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, frontend.URL, nil)
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		bs, err := io.ReadAll(resp.Body)
+		inFlight <- result{body: string(bs), err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- frontend.Config.Shutdown(ctx)
+	}()
+
+	//the client learns about the shutdown while its stream is still open.
+	deadline := time.Now().Add(2 * time.Second)
+	for !cc.State().Closing {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client to receive GOAWAY")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	if cc.CanTakeNewRequest() {
+		t.Error("expected the connection to refuse new requests")
+	}
+
+	close(release)
+
+	res := <-inFlight
+	if res.err != nil {
+		t.Fatalf("failed to finish in-flight request: %s", res.err)
+	}
+
+	if res.body != "done" {
+		t.Errorf("body=%s, got %s", "done", res.body)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("failed to shut down: %s", err)
+	}
+}
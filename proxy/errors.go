@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errorBody is the JSON form of an error answered by the proxy itself.
+type errorBody struct {
+	Error     string `json:"error"`
+	Code      int    `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// problemDetails is the RFC 7807 form of an error answered by the proxy.
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorMediaTypes are the forms an error can be written in, the earlier
+// one wins when the client weighs two the same.
+var errorMediaTypes = []string{"text/plain", "application/json", "application/problem+json"}
+
+// writeError answers r with status and message, as JSON or problem details
+// when the client prefers those over plain text. The request ID is taken
+// from X-Request-Id.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	//the form of the body depends on Accept, caches have to know.
+	addVary(w.Header(), "Accept")
+
+	var body []byte
+	mediaType := negotiateMediaType(r.Header, errorMediaTypes)
+	switch mediaType {
+	case "application/json":
+		body, _ = json.Marshal(errorBody{
+			Error:     message,
+			Code:      status,
+			RequestID: r.Header.Get("X-Request-Id"),
+		})
+	case "application/problem+json":
+		problem := problemDetails{
+			Type:      "about:blank",
+			Title:     http.StatusText(status),
+			Status:    status,
+			RequestID: r.Header.Get("X-Request-Id"),
+		}
+		//the title already says as much for the generic errors.
+		if message != problem.Title {
+			problem.Detail = message
+		}
+		body, _ = json.Marshal(problem)
+	default:
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// negotiateMediaType returns the entry of offers the Accept header in h
+// weighs highest, the first offer when nothing beats it.
+func negotiateMediaType(h http.Header, offers []string) string {
+	best, bestQ := offers[0], acceptQuality(h, offers[0])
+	for _, offer := range offers[1:] {
+		if q := acceptQuality(h, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the weight the Accept header in h gives mediaType,
+// taken from the most specific range matching it. A missing header accepts
+// everything.
+func acceptQuality(h http.Header, mediaType string) float64 {
+	values := h.Values("Accept")
+	if len(values) == 0 {
+		return 1
+	}
+
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			accepted, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			accepted = strings.ToLower(strings.TrimSpace(accepted))
+
+			var rank int
+			switch {
+			case accepted == mediaType:
+				rank = 2
+			case accepted == mainType+"/*":
+				rank = 1
+			case accepted == "*/*":
+				rank = 0
+			default:
+				continue
+			}
+
+			if rank <= specificity {
+				continue
+			}
+			specificity = rank
+			q = 1
+
+			for _, param := range strings.Split(params, ";") {
+				if weight, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+					if parsed, err := strconv.ParseFloat(weight, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+		}
+	}
+	return q
+}
@@ -0,0 +1,188 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestJSONErrors(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing.Close() //connections to it are refused.
+
+	tests := map[string]struct {
+		accept              string
+		expectedContentType string
+	}{
+		"no accept":       {expectedContentType: "text/plain; charset=utf-8"},
+		"any":             {accept: "*/*", expectedContentType: "text/plain; charset=utf-8"},
+		"json":            {accept: "application/json", expectedContentType: "application/json"},
+		"json wildcard":   {accept: "application/*", expectedContentType: "application/json"},
+		"json preferred":  {accept: "text/plain;q=0.5, application/json", expectedContentType: "application/json"},
+		"text preferred":  {accept: "text/plain, application/json;q=0.5", expectedContentType: "text/plain; charset=utf-8"},
+		"json refused":    {accept: "application/json;q=0, */*", expectedContentType: "text/plain; charset=utf-8"},
+		"browser default": {accept: "text/html,application/xhtml+xml,*/*;q=0.8", expectedContentType: "text/plain; charset=utf-8"},
+	}
+
+	p, err := proxy.New(failing.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Request-Id", "req-42")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusBadGateway {
+				t.Errorf("status=%d, got %d", http.StatusBadGateway, recorder.Code)
+			}
+
+			if got := recorder.Header().Get("Content-Type"); got != tt.expectedContentType {
+				t.Fatalf("content-type=%q, got %q", tt.expectedContentType, got)
+			}
+
+			if tt.expectedContentType != "application/json" {
+				if body := recorder.Body.String(); body != "Bad Gateway\n" {
+					t.Errorf("body=%q, got %q", "Bad Gateway\n", body)
+				}
+				return
+			}
+
+			var body struct {
+				Error     string `json:"error"`
+				Code      int    `json:"code"`
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode body %q: %s", recorder.Body.String(), err)
+			}
+
+			if body.Error != "Bad Gateway" {
+				t.Errorf("error=%q, got %q", "Bad Gateway", body.Error)
+			}
+
+			if body.Code != http.StatusBadGateway {
+				t.Errorf("code=%d, got %d", http.StatusBadGateway, body.Code)
+			}
+
+			if body.RequestID != "req-42" {
+				t.Errorf("request_id=%q, got %q", "req-42", body.RequestID)
+			}
+		})
+	}
+}
+
+func TestJSONRateLimitError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false,
+		proxy.WithRoutes(proxy.Route{Name: "api", RateLimit: &proxy.RateLimit{Rate: 0.001, Burst: 1}}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	var recorder *httptest.ResponseRecorder
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("Accept", "application/json")
+		recorder = httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+	}
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("status=%d, got %d", http.StatusTooManyRequests, recorder.Code)
+	}
+
+	var body struct {
+		Error     string  `json:"error"`
+		Code      int     `json:"code"`
+		RequestID *string `json:"request_id"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode body %q: %s", recorder.Body.String(), err)
+	}
+
+	if body.Code != http.StatusTooManyRequests {
+		t.Errorf("code=%d, got %d", http.StatusTooManyRequests, body.Code)
+	}
+
+	//without an incoming ID the field is left out.
+	if body.RequestID != nil {
+		t.Errorf("expected no request_id, got %q", *body.RequestID)
+	}
+
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+}
+
+func TestProblemDetailsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithAllowedMethods(http.MethodGet))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		accept              string
+		expectedContentType string
+	}{
+		"problem":           {accept: "application/problem+json", expectedContentType: "application/problem+json"},
+		"problem preferred": {accept: "application/json;q=0.9, application/problem+json", expectedContentType: "application/problem+json"},
+		"json":              {accept: "application/json", expectedContentType: "application/json"},
+		"json on a tie":     {accept: "application/*", expectedContentType: "application/json"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set("X-Request-Id", "req-42")
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusMethodNotAllowed {
+				t.Errorf("status=%d, got %d", http.StatusMethodNotAllowed, recorder.Code)
+			}
+
+			if got := recorder.Header().Get("Content-Type"); got != tt.expectedContentType {
+				t.Fatalf("content-type=%q, got %q", tt.expectedContentType, got)
+			}
+
+			if tt.expectedContentType != "application/problem+json" {
+				return
+			}
+
+			var problem map[string]any
+			if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("failed to decode body %q: %s", recorder.Body.String(), err)
+			}
+
+			expected := map[string]any{
+				"type":       "about:blank",
+				"title":      "Method Not Allowed",
+				"status":     float64(http.StatusMethodNotAllowed),
+				"detail":     "method POST is not allowed",
+				"request_id": "req-42",
+			}
+			for field, value := range expected {
+				if problem[field] != value {
+					t.Errorf("%s=%v, got %v", field, value, problem[field])
+				}
+			}
+		})
+	}
+}
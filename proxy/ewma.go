@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// defaultEWMADecay is how long it takes an old response time to lose most
+// of its weight in the average.
+const defaultEWMADecay = 10 * time.Second
+
+// ewmaFailurePenalty is the response time recorded for a failed attempt, so
+// a backend refusing connections quickly does not look fast.
+const ewmaFailurePenalty = time.Second
+
+// peakEWMA favours the backends answering fastest. A backend costs its
+// moving average response time times the requests it has in flight plus
+// one, and is picked with a probability proportional to its weight divided
+// by that cost. A response slower than the average replaces it at once so a
+// backend slowing down is avoided right away, faster ones pull it down
+// gradually.
+type peakEWMA struct {
+	decay time.Duration
+	clock Clock
+
+	mu    sync.Mutex
+	stats map[string]*latencyStats //by backendKey.
+}
+
+// latencyStats is what peakEWMA knows about one backend.
+type latencyStats struct {
+	average  float64 //nanoseconds, zero until the first response.
+	last     time.Time
+	inflight int
+}
+
+func newPeakEWMA(decay time.Duration, clock Clock) *peakEWMA {
+	if decay <= 0 {
+		decay = defaultEWMADecay
+	}
+
+	return &peakEWMA{
+		decay: decay,
+		clock: clock,
+		stats: make(map[string]*latencyStats),
+	}
+}
+
+// next picks the backend for a request from backends sorted by priority.
+func (e *peakEWMA) next(backends []*Backend) *Backend {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	group := backends
+	for i, backend := range backends {
+		if backend.Priority != backends[0].Priority {
+			group = backends[:i]
+			break
+		}
+	}
+
+	//backends without a response yet are assumed to be as fast as the others.
+	var measured, sum float64
+	for _, backend := range group {
+		if s := e.stats[backendKey(backend.URL)]; s != nil && s.average > 0 {
+			measured++
+			sum += s.average
+		}
+	}
+	fallback := 1.0
+	if measured > 0 {
+		fallback = sum / measured
+	}
+
+	shares := make([]float64, len(group))
+	var total float64
+	for i, backend := range group {
+		average, inflight := fallback, 0
+		if s := e.stats[backendKey(backend.URL)]; s != nil {
+			inflight = s.inflight
+			if s.average > 0 {
+				average = s.average
+			}
+		}
+
+		shares[i] = float64(backend.weight()) / (average * float64(inflight+1))
+		total += shares[i]
+	}
+
+	pick := rand.Float64() * total
+	for i, share := range shares {
+		pick -= share
+		if pick < 0 {
+			return group[i]
+		}
+	}
+	return group[len(group)-1]
+}
+
+// reset is a no op, response times are kept by backend URL so backends that
+// stay in the pool keep their average.
+func (e *peakEWMA) reset() {}
+
+// track counts a request to the backend with key as in flight, the returned
+// function records how it went once the response headers arrived.
+func (e *peakEWMA) track(key string) func(failed bool) {
+	e.mu.Lock()
+	s, ok := e.stats[key]
+	if !ok {
+		s = &latencyStats{}
+		e.stats[key] = s
+	}
+	s.inflight++
+	start := e.clock.Now()
+	e.mu.Unlock()
+
+	return func(failed bool) {
+		now := e.clock.Now()
+		rtt := now.Sub(start)
+		if failed {
+			rtt = max(rtt, ewmaFailurePenalty)
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		s.inflight--
+		s.observe(float64(rtt), now, e.decay)
+	}
+}
+
+// observe adds a response time to the average.
+func (s *latencyStats) observe(rtt float64, now time.Time, decay time.Duration) {
+	if s.average == 0 || rtt > s.average {
+		s.average = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(s.last)) / float64(decay))
+		s.average = s.average*w + rtt*(1-w)
+	}
+
+	//zero means unmeasured, a backend answering within the clock resolution is just fast.
+	s.average = max(s.average, 1)
+	s.last = now
+}
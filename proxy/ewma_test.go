@@ -0,0 +1,50 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestPeakEWMA(t *testing.T) {
+	var fastHits, slowHits atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+	}))
+	defer fast.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		time.Sleep(time.Millisecond * 20)
+	}))
+	defer slow.Close()
+
+	p, err := proxy.New(fast.URL, false, proxy.WithBackends(slow.URL), proxy.WithPeakEWMA(0))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	const requests = 200
+	for range requests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+		}
+	}
+
+	//round-robin would split the requests evenly.
+	if slowHits.Load()*5 > fastHits.Load() {
+		t.Errorf("expected the slow backend to get far fewer requests, fast=%d slow=%d", fastHits.Load(), slowHits.Load())
+	}
+
+	if fastHits.Load()+slowHits.Load() != requests {
+		t.Errorf("backend hits=%d, got %d", requests, fastHits.Load()+slowHits.Load())
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// isForward reports whether r asks the proxy to reach a destination of its
+// choosing, a CONNECT tunnel or a request with an absolute URI.
+func isForward(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+// forwardAllowed reports whether the forward proxy may reach host, which may
+// carry a port. Allowed entries match a host exactly, entries starting with
+// a dot match every subdomain.
+func (p *Proxy) forwardAllowed(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, allowed := range p.forwardHosts {
+		if strings.HasPrefix(allowed, ".") {
+			if strings.HasSuffix(strings.ToLower(host), strings.ToLower(allowed)) {
+				return true
+			}
+			continue
+		}
+
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// hopHeaders only concern a single connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, along with those
+// its Connection header names.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// newForwardTransport returns the transport forward requests are sent with.
+// Destinations are arbitrary hosts, none of the settings made for the
+// backends apply to them.
+func newForwardTransport(responseHeaderTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	return transport
+}
+
+// serveForward sends r to the destination it names instead of a backend.
+func (p *Proxy) serveForward(w http.ResponseWriter, r *http.Request) {
+	if !p.forwardAllowed(r.URL.Host) {
+		writeError(w, r, http.StatusForbidden, fmt.Sprintf("destination %s is not allowed", r.URL.Host))
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		//tunnels are for tls, not for reaching any service of an allowed host.
+		if _, port, err := net.SplitHostPort(r.URL.Host); err != nil || !slices.Contains(p.forwardConnectPorts, port) {
+			writeError(w, r, http.StatusForbidden, fmt.Sprintf("destination %s is not allowed", r.URL.Host))
+			return
+		}
+
+		p.serveConnect(w, r)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	//meant for this proxy, not the destination.
+	removeHopHeaders(req.Header)
+
+	resp, err := p.forwardTransport.RoundTrip(req)
+	if err != nil {
+		p.fail(w, r, http.StatusBadGateway, "forward request", err)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+
+	for header, values := range resp.Header {
+		for _, val := range values {
+			w.Header().Add(header, val)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// serveConnect opens a tunnel to the destination of a CONNECT request and
+// copies bytes in both directions until either side is done.
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.fail(w, r, http.StatusInternalServerError, "open tunnel", errors.New("client connection does not support tunnels"))
+		return
+	}
+
+	dialer := net.Dialer{Timeout: time.Second}
+	dest, err := dialer.DialContext(r.Context(), "tcp", r.URL.Host)
+	if err != nil {
+		p.fail(w, r, http.StatusBadGateway, "open tunnel", err)
+		return
+	}
+	defer dest.Close()
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		p.fail(w, r, http.StatusInternalServerError, "hijack client connection", err)
+		return
+	}
+	defer conn.Close()
+
+	//deadlines set by the server for the http exchange do not apply to the tunnel.
+	conn.SetDeadline(time.Time{})
+
+	brw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		//brw may already hold bytes the client sent after the request.
+		_, err := io.Copy(dest, brw)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, dest)
+		errs <- err
+	}()
+
+	//once either side is done the deferred closes stop the other copy.
+	<-errs
+}
@@ -0,0 +1,194 @@
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestForwardProxyConnect(t *testing.T) {
+	//an echo server stands in for any tcp destination.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	p, err := proxy.New("http://127.0.0.1:1", true,
+		proxy.WithForwardProxy("127.0.0.1"),
+		proxy.WithForwardConnectPorts(echo.Addr().(*net.TCPAddr).Port),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	tests := map[string]struct {
+		dest           string
+		expectedStatus int
+	}{
+		"allowed": {
+			dest:           echo.Addr().String(),
+			expectedStatus: http.StatusOK,
+		},
+		"not allowed": {
+			dest:           "localhost:22",
+			expectedStatus: http.StatusForbidden,
+		},
+		"port not allowed": {
+			dest:           "127.0.0.1:22",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %s", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", tt.dest, tt.dest)
+			reader := bufio.NewReader(conn)
+
+			resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Fatalf("failed to read response: %s", err)
+			}
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			fmt.Fprint(conn, "ping\n")
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read through the tunnel: %s", err)
+			}
+
+			if line != "ping\n" {
+				t.Errorf("echo=%q, got %q", "ping\n", line)
+			}
+		})
+	}
+}
+
+func TestForwardProxyAbsoluteURI(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("expected Proxy-Connection to be removed")
+		}
+		if r.Header.Get("X-Hop") != "" {
+			t.Errorf("expected the headers named by Connection to be removed")
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "destination")
+		fmt.Fprintf(w, "destination %s", r.URL.Path)
+	}))
+	defer dest.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "backend")
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, true, proxy.WithForwardProxy("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	proxyURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse url: %s", err)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, dest.URL+"/resource", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "client")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "destination /resource" {
+		t.Errorf("body=%q, got %q", "destination /resource", body)
+	}
+
+	if got := resp.Header.Get("X-Hop"); got != "" {
+		t.Errorf("expected X-Hop to be removed from the response, got %q", got)
+	}
+
+	//requests with a relative uri still go to the backend.
+	resp, err = http.Get(server.URL + "/resource")
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "backend" {
+		t.Errorf("body=backend, got %q", body)
+	}
+}
+
+func TestForwardProxyVerifiesDestinations(t *testing.T) {
+	//the certificate of the destination is not trusted by anyone.
+	dest := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer dest.Close()
+
+	//skipping verification is meant for the backends only.
+	p, err := proxy.New("http://127.0.0.1:1", true, proxy.WithForwardProxy("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, dest.URL+"/", nil))
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("status=%d, got %d", http.StatusBadGateway, recorder.Code)
+	}
+}
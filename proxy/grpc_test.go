@@ -0,0 +1,192 @@
+package proxy_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+	"golang.org/x/net/http2"
+)
+
+// grpcFrame prefixes msg with the gRPC length-prefixed message header.
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	return frame
+}
+
+func TestGRPCUnary(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("protocol=%d, got %d", 2, r.ProtoMajor)
+		}
+
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("TE=%s, got %s", "trailers", r.Header.Get("Te"))
+		}
+
+		req, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request: %s", err)
+			return
+		}
+
+		if !bytes.Equal(req, grpcFrame("ping")) {
+			t.Errorf("request=%v, got %v", grpcFrame("ping"), req)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write(grpcFrame("pong"))
+
+		//grpc servers send their status as trailers without announcing them.
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	proxyServer := httptest.NewUnstartedServer(p)
+	proxyServer.EnableHTTP2 = true
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+
+	//the second call makes sure the backend transport is only configured once.
+	for range 2 {
+		req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/echo.Echo/Ping", bytes.NewReader(grpcFrame("ping")))
+		if err != nil {
+			t.Fatalf("failed to create a new request: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to do the request to proxy server: %s", err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read response body: %s", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+		}
+
+		if !bytes.Equal(body, grpcFrame("pong")) {
+			t.Errorf("response=%v, got %v", grpcFrame("pong"), body)
+		}
+
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("grpc-status=%q, got %q", "0", got)
+		}
+
+		if got := resp.Trailer.Get("Grpc-Message"); got != "ok" {
+			t.Errorf("grpc-message=%q, got %q", "ok", got)
+		}
+	}
+}
+
+func TestGRPCServerStreaming(t *testing.T) {
+	messages := []string{"one", "two", "three"}
+	gap := time.Millisecond * 300
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+
+		for _, msg := range messages {
+			w.Write(grpcFrame(msg))
+			w.(http.Flusher).Flush()
+			time.Sleep(gap)
+		}
+
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	proxyServer := httptest.NewUnstartedServer(p)
+	proxyServer.EnableHTTP2 = true
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/echo.Echo/Stream", bytes.NewReader(grpcFrame("start")))
+	if err != nil {
+		t.Fatalf("failed to create a new request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to do the request to proxy server: %s", err)
+	}
+	defer resp.Body.Close()
+
+	for i, msg := range messages {
+		frame := make([]byte, len(grpcFrame(msg)))
+		if _, err := io.ReadFull(resp.Body, frame); err != nil {
+			t.Fatalf("failed to read message %d: %s", i, err)
+		}
+
+		if !bytes.Equal(frame, grpcFrame(msg)) {
+			t.Errorf("message=%v, got %v", grpcFrame(msg), frame)
+		}
+
+		//each message must arrive when the backend sends it, not when the stream ends.
+		if elapsed, sent := time.Since(start), gap*time.Duration(i); elapsed > sent+gap/2 {
+			t.Errorf("message %d arrived after %s, sent after %s", i, elapsed, sent)
+		}
+
+		if got := resp.Trailer.Get("Grpc-Status"); got != "" {
+			t.Errorf("expected no grpc-status before the last message, got %q", got)
+		}
+	}
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("failed to read the end of the stream: %s", err)
+	}
+
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("grpc-status=%q, got %q", "0", got)
+	}
+}
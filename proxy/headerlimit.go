@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isHeaderLimitError reports whether err is the transport refusing a
+// response whose headers exceed MaxResponseHeaderBytes. The transport does
+// not export a typed error for it.
+func isHeaderLimitError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// headerCount returns the number of header lines in h.
+func headerCount(h http.Header) int {
+	count := 0
+	for _, values := range h {
+		count += len(values)
+	}
+	return count
+}
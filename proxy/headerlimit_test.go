@@ -0,0 +1,55 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestResponseHeaderLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("X-Large", strings.Repeat("a", 8<<10))
+		case "/many":
+			for i := range 50 {
+				w.Header().Set(fmt.Sprintf("X-Header-%d", i), "value")
+			}
+		}
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithResponseHeaderLimits(4<<10, 20))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		path           string
+		expectedStatus int
+	}{
+		"within limits":     {path: "/", expectedStatus: http.StatusOK},
+		"oversized headers": {path: "/large", expectedStatus: http.StatusBadGateway},
+		"too many headers":  {path: "/many", expectedStatus: http.StatusBadGateway},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, rec.Code)
+			}
+
+			if tt.expectedStatus == http.StatusBadGateway && rec.Header().Get("X-Large") != "" {
+				t.Error("expected the backend headers not to be forwarded")
+			}
+		})
+	}
+}
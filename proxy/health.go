@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxHealthBody is how much of a health check response body is validated.
+const maxHealthBody = 64 << 10
+
+// HealthCheck describes how a backend is probed. A backend is healthy when
+// the probe answers with a 2xx status and, when set, a body containing Body
+// and matching BodyPattern. TCP checks only require the backend to accept a
+// connection within the timeout.
+type HealthCheck struct {
+	TCP     bool          //dial the backend instead of sending a request.
+	Path    string        //requested on the backend host, / when empty.
+	Timeout time.Duration //one second when zero.
+
+	Body        string         //text the response body must contain.
+	BodyPattern *regexp.Regexp //expression the response body must match.
+}
+
+// HealthChecker probes the backends of a proxy, the default ones and those
+// of every route, and takes the failing ones out of rotation until they
+// pass again. Backends with their own HealthCheck are probed with it instead
+// of the checker's.
+type HealthChecker struct {
+	HealthCheck
+
+	Proxy    *Proxy
+	Interval time.Duration //how often the backends are probed.
+	Client   *http.Client  //the proxy client when nil.
+	Logger   *slog.Logger  //slog.Default when nil.
+	Clock    Clock         //the wall clock when nil.
+
+	//AdjustWeights lowers the weight of backends whose probes answer slower
+	//than the fastest one of their pool, in proportion to the slowdown. The
+	//weights recover as the probe latency does. TCP probes count too.
+	AdjustWeights bool
+
+	//Jitter spreads the probes of a round over that fraction of Interval,
+	//each backend at its own random offset, instead of probing them all at
+	//once. The first round is still sent right away. Values above 1 are
+	//treated as 1.
+	Jitter float64
+}
+
+// Check probes every backend once and records the results. The returned
+// error lists the backends found unhealthy.
+func (h *HealthChecker) Check(ctx context.Context) error {
+	var errs []error
+	for _, target := range h.targets() {
+		if err := h.checkBackend(ctx, target.pool, target.backend); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// probeTarget is a backend along with the pool its health is recorded in.
+type probeTarget struct {
+	pool    *pool
+	backend *Backend
+	offset  time.Duration //from the start of a jittered round.
+}
+
+// targets returns every backend to probe.
+func (h *HealthChecker) targets() []probeTarget {
+	var targets []probeTarget
+	for _, pl := range h.Proxy.pools() {
+		for _, backend := range pl.list() {
+			targets = append(targets, probeTarget{pool: pl, backend: backend})
+		}
+	}
+	return targets
+}
+
+// checkBackend probes backend once and records the result in pl.
+func (h *HealthChecker) checkBackend(ctx context.Context, pl *pool, backend *Backend) error {
+	clock := clockOrDefault(h.Clock)
+
+	check := h.HealthCheck
+	if backend.HealthCheck != nil {
+		check = *backend.HealthCheck
+	}
+
+	start := clock.Now()
+	err := check.probe(ctx, backend.URL, h.client(backend))
+	pl.setHealthy(backend.URL, err == nil)
+	if err == nil && h.AdjustWeights {
+		pl.setProbeLatency(backend.URL, clock.Now().Sub(start))
+	}
+	if err != nil {
+		return fmt.Errorf("backend %s: %w", backend.URL, err)
+	}
+	return nil
+}
+
+func (h *HealthChecker) client(backend *Backend) *http.Client {
+	if h.Client == nil {
+		return h.Proxy.backendClient(backend)
+	}
+	return h.Client
+}
+
+// probe runs the check against backend.
+func (c HealthCheck) probe(ctx context.Context, backend *url.URL, client *http.Client) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if c.TCP {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", backendAddr(backend))
+		if err != nil {
+			return fmt.Errorf("dial: %w", err)
+		}
+		return conn.Close()
+	}
+
+	target := url.URL{Scheme: backend.Scheme, Host: backend.Host, Path: c.Path}
+	if target.Path == "" {
+		target.Path = "/"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if c.Body == "" && c.BodyPattern == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	if c.Body != "" && !strings.Contains(string(body), c.Body) {
+		return fmt.Errorf("body does not contain %q", c.Body)
+	}
+
+	if c.BodyPattern != nil && !c.BodyPattern.Match(body) {
+		return fmt.Errorf("body does not match %s", c.BodyPattern)
+	}
+	return nil
+}
+
+// Run checks the backends right away and then on every interval until ctx
+// is cancelled.
+func (h *HealthChecker) Run(ctx context.Context) error {
+	if h.Interval <= 0 {
+		return errors.New("health checker interval must be positive")
+	}
+
+	if err := h.Check(ctx); err != nil && ctx.Err() == nil {
+		loggerOrDefault(h.Logger).Warn("health check", "err", err)
+	}
+
+	clock := clockOrDefault(h.Clock)
+	for {
+		start := clock.Now()
+
+		var errs []error
+		for _, target := range h.schedule() {
+			if !sleep(ctx, clock, start.Add(target.offset).Sub(clock.Now())) {
+				return nil
+			}
+
+			if err := h.checkBackend(ctx, target.pool, target.backend); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if err := errors.Join(errs...); err != nil && ctx.Err() == nil {
+			loggerOrDefault(h.Logger).Warn("health check", "err", err)
+		}
+
+		if !sleep(ctx, clock, start.Add(h.Interval).Sub(clock.Now())) {
+			return nil
+		}
+	}
+}
+
+// schedule returns the backends of the next round ordered by their offset
+// into it. Without jitter they are all probed at the end of the interval.
+func (h *HealthChecker) schedule() []probeTarget {
+	targets := h.targets()
+
+	jitter := min(h.Jitter, 1)
+	for i := range targets {
+		targets[i].offset = h.Interval
+		if jitter > 0 {
+			targets[i].offset = time.Duration(rand.Float64() * jitter * float64(h.Interval))
+		}
+	}
+
+	slices.SortFunc(targets, func(a, b probeTarget) int { return cmp.Compare(a.offset, b.offset) })
+	return targets
+}
+
+// sleep waits for d on clock and reports whether ctx is still alive.
+func sleep(ctx context.Context, clock Clock, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(d):
+		return true
+	}
+}
+
+// probeLatencySmoothing is the share a new probe latency takes in the
+// average of its backend, so a single slow probe only lowers the weight a
+// little.
+const probeLatencySmoothing = 0.5
+
+// probeWeightScale multiplies configured weights once probe latencies are
+// known, so they can be lowered in small steps.
+const probeWeightScale = 100
+
+// setProbeLatency adds the latency of a passed health probe to the average
+// of backend.
+func (p *pool) setProbeLatency(backend *url.URL, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.latency == nil {
+		p.latency = make(map[string]time.Duration)
+	}
+
+	key := backendKey(backend)
+	if average, ok := p.latency[key]; ok {
+		latency = time.Duration(float64(average)*(1-probeLatencySmoothing) + float64(latency)*probeLatencySmoothing)
+	}
+	p.latency[key] = max(latency, 1)
+}
+
+// effectiveWeight returns the weight backend is balanced with, its own
+// weight lowered by how much slower its probes answer than the fastest
+// backend's of the pool.
+func (p *pool) effectiveWeight(backend *Backend) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.latency) == 0 {
+		return backend.weight()
+	}
+
+	weight := backend.weight() * probeWeightScale
+	own, ok := p.latency[backendKey(backend.URL)]
+	if !ok {
+		//not probed yet, nothing suggests it is slow.
+		return weight
+	}
+
+	fastest := own
+	for _, latency := range p.latency {
+		fastest = min(fastest, latency)
+	}
+	return max(int(float64(weight)*float64(fastest)/float64(own)), 1)
+}
+
+// pools returns the default pool and those of the routes with their own
+// backends.
+func (p *Proxy) pools() []*pool {
+	pools := []*pool{p.pool}
+	for _, rt := range p.routes {
+		if rt.pool != nil {
+			pools = append(pools, rt.pool)
+		}
+	}
+	return pools
+}
+
+// Healthy reports whether backend passed its last health check, backends
+// never checked are healthy.
+func (p *Proxy) Healthy(backend *url.URL) bool {
+	for _, pl := range p.pools() {
+		if !pl.isHealthy(backend) {
+			return false
+		}
+	}
+	return true
+}
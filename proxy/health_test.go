@@ -0,0 +1,361 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestHealthCheckBody(t *testing.T) {
+	newBackend := func(name, health string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				//degraded backends still answer with 200.
+				fmt.Fprint(w, health)
+				return
+			}
+			fmt.Fprint(w, name)
+		}))
+	}
+
+	healthy := newBackend("healthy", `{"status":"ok"}`)
+	defer healthy.Close()
+
+	degraded := newBackend("degraded", `{"status":"degraded"}`)
+	defer degraded.Close()
+
+	p, err := proxy.New(healthy.URL, false, proxy.WithBackends(degraded.URL))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]proxy.HealthCheck{
+		"string": {Path: "/healthz", Body: `"status":"ok"`},
+		"regexp": {Path: "/healthz", BodyPattern: regexp.MustCompile(`"status":\s*"ok"`)},
+	}
+
+	for name, check := range tests {
+		t.Run(name, func(t *testing.T) {
+			checker := proxy.HealthChecker{Proxy: p, HealthCheck: check}
+			if err := checker.Check(context.Background()); err == nil {
+				t.Fatal("expected the degraded backend to fail its check")
+			}
+
+			healthyURL, _ := url.Parse(healthy.URL)
+			degradedURL, _ := url.Parse(degraded.URL)
+
+			if !p.Healthy(healthyURL) {
+				t.Errorf("expected %s to be healthy", healthy.URL)
+			}
+
+			if p.Healthy(degradedURL) {
+				t.Errorf("expected %s to be unhealthy", degraded.URL)
+			}
+
+			server := httptest.NewServer(p)
+			defer server.Close()
+
+			for range 4 {
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					t.Fatalf("failed to send request: %s", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if string(body) != "healthy" {
+					t.Errorf("expected requests to skip the unhealthy backend, got %q", body)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	//accepts connections but never speaks http.
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer raw.Close()
+
+	go func() {
+		for {
+			conn, err := raw.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer web.Close()
+
+	//nothing listens on it anymore.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	closed.Close()
+
+	tests := map[string]struct {
+		backend         string
+		check           proxy.HealthCheck
+		expectedHealthy bool
+	}{
+		"tcp check on broken http": {
+			backend:         "http://" + raw.Addr().String(),
+			check:           proxy.HealthCheck{TCP: true},
+			expectedHealthy: true,
+		},
+		"http check on broken http": {
+			//the base path keeps it apart from the tcp checked entry.
+			backend:         "http://" + raw.Addr().String() + "/http",
+			check:           proxy.HealthCheck{},
+			expectedHealthy: false,
+		},
+		"tcp check on closed port": {
+			backend:         "http://" + closed.Addr().String(),
+			check:           proxy.HealthCheck{TCP: true},
+			expectedHealthy: false,
+		},
+		"http check on working http": {
+			backend:         web.URL,
+			check:           proxy.HealthCheck{},
+			expectedHealthy: true,
+		},
+	}
+
+	p, err := proxy.New(web.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	var backends []*proxy.Backend
+	for _, tt := range tests {
+		u, err := url.Parse(tt.backend)
+		if err != nil {
+			t.Fatalf("failed to parse url: %s", err)
+		}
+		check := tt.check
+		backends = append(backends, &proxy.Backend{URL: u, HealthCheck: &check})
+	}
+
+	if err := p.SetBackends(backends); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	//the checker's own check would fail every backend, each one uses its own.
+	checker := proxy.HealthChecker{Proxy: p, HealthCheck: proxy.HealthCheck{Path: "/missing", Body: "never"}}
+	checker.Check(context.Background())
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			u, _ := url.Parse(tt.backend)
+			if got := p.Healthy(u); got != tt.expectedHealthy {
+				t.Errorf("healthy=%t, got %t", tt.expectedHealthy, got)
+			}
+		})
+	}
+}
+
+func TestBackgroundTasksStop(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	backendURL, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(backendURL.Port())
+
+	tasks := map[string]func(ctx context.Context) error{
+		"health checker": (&proxy.HealthChecker{Proxy: p, Interval: time.Millisecond}).Run,
+		"dns refresher":  (&proxy.DNSRefresher{Interval: time.Millisecond, Lookuper: &stubHosts{}}).Run,
+		"srv resolver": (&proxy.SRVResolver{
+			Proxy:    p,
+			Name:     "backend.internal",
+			Interval: time.Millisecond,
+			Lookuper: stubSRV{records: []*net.SRV{{Target: "127.0.0.1.", Port: uint16(port)}}},
+		}).Run,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	for _, run := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx)
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected every background task to stop once the context was cancelled")
+	}
+}
+
+func TestHealthCheckLatencyWeights(t *testing.T) {
+	clock := newFakeClock()
+
+	//probes take as long as the backend advances the clock.
+	var probeDelay sync.Map
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				delay, _ := probeDelay.Load(name)
+				clock.advance(delay.(time.Duration))
+				return
+			}
+			fmt.Fprint(w, name)
+		}))
+	}
+
+	fast := newBackend("fast")
+	defer fast.Close()
+	probeDelay.Store("fast", time.Millisecond*10)
+
+	slow := newBackend("slow")
+	defer slow.Close()
+	probeDelay.Store("slow", time.Millisecond*100)
+
+	p, err := proxy.New(fast.URL, false, proxy.WithBackends(slow.URL))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	checker := proxy.HealthChecker{
+		HealthCheck:   proxy.HealthCheck{Path: "/healthz"},
+		Proxy:         p,
+		Clock:         clock,
+		AdjustWeights: true,
+	}
+
+	share := func() float64 {
+		t.Helper()
+
+		const requests = 110
+		slowHits := 0
+		for range requests {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+			if recorder.Body.String() == "slow" {
+				slowHits++
+			}
+		}
+		return float64(slowHits) / requests
+	}
+
+	if err := checker.Check(context.Background()); err != nil {
+		t.Fatalf("failed to check: %s", err)
+	}
+
+	//ten times the latency, a tenth of the weight.
+	if got := share(); got > 0.1 {
+		t.Errorf("expected the slow backend to get at most 10%% of the requests, got %.0f%%", got*100)
+	}
+
+	probeDelay.Store("slow", time.Millisecond*10)
+	for range 10 {
+		if err := checker.Check(context.Background()); err != nil {
+			t.Fatalf("failed to check: %s", err)
+		}
+	}
+
+	if got := share(); got < 0.45 {
+		t.Errorf("expected the recovered backend to get about half the requests, got %.0f%%", got*100)
+	}
+}
+
+func TestHealthCheckJitter(t *testing.T) {
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer server.Close()
+
+	//backends differing by path only, the probes all land on the same server.
+	var backends []string
+	for i := range 9 {
+		backends = append(backends, server.URL+"/"+strconv.Itoa(i))
+	}
+
+	p, err := proxy.New(server.URL, false, proxy.WithBackends(backends...))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	clock := newFakeClock()
+	checker := proxy.HealthChecker{Proxy: p, Interval: time.Hour, Clock: clock, Jitter: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checker.Run(ctx)
+
+	//waits for the checker to be parked on the clock again.
+	parked := func() {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for clock.waiting() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the health checker to wait on the clock")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	parked()
+	if got := probes.Load(); got != 10 {
+		t.Fatalf("expected the first round to probe every backend right away, got %d probes", got)
+	}
+
+	//the next round is spread over the hour, not sent in one go.
+	probes.Store(0)
+	busySteps := 0
+	for range 10 {
+		before := probes.Load()
+		clock.advance(time.Minute * 6)
+		parked()
+		if probes.Load() > before {
+			busySteps++
+		}
+	}
+
+	if got := probes.Load(); got != 10 {
+		t.Errorf("probes=10, got %d", got)
+	}
+
+	if busySteps < 2 {
+		t.Errorf("expected the probes to be spread across the interval, all landed in %d step", busySteps)
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotentCall is the request sent for one Idempotency-Key, resp is set
+// once done is closed when the response can be replayed.
+type idempotentCall struct {
+	done    chan struct{}
+	resp    *sharedResponse
+	expires time.Time
+	el      *list.Element //position among the stored calls.
+}
+
+// idempotencyStore remembers the responses to non-idempotent requests by
+// their Idempotency-Key, so a retried request gets the first response
+// instead of running again. It holds at most maxEntries responses, the
+// oldest one is dropped first.
+type idempotencyStore struct {
+	ttl        time.Duration
+	maxEntries int
+	clock      Clock
+
+	mu     sync.Mutex
+	calls  map[string]*idempotentCall
+	stored *list.List //keys of the completed calls, oldest first.
+}
+
+func newIdempotencyStore(ttl time.Duration, maxEntries int, clock Clock) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		clock:      clock,
+		calls:      make(map[string]*idempotentCall),
+		stored:     list.New(),
+	}
+}
+
+// idempotencyKey returns the key r is remembered by and whether r carries
+// an Idempotency-Key at all. Keys are chosen by clients, they are scoped to
+// the host, request target and credentials so clients can not see each
+// other's responses.
+func idempotencyKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		return "", false
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return "", false
+	}
+
+	return routePrefix(r) + r.Method + " " + clientHost(r) + r.URL.RequestURI() +
+		"\x00" + r.Header.Get("Authorization") + "\x00" + r.Header.Get("Cookie") + "\x00" + key, true
+}
+
+// do runs fn for the first request with key and replays its response to
+// the requests repeating the key until it expires. Requests arriving while
+// fn is in flight wait for it until ctx is done. Failed requests, server
+// errors and bodies too large to buffer are not remembered, waiters then
+// send their own.
+func (s *idempotencyStore) do(ctx context.Context, key string, fn func() (*http.Response, error)) (*http.Response, error) {
+	s.mu.Lock()
+	c, ok := s.calls[key]
+	if ok && c.el != nil && !s.clock.Now().Before(c.expires) {
+		s.remove(key, c)
+		ok = false
+	}
+
+	if ok {
+		s.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+		if c.resp == nil {
+			return fn()
+		}
+		return replayed(c.resp), nil
+	}
+
+	c = &idempotentCall{done: make(chan struct{})}
+	s.calls[key] = c
+	s.mu.Unlock()
+
+	shared, own, err := readShared(fn)
+
+	s.mu.Lock()
+	if err == nil && shared.statusCode < http.StatusInternalServerError {
+		c.resp = shared
+		c.expires = s.clock.Now().Add(s.ttl)
+		c.el = s.stored.PushBack(key)
+		if s.maxEntries > 0 && s.stored.Len() > s.maxEntries {
+			oldest := s.stored.Front().Value.(string)
+			s.remove(oldest, s.calls[oldest])
+		}
+	} else {
+		delete(s.calls, key)
+	}
+	s.mu.Unlock()
+	close(c.done)
+
+	if own != nil {
+		return own, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return shared.response(), nil
+}
+
+// remove forgets the call stored under key, s.mu must be held.
+func (s *idempotencyStore) remove(key string, c *idempotentCall) {
+	delete(s.calls, key)
+	if c.el != nil {
+		s.stored.Remove(c.el)
+	}
+}
+
+// replayed returns a copy of resp marked as a replay for the client.
+func replayed(resp *sharedResponse) *http.Response {
+	replay := resp.response()
+	replay.Header.Set("Idempotent-Replayed", "true")
+	return replay
+}
@@ -0,0 +1,219 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		//keep the request in flight so the concurrent ones pile up behind it.
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "order %d", n)
+	}))
+	defer backend.Close()
+
+	clock := newFakeClock()
+	p, err := proxy.New(backend.URL, false, proxy.WithIdempotency(time.Minute, 10), proxy.WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("item=1"))
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := send("a")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("status=%d, got %d", http.StatusCreated, first.Code)
+	}
+
+	second := send("a")
+	if second.Code != http.StatusCreated {
+		t.Errorf("status=%d, got %d", http.StatusCreated, second.Code)
+	}
+
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("body=%q, got %q", first.Body.String(), second.Body.String())
+	}
+
+	if got := second.Header().Get("Idempotent-Replayed"); got != "true" {
+		t.Errorf("Idempotent-Replayed=true, got %q", got)
+	}
+
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("hits=1, got %d", got)
+	}
+
+	//requests with the same new key wait for the first one in flight.
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bs, _ := io.ReadAll(send("b").Body)
+			bodies[i] = string(bs)
+		}()
+	}
+	wg.Wait()
+
+	if got := hits.Load(); got != 2 {
+		t.Errorf("hits=2, got %d", got)
+	}
+
+	for _, body := range bodies {
+		if body != "order 2" {
+			t.Errorf("body=%q, got %q", "order 2", body)
+		}
+	}
+
+	clock.advance(time.Minute)
+	if rec := send("a"); rec.Body.String() != "order 3" {
+		t.Errorf("body=%q, got %q", "order 3", rec.Body.String())
+	}
+}
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithIdempotency(time.Minute, 1))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		key           string
+		expectedHits  int32
+	}{
+		{name: "first request", method: http.MethodPost, key: "a", expectedHits: 1},
+		{name: "replayed", method: http.MethodPost, key: "a", expectedHits: 1},
+		{name: "other client", method: http.MethodPost, authorization: "Bearer other", key: "a", expectedHits: 2},
+		{name: "evicted by the other client", method: http.MethodPost, key: "a", expectedHits: 3},
+		{name: "PUT is already idempotent", method: http.MethodPut, key: "a", expectedHits: 4},
+		{name: "no key", method: http.MethodPost, expectedHits: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/orders", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.key != "" {
+				req.Header.Set("Idempotency-Key", tt.key)
+			}
+			p.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := hits.Load(); got != tt.expectedHits {
+				t.Errorf("hits=%d, got %d", tt.expectedHits, got)
+			}
+		})
+	}
+}
+
+func TestIdempotencyUnbounded(t *testing.T) {
+	if _, err := proxy.New("http://localhost:8080", false, proxy.WithIdempotency(time.Minute, 0)); err == nil {
+		t.Error("expected an unbounded idempotency store to be rejected")
+	}
+}
+
+func TestIdempotencyKeyedByHost(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, r.Host)
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithIdempotency(time.Minute, 10), proxy.WithPreserveHostHeader(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	//virtual hosts behind the same backend do not replay each other's responses.
+	for range 2 {
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+			req.Host = host
+			req.Header.Set("Idempotency-Key", "a")
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if body := recorder.Body.String(); body != host {
+				t.Errorf("body=%s, got %s", host, body)
+			}
+		}
+	}
+
+	if got := hits.Load(); got != 2 {
+		t.Errorf("hits=2, got %d", got)
+	}
+}
+
+func TestIdempotencyWaiterContext(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	p, err := proxy.New(backend.URL, false, proxy.WithIdempotency(time.Minute, 10), proxy.WithResponseHeaderTimeout(10*time.Second))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	send := func(ctx context.Context) {
+		req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/orders", nil)
+		req.Header.Set("Idempotency-Key", "a")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	//the first request holds the key until the backend is released.
+	go send(context.Background())
+	time.Sleep(20 * time.Millisecond)
+
+	//a client waiting behind it can still go away.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		send(ctx)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the waiting request to end with its context")
+	}
+}
@@ -0,0 +1,72 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestListenKeepAlive(t *testing.T) {
+	lc := proxy.ListenConfig{
+		KeepAlive: net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 3},
+	}
+
+	listeners, err := lc.Listen(context.Background(), []string{"127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listeners[0].Close()
+
+	client, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer client.Close()
+
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get raw conn: %s", err)
+	}
+
+	tests := map[string]struct {
+		level    int
+		option   int
+		expected int
+	}{
+		"SO_KEEPALIVE":  {level: syscall.SOL_SOCKET, option: syscall.SO_KEEPALIVE, expected: 1},
+		"TCP_KEEPIDLE":  {level: syscall.IPPROTO_TCP, option: syscall.TCP_KEEPIDLE, expected: 30},
+		"TCP_KEEPINTVL": {level: syscall.IPPROTO_TCP, option: syscall.TCP_KEEPINTVL, expected: 5},
+		"TCP_KEEPCNT":   {level: syscall.IPPROTO_TCP, option: syscall.TCP_KEEPCNT, expected: 3},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var value int
+			var sockErr error
+			err := raw.Control(func(fd uintptr) {
+				value, sockErr = syscall.GetsockoptInt(int(fd), tt.level, tt.option)
+			})
+			if err != nil {
+				t.Fatalf("failed to control conn: %s", err)
+			}
+
+			if sockErr != nil {
+				t.Fatalf("failed to read %s: %s", name, sockErr)
+			}
+
+			if value != tt.expected {
+				t.Errorf("%s=%d, got %d", name, tt.expected, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// lifetimeConn is a backend connection retired once its lifetime ran out.
+// A connection still serving requests is closed when the last one is done,
+// an idle one right away.
+type lifetimeConn struct {
+	net.Conn
+	timer *time.Timer
+
+	mu      sync.Mutex
+	active  int
+	expired bool
+}
+
+func (c *lifetimeConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	idle := c.active == 0
+	c.mu.Unlock()
+
+	if idle {
+		c.Conn.Close()
+	}
+}
+
+// acquire marks the connection as serving a request.
+func (c *lifetimeConn) acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active++
+}
+
+// release marks a request on the connection as done.
+func (c *lifetimeConn) release() {
+	c.mu.Lock()
+	c.active--
+	retire := c.expired && c.active == 0
+	c.mu.Unlock()
+
+	if retire {
+		c.Conn.Close()
+	}
+}
+
+func (c *lifetimeConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// limitConnLifetime wraps dial so connections are retired after lifetime,
+// which makes backends behind a load balancer get rebalanced.
+func limitConnLifetime(dial func(ctx context.Context, network, addr string) (net.Conn, error), lifetime time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		lc := lifetimeConn{Conn: conn}
+		lc.timer = time.AfterFunc(lifetime, lc.expire)
+		return &lc, nil
+	}
+}
+
+// findLifetimeConn returns the lifetimeConn below conn, nil when there is
+// none.
+func findLifetimeConn(conn net.Conn) *lifetimeConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *lifetimeConn:
+			return c
+		case *casingConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// traceConnLifetime returns r with a trace holding the connection it is sent
+// on until the returned release func is called, so the connection is not
+// retired while the response is being read.
+func traceConnLifetime(r *http.Request) (*http.Request, func()) {
+	var mu sync.Mutex
+	var held *lifetimeConn
+
+	trace := httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			lc := findLifetimeConn(info.Conn)
+			if lc == nil {
+				return
+			}
+
+			lc.acquire()
+			mu.Lock()
+			previous := held
+			held = lc
+			mu.Unlock()
+
+			//a retry inside the transport moved the request to another connection.
+			if previous != nil {
+				previous.release()
+			}
+		},
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if held != nil {
+				held.release()
+			}
+		})
+	}
+
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), &trace)), release
+}
+
+// releaseBody calls release once the body was read to the end or closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
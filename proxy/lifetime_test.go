@@ -0,0 +1,75 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestConnLifetime(t *testing.T) {
+	var dials atomic.Int32
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			//outlives the connection lifetime while the request is in flight.
+			time.Sleep(150 * time.Millisecond)
+		}
+		fmt.Fprint(w, "Hello World!")
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true, proxy.WithConnLifetime(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	send := func(path string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		body, _ := io.ReadAll(recorder.Body)
+		if recorder.Code != http.StatusOK || string(body) != "Hello World!" {
+			t.Fatalf("status=%d, got %d with body %q", http.StatusOK, recorder.Code, body)
+		}
+	}
+
+	//within the lifetime the connection is reused.
+	send("/")
+	send("/")
+	if got := dials.Load(); got != 1 {
+		t.Fatalf("dials=1, got %d", got)
+	}
+
+	//the lifetime runs out while the request is served, it still completes.
+	send("/slow")
+
+	//the expired connection was retired, a new one is dialed.
+	time.Sleep(20 * time.Millisecond)
+	send("/")
+	if got := dials.Load(); got != 2 {
+		t.Errorf("dials=2, got %d", got)
+	}
+
+	//an idle connection is retired once its lifetime ran out as well.
+	time.Sleep(150 * time.Millisecond)
+	send("/")
+	if got := dials.Load(); got != 3 {
+		t.Errorf("dials=3, got %d", got)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ListenConfig configures the listeners opened by Listen.
+type ListenConfig struct {
+	//ReusePort sets SO_REUSEPORT so a new instance can bind the port before
+	//the old one exits. It is ignored on platforms without it.
+	ReusePort bool
+
+	//KeepAlive tunes the TCP keepalive probes of accepted connections when
+	//its Enable is set, so dead clients are noticed and their connections
+	//freed. Otherwise Go's default of a probe every 15 seconds applies.
+	KeepAlive net.KeepAliveConfig
+
+	Logger *slog.Logger //slog.Default when nil.
+}
+
+// Listen opens a TCP listener on each of addrs, so one server can accept
+// connections on several interfaces or address families. When any address
+// fails, the listeners opened so far are closed again.
+func (c ListenConfig) Listen(ctx context.Context, addrs []string) ([]net.Listener, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+
+	var lc net.ListenConfig
+	if c.KeepAlive.Enable {
+		lc.KeepAliveConfig = c.KeepAlive
+	}
+
+	if c.ReusePort {
+		if reusePortSupported {
+			lc.Control = reusePort
+		} else {
+			loggerOrDefault(c.Logger).Warn("SO_REUSEPORT is not supported on this platform, listening without it")
+		}
+	}
+
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := lc.Listen(ctx, "tcp", addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Listen opens a TCP listener on each of addrs with the default ListenConfig.
+func Listen(ctx context.Context, addrs []string) ([]net.Listener, error) {
+	return ListenConfig{}.Listen(ctx, addrs)
+}
+
+// connLimitListener limits the number of concurrent connections per client
+// IP.
+type connLimitListener struct {
+	net.Listener
+	limit  int
+	exempt []netip.Prefix
+
+	mu     sync.Mutex
+	counts map[netip.Addr]int
+}
+
+// NewConnLimitListener wraps l so each client IP holds at most limit open
+// connections, connections beyond the limit are closed as soon as they are
+// accepted. Clients inside exempt, such as trusted proxies or load balancers
+// carrying many clients, are not limited.
+func NewConnLimitListener(l net.Listener, limit int, exempt []netip.Prefix) net.Listener {
+	return &connLimitListener{
+		Listener: l,
+		limit:    limit,
+		exempt:   exempt,
+		counts:   make(map[netip.Addr]int),
+	}
+}
+
+// Accept returns the next connection within the limit of its client IP.
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			//not an ip connection, nothing to limit by.
+			return conn, nil
+		}
+		ip := addrPort.Addr().Unmap()
+
+		if l.isExempt(ip) {
+			return conn, nil
+		}
+
+		l.mu.Lock()
+		if l.counts[ip] >= l.limit {
+			l.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		l.counts[ip]++
+		l.mu.Unlock()
+
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *connLimitListener) isExempt(ip netip.Addr) bool {
+	for _, prefix := range l.exempt {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *connLimitListener) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counts[ip]--
+	if l.counts[ip] <= 0 {
+		delete(l.counts, ip)
+	}
+}
+
+// limitedConn gives its slot back to the listener when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,178 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// serveGreeting accepts connections from l and writes a byte on each so
+// clients can tell an accepted connection apart from a refused one.
+func serveGreeting(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.Write([]byte("k"))
+			io.Copy(io.Discard, conn)
+		}()
+	}
+}
+
+// accepted reports whether the listener kept the connection open.
+func accepted(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1)
+	_, err := conn.Read(buf)
+	return err == nil
+}
+
+func TestConnLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	l := proxy.NewConnLimitListener(inner, 2, nil)
+	defer l.Close()
+	go serveGreeting(l)
+
+	var conns []net.Conn
+	for range 3 {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %s", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	for i, conn := range conns[:2] {
+		if !accepted(t, conn) {
+			t.Errorf("expected connection %d to be accepted", i)
+		}
+	}
+
+	if accepted(t, conns[2]) {
+		t.Errorf("expected connection beyond the limit to be refused")
+	}
+
+	//closing a connection frees its slot.
+	conns[0].Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+
+	if !accepted(t, conn) {
+		t.Errorf("expected connection to be accepted after a slot was freed")
+	}
+}
+
+func TestConnLimitListenerTrusted(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	trusted := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	l := proxy.NewConnLimitListener(inner, 1, trusted)
+	defer l.Close()
+	go serveGreeting(l)
+
+	for i := range 3 {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %s", err)
+		}
+		defer conn.Close()
+
+		if !accepted(t, conn) {
+			t.Errorf("expected connection %d from a trusted proxy to be accepted", i)
+		}
+	}
+}
+
+func TestListenMultipleAddresses(t *testing.T) {
+	listeners, err := proxy.Listen(context.Background(), []string{"127.0.0.1:0", "127.0.0.2:0"})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	server := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello World!")
+		}),
+	}
+	defer server.Close()
+
+	for _, l := range listeners {
+		go server.Serve(l)
+	}
+
+	for _, l := range listeners {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to send request to %s: %s", l.Addr(), err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "Hello World!" {
+			t.Errorf("%s: body=%q, got %q", l.Addr(), "Hello World!", body)
+		}
+	}
+
+	//shutting the server down closes every listener.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shutdown: %s", err)
+	}
+
+	for _, l := range listeners {
+		if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			t.Errorf("expected %s to be closed", l.Addr())
+		}
+	}
+}
+
+func TestListenClosesOnFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer taken.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	if _, err := proxy.Listen(context.Background(), []string{freeAddr, taken.Addr().String()}); err == nil {
+		t.Fatal("expected listening on a taken address to fail")
+	}
+
+	//the address opened before the failure is free again.
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("expected %s to be released: %s", freeAddr, err)
+	}
+	l.Close()
+}
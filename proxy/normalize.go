@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// normalizeRequestPath rewrites the path of r to its normalized form, see
+// normalizePath. It reports false when strict is set and the path was
+// suspicious, r is left untouched then.
+func normalizeRequestPath(r *http.Request, strict bool) bool {
+	escaped := r.URL.EscapedPath()
+	if !strings.HasPrefix(escaped, "/") {
+		//asterisk and authority forms have no path to normalize.
+		return true
+	}
+
+	normalized, suspicious := normalizePath(escaped)
+	if suspicious && strict {
+		return false
+	}
+
+	if normalized == escaped {
+		return true
+	}
+
+	unescaped, err := url.PathUnescape(normalized)
+	if err != nil {
+		return !strict
+	}
+	r.URL.Path = unescaped
+	r.URL.RawPath = normalized
+	return true
+}
+
+// normalizePath decodes percent-encoded unreserved characters in the
+// escaped path p, collapses repeated slashes and resolves . and .. segments.
+// It also reports whether p was suspicious, holding dot segments or encoded
+// separators that backends may interpret differently than the proxy.
+func normalizePath(p string) (string, bool) {
+	decoded := decodeUnreserved(p)
+
+	suspicious := false
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == "." || segment == ".." {
+			suspicious = true
+			break
+		}
+	}
+
+	lower := strings.ToLower(decoded)
+	for _, encoded := range []string{"%2f", "%5c", "%00"} {
+		if strings.Contains(lower, encoded) {
+			suspicious = true
+		}
+	}
+
+	cleaned := path.Clean(decoded)
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, suspicious
+}
+
+// decodeUnreserved decodes percent-encodings of characters that never need
+// encoding in a path, such as %41 for A or %2E for a dot.
+func decodeUnreserved(p string) string {
+	if !strings.Contains(p, "%") {
+		return p
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '%' && i+2 < len(p) {
+			if c, ok := unhex(p[i+1], p[i+2]); ok && isUnreserved(c) {
+				b.WriteByte(c)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+func unhex(hi, lo byte) (byte, bool) {
+	h, ok := hexValue(hi)
+	if !ok {
+		return 0, false
+	}
+	l, ok := hexValue(lo)
+	if !ok {
+		return 0, false
+	}
+	return h<<4 | l, true
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
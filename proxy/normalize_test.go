@@ -0,0 +1,92 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestPathNormalization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.EscapedPath())
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		strict         bool
+		path           string
+		expectedStatus int
+		expectedPath   string
+	}{
+		"dot segments": {
+			path:           "//a/../b",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/b",
+		},
+		"encoded unreserved": {
+			path:           "/%61pi/%7Euser/",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/api/~user/",
+		},
+		"encoded traversal": {
+			path:           "/public/%2e%2e/admin",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/admin",
+		},
+		"encoded slash kept": {
+			path:           "/files/a%2Fb",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/files/a%2Fb",
+		},
+		"strict double slash": {
+			strict:         true,
+			path:           "/a//b",
+			expectedStatus: http.StatusOK,
+			expectedPath:   "/a/b",
+		},
+		"strict traversal": {
+			strict:         true,
+			path:           "/public/%2e%2e/admin",
+			expectedStatus: http.StatusBadRequest,
+		},
+		"strict encoded slash": {
+			strict:         true,
+			path:           "/public%2F..%2Fadmin",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, false, proxy.WithPathNormalization(tt.strict))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			body, err := io.ReadAll(recorder.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+
+			if string(body) != tt.expectedPath {
+				t.Errorf("path=%s, got %s", tt.expectedPath, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,622 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Option configures optional behaviour of the proxy.
+type Option func(*config)
+
+// config holds the optional settings applied by New.
+type config struct {
+	serverName string
+	rootCAs    *x509.CertPool
+
+	disableKeepAlives     bool
+	idleConnTimeout       time.Duration
+	expectContinueTimeout time.Duration
+	responseHeaderTimeout time.Duration
+	maxConnsPerHost       int
+	connLifetime          time.Duration
+
+	coalesce bool
+	cache    Cache
+
+	cacheStatuses []int
+	cacheMethods  []string
+
+	backends       []string
+	noBackends     bool
+	maxBackends    int
+	retries        int
+	requestTimeout time.Duration
+
+	timeoutHeader    string
+	maxHeaderTimeout time.Duration
+
+	debug bool
+
+	preserveHeaderCase bool
+	dnsRefresher       *DNSRefresher
+
+	routes []Route
+
+	allowedMethods []string
+
+	normalizePaths bool
+	strictPaths    bool
+
+	cookieRewrite *CookieRewrite
+	preserveHost  bool
+
+	uploadLimit   int64
+	downloadLimit int64
+
+	logger *slog.Logger
+
+	forward             bool
+	forwardHosts        []string
+	forwardConnectPorts []string
+
+	compress            bool
+	requestCompressSize int64
+
+	stickyCookie string
+
+	forwardClientCert bool
+
+	concurrencyLimit *ConcurrencyLimit
+
+	trustedProxies []netip.Prefix
+	allowIPs       []netip.Prefix
+	denyIPs        []netip.Prefix
+	geoHook        GeoHook
+
+	copyBufferSize int
+
+	maxResponseHeaderBytes int64
+	maxResponseHeaders     int
+
+	accessLog        bool
+	backendRequestID string
+
+	defaultScheme string
+
+	clock Clock
+
+	altSvcPort   int
+	altSvcMaxAge time.Duration
+
+	socks5Addr     string
+	socks5Username string
+	socks5Password string
+
+	peakEWMA  bool
+	ewmaDecay time.Duration
+
+	maintenancePage []byte
+
+	statusRewrites map[int]int
+
+	modifyResponse func(*http.Response) error
+	director       func(*http.Request)
+
+	idempotencyTTL     time.Duration
+	idempotencyMaxKeys int
+}
+
+// WithServerName sets the TLS server name used for SNI and certificate
+// validation when dialing the backends. It is required when a backend is
+// dialed by IP or through a load balancer whose address does not match the
+// certificate. Backends with a ServerName of their own use it instead.
+func WithServerName(name string) Option {
+	return func(c *config) {
+		c.serverName = name
+	}
+}
+
+// WithRootCAs sets the certificate pool used to verify the backend
+// certificate. The system pool is used when not set.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *config) {
+		c.rootCAs = pool
+	}
+}
+
+// WithDisableKeepAlives forces a fresh backend connection for every request
+// instead of reusing idle ones.
+func WithDisableKeepAlives(disable bool) Option {
+	return func(c *config) {
+		c.disableKeepAlives = disable
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle backend connection is kept in
+// the pool before it is closed. Zero means no limit.
+func WithIdleConnTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.idleConnTimeout = d
+	}
+}
+
+// WithMaxConnsPerHost limits the connections open to each backend, requests
+// wait for a free connection once the limit is reached. Zero means no limit.
+func WithMaxConnsPerHost(n int) Option {
+	return func(c *config) {
+		c.maxConnsPerHost = n
+	}
+}
+
+// WithConnLifetime retires backend connections once they have been open for
+// d, so connections cycle even under steady load and load balancers in front
+// of the backends get to rebalance them. Requests in flight are completed
+// before the connection is closed.
+func WithConnLifetime(d time.Duration) Option {
+	return func(c *config) {
+		c.connLifetime = d
+	}
+}
+
+// WithExpectContinueTimeout sets how long the body of a request sent with
+// "Expect: 100-continue" is held back waiting for the backend to answer with
+// 100 Continue, one second by default. The client only receives its own 100
+// Continue once the backend agreed, or the wait ran out, and the body is
+// streamed after it. A backend rejecting the request never gets the body.
+func WithExpectContinueTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.expectContinueTimeout = d
+	}
+}
+
+// WithResponseHeaderTimeout bounds how long the proxy waits for the headers
+// of a backend response once the request was sent, one second by default.
+// Streaming the body afterwards is not bound by it. Requests running out of
+// it are answered with 504.
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.responseHeaderTimeout = d
+	}
+}
+
+// WithCoalescing makes identical concurrent GET and HEAD requests share a
+// single upstream request. The shared response is buffered in memory before
+// it is written to the waiting clients.
+func WithCoalescing(enabled bool) Option {
+	return func(c *config) {
+		c.coalesce = enabled
+	}
+}
+
+// WithCache enables caching of upstream responses in c. Only responses with
+// a cacheable status and method that carry an explicit freshness lifetime
+// are stored.
+func WithCache(c Cache) Option {
+	return func(cfg *config) {
+		cfg.cache = c
+	}
+}
+
+// WithCacheStatuses sets the response statuses stored in the cache,
+// replacing the default of 200, 203, 300, 301, 404 and 410. Responses marked
+// no-store or private are never stored whatever their status.
+func WithCacheStatuses(statuses ...int) Option {
+	return func(c *config) {
+		c.cacheStatuses = statuses
+	}
+}
+
+// WithCacheMethods sets the request methods served from the cache,
+// replacing the default of GET and HEAD. Entries are keyed by method and
+// URL only, methods whose response depends on the request body do not
+// belong here.
+func WithCacheMethods(methods ...string) Option {
+	return func(c *config) {
+		c.cacheMethods = methods
+	}
+}
+
+// WithBackends adds backends next to the one passed to New. Requests are
+// spread across all backends in round-robin order, SetBackends can be used
+// to change them later on.
+func WithBackends(hosts ...string) Option {
+	return func(c *config) {
+		c.backends = append(c.backends, hosts...)
+	}
+}
+
+// WithNoBackends lets New create a proxy without any backend, when host is
+// empty and no backends were added, for backends set later on with
+// SetBackends or an SRVResolver. Requests are answered with 503 until then.
+func WithNoBackends(allowed bool) Option {
+	return func(c *config) {
+		c.noBackends = allowed
+	}
+}
+
+// WithMaxBackends caps the number of default backends, New and
+// SetBackends fail when given more. Zero means no limit.
+func WithMaxBackends(n int) Option {
+	return func(c *config) {
+		c.maxBackends = n
+	}
+}
+
+// WithRetries sets how many of the following backends are tried when
+// forwarding a request fails. Request bodies are streamed to the backend and
+// never buffered to be replayed, so requests with a body that cannot be
+// recreated are never retried.
+func WithRetries(n int) Option {
+	return func(c *config) {
+		c.retries = n
+	}
+}
+
+// WithRequestTimeout bounds the time from receiving a request until the
+// backend response is copied, spanning backend selection and every retry
+// attempt. When it runs out before the response headers arrive the client
+// gets a 504, either way the backend request is cancelled. Streamed
+// responses, that is gRPC calls and bodies of unknown length, are only
+// bound until their headers arrive.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.requestTimeout = d
+	}
+}
+
+// WithTimeoutHeader lets clients shorten the request timeout for their own
+// request with header, such as X-Timeout in seconds or Grpc-Timeout in its
+// own format. The requested timeout is capped at max and never extends the
+// one set by WithRequestTimeout. Running out of it answers with a 504.
+func WithTimeoutHeader(header string, max time.Duration) Option {
+	return func(c *config) {
+		c.timeoutHeader = header
+		c.maxHeaderTimeout = max
+	}
+}
+
+// WithDebug adds debugging headers, such as X-Proxy-Retry-Count, to
+// responses and lets clients pin a request to a backend by sending its host
+// in X-Proxy-Target, pins to unhealthy backends are ignored. It should not be
+// enabled in production since it exposes details about the backends.
+func WithDebug(enabled bool) Option {
+	return func(c *config) {
+		c.debug = enabled
+	}
+}
+
+// WithPreserveHeaderCase copies response headers to the client with the
+// exact casing the backend used instead of the canonical form. Backend
+// connections are limited to HTTP/1.1 while enabled, and responses served
+// from the cache or shared between coalesced requests use canonical names.
+func WithPreserveHeaderCase(enabled bool) Option {
+	return func(c *config) {
+		c.preserveHeaderCase = enabled
+	}
+}
+
+// WithDNSRefresher makes the proxy dial backend host names by the addresses
+// d resolves. Run d to keep the addresses current.
+func WithDNSRefresher(d *DNSRefresher) Option {
+	return func(c *config) {
+		c.dnsRefresher = d
+	}
+}
+
+// WithRoutes sends requests matching a route to the backends of that route,
+// the first matching route wins. New fails when a route is invalid or
+// duplicates an earlier one, see ValidateRoutes, and logs the routes that
+// overlap, see RouteOverlaps.
+func WithRoutes(routes ...Route) Option {
+	return func(c *config) {
+		c.routes = append(c.routes, routes...)
+	}
+}
+
+// WithAllowedMethods limits the methods forwarded by the proxy, other
+// methods are answered with 405 and an Allow header listing methods. All
+// methods are allowed when none are given.
+func WithAllowedMethods(methods ...string) Option {
+	return func(c *config) {
+		c.allowedMethods = append(c.allowedMethods, methods...)
+	}
+}
+
+// WithPathNormalization cleans request paths before they are routed and
+// forwarded: repeated slashes are collapsed, . and .. segments resolved and
+// percent-encoded unreserved characters decoded. With strict set, paths
+// holding dot segments or encoded slashes, backslashes or NUL bytes are
+// rejected with 400 instead, so they can not slip past auth rules of the
+// backends.
+func WithPathNormalization(strict bool) Option {
+	return func(c *config) {
+		c.normalizePaths = true
+		c.strictPaths = strict
+	}
+}
+
+// WithCookieRewrite rewrites the Set-Cookie headers of backend responses as
+// described by rw.
+func WithCookieRewrite(rw CookieRewrite) Option {
+	return func(c *config) {
+		c.cookieRewrite = &rw
+	}
+}
+
+// WithUploadLimit caps how fast each request body is forwarded to the
+// backend, in bytes per second. Routes can set their own UploadLimit.
+func WithUploadLimit(bytesPerSec int64) Option {
+	return func(c *config) {
+		c.uploadLimit = bytesPerSec
+	}
+}
+
+// WithDownloadLimit caps how fast response bodies are sent to each client,
+// in bytes per second. Parallel downloads of a client share its limit,
+// clients are told apart by their IP as told by the trusted proxies.
+func WithDownloadLimit(bytesPerSec int64) Option {
+	return func(c *config) {
+		c.downloadLimit = bytesPerSec
+	}
+}
+
+// WithPreserveHostHeader forwards the Host header the client sent instead
+// of the backend host, for backends doing virtual hosting. The backend is
+// still dialed by its own address.
+func WithPreserveHostHeader(enabled bool) Option {
+	return func(c *config) {
+		c.preserveHost = enabled
+	}
+}
+
+// WithLogger sets the logger backend errors are reported to, slog.Default
+// when not set.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// WithForwardProxy makes the proxy also act as a forward proxy: CONNECT
+// requests are tunneled and requests with an absolute URI are sent to the
+// destination they name, as long as its host is in allowedHosts. Entries
+// starting with a dot allow every subdomain. Other requests keep going to
+// the backends.
+func WithForwardProxy(allowedHosts ...string) Option {
+	return func(c *config) {
+		c.forward = true
+		c.forwardHosts = append(c.forwardHosts, allowedHosts...)
+	}
+}
+
+// WithForwardConnectPorts lists the ports CONNECT tunnels of the forward
+// proxy may be opened to, 443 unless given.
+func WithForwardConnectPorts(ports ...int) Option {
+	return func(c *config) {
+		for _, port := range ports {
+			c.forwardConnectPorts = append(c.forwardConnectPorts, strconv.Itoa(port))
+		}
+	}
+}
+
+// WithCompression gzips text responses for clients accepting it. Responses
+// the backend already encoded are passed through untouched, and Vary lists
+// Accept-Encoding on every response the proxy could have compressed.
+func WithCompression(enabled bool) Option {
+	return func(c *config) {
+		c.compress = enabled
+	}
+}
+
+// WithRequestCompression gzips the text request bodies of at least minSize
+// bytes sent to backends accepting it, 1KB when minSize is zero. Backends
+// tell they do with Accept-Encoding in their responses, as in RFC 7694.
+func WithRequestCompression(minSize int64) Option {
+	return func(c *config) {
+		if minSize <= 0 {
+			minSize = minCompressSize
+		}
+		c.requestCompressSize = minSize
+	}
+}
+
+// WithStickySessions keeps every client on the backend it was first sent to,
+// remembered in the cookie named name. Clients are first assigned by the
+// balancer, so backend weights still shape the spread, and are assigned
+// again when their backend is removed or fails its health check.
+func WithStickySessions(name string) Option {
+	return func(c *config) {
+		c.stickyCookie = name
+	}
+}
+
+// WithClientCertForwarding sends backends the verified client certificate
+// next to the CN and SANs they always get: URL encoded PEM in
+// X-Client-Cert, its subject in X-Client-Cert-Subject and its SHA-256
+// fingerprint in X-Client-Cert-Fingerprint.
+func WithClientCertForwarding(enabled bool) Option {
+	return func(c *config) {
+		c.forwardClientCert = enabled
+	}
+}
+
+// WithConcurrencyLimit caps the requests forwarded at once, the others wait
+// for their turn by priority. Requests turned away or shed from the queue
+// are answered with 503.
+func WithConcurrencyLimit(limit ConcurrencyLimit) Option {
+	return func(c *config) {
+		limit.Priorities = slices.Clone(limit.Priorities)
+		c.concurrencyLimit = &limit
+	}
+}
+
+// WithTrustedProxies lists the proxies and load balancers in front of the
+// proxy. Requests arriving from them are attributed to the client named in
+// X-Forwarded-For, and the chain they report is kept when forwarding.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(c *config) {
+		c.trustedProxies = append(c.trustedProxies, prefixes...)
+	}
+}
+
+// WithIPAllowlist only serves clients whose IP lies in one of prefixes,
+// others get 403.
+func WithIPAllowlist(prefixes ...netip.Prefix) Option {
+	return func(c *config) {
+		c.allowIPs = append(c.allowIPs, prefixes...)
+	}
+}
+
+// WithIPDenylist answers clients whose IP lies in one of prefixes with 403,
+// even when the allowlist has them.
+func WithIPDenylist(prefixes ...netip.Prefix) Option {
+	return func(c *config) {
+		c.denyIPs = append(c.denyIPs, prefixes...)
+	}
+}
+
+// WithGeoHook consults hook for every client IP. Clients it does not allow
+// get 403, the others are forwarded with the country it returned in the
+// X-Geo-Country header.
+func WithGeoHook(hook GeoHook) Option {
+	return func(c *config) {
+		c.geoHook = hook
+	}
+}
+
+// WithCopyBufferSize sets the size of the buffers response bodies are copied
+// through, 32KB when not set. Buffers are pooled and reused across requests.
+func WithCopyBufferSize(size int) Option {
+	return func(c *config) {
+		c.copyBufferSize = size
+	}
+}
+
+// WithResponseHeaderLimits caps the response headers accepted from a
+// backend, in total bytes and in number of header lines. Responses over
+// either limit are answered with 502 instead of being forwarded. Zero keeps
+// the transport default of 10MB and no line limit.
+func WithResponseHeaderLimits(maxBytes int64, maxHeaders int) Option {
+	return func(c *config) {
+		c.maxResponseHeaderBytes = maxBytes
+		c.maxResponseHeaders = maxHeaders
+	}
+}
+
+// WithAccessLog logs a line for every request served, to the logger set by
+// WithLogger. When backendRequestID names a response header, the request ID
+// the backend echoed in it is part of the line.
+func WithAccessLog(backendRequestID string) Option {
+	return func(c *config) {
+		c.accessLog = true
+		c.backendRequestID = backendRequestID
+	}
+}
+
+// WithDefaultUpstreamScheme sets the scheme, http or https, backends given
+// as a bare host:port are dialed with. Without it such backends are
+// rejected by New.
+func WithDefaultUpstreamScheme(scheme string) Option {
+	return func(c *config) {
+		c.defaultScheme = scheme
+	}
+}
+
+// WithClock sets the clock rate limits, remembered idempotency keys and the
+// freshness of cached responses are measured with, the wall clock when not
+// set.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithAltSvc advertises an HTTP/3 endpoint on port through the Alt-Svc
+// header of proxied responses, replacing any the backend sent. Clients
+// cache it for maxAge. The proxy does not speak HTTP/3: use it only when a
+// separate HTTP/3 frontend listens on port for the same hosts, otherwise
+// clients try a QUIC endpoint that does not exist.
+func WithAltSvc(port int, maxAge time.Duration) Option {
+	return func(c *config) {
+		c.altSvcPort = port
+		c.altSvcMaxAge = maxAge
+	}
+}
+
+// WithSOCKS5 dials backends through the SOCKS5 server at addr. The username
+// and password are sent when the username is not empty.
+func WithSOCKS5(addr, username, password string) Option {
+	return func(c *config) {
+		c.socks5Addr = addr
+		c.socks5Username = username
+		c.socks5Password = password
+	}
+}
+
+// WithPeakEWMA balances requests by response time instead of round-robin,
+// backends are picked less often the slower they answered recently and the
+// more requests they already handle. Old response times lose most of their
+// weight after decay, ten seconds when zero.
+func WithPeakEWMA(decay time.Duration) Option {
+	return func(c *config) {
+		c.peakEWMA = true
+		c.ewmaDecay = decay
+	}
+}
+
+// WithMaintenancePage sets the body answered with 503 while the proxy is in
+// maintenance mode, its content type is detected from it. Without it a short
+// error message is answered.
+func WithMaintenancePage(page []byte) Option {
+	return func(c *config) {
+		c.maintenancePage = page
+	}
+}
+
+// WithStatusRewrite answers backend responses carrying a status listed in
+// rewrites with the status it maps to, such as 308 to 301 for clients not
+// knowing the former. Headers and body are passed through unchanged.
+func WithStatusRewrite(rewrites map[int]int) Option {
+	return func(c *config) {
+		c.statusRewrites = rewrites
+	}
+}
+
+// WithModifyResponse sets a hook called with every backend response before
+// it is copied to the client, it may change the status, headers and body.
+// When it returns an error the client gets a 502 instead.
+func WithModifyResponse(modify func(*http.Response) error) Option {
+	return func(c *config) {
+		c.modifyResponse = modify
+	}
+}
+
+// WithDirector sets a hook called with every outbound request before it is
+// sent, upgrades included, once per attempt when retrying. By then the
+// request is addressed to its backend and carries the headers the proxy
+// adds, such as X-Forwarded-For, so the hook may change or drop any of them.
+// The Headers of the backend and the gzip Content-Encoding of compressed
+// request bodies are applied after the hook, it can not drop or override
+// them. Changes to the backend host are not seen by balancing or health
+// checks.
+func WithDirector(director func(*http.Request)) Option {
+	return func(c *config) {
+		c.director = director
+	}
+}
+
+// WithIdempotency remembers the response to POST and PATCH requests carrying
+// an Idempotency-Key header for ttl, a request repeating the key is answered
+// with it again without reaching the backend. At most maxKeys responses are
+// kept, the oldest are forgotten first, and maxKeys must be positive.
+func WithIdempotency(ttl time.Duration, maxKeys int) Option {
+	return func(c *config) {
+		c.idempotencyTTL = ttl
+		c.idempotencyMaxKeys = maxKeys
+	}
+}
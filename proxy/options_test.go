@@ -0,0 +1,583 @@
+package proxy_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestServerNameOverride(t *testing.T) {
+	serverName := "backend.internal"
+	cert, pool := newCertificate(t, serverName)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Hello World!")
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	tests := map[string]struct {
+		opts           []proxy.Option
+		expectedStatus int
+	}{
+		"without server name": {
+			opts:           []proxy.Option{proxy.WithRootCAs(pool)},
+			expectedStatus: http.StatusBadGateway,
+		},
+		"with server name": {
+			opts:           []proxy.Option{proxy.WithRootCAs(pool), proxy.WithServerName(serverName)},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			//server.URL dials 127.0.0.1 which is not in the certificate.
+			p, err := proxy.New(server.URL, false, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestBackendServerNames(t *testing.T) {
+	pool := x509.NewCertPool()
+	var backends []*proxy.Backend
+	for _, name := range []string{"a.internal", "b.internal"} {
+		cert, _ := newCertificate(t, name)
+		pool.AddCert(cert.Leaf)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatalf("failed to parse url: %s", err)
+		}
+		backends = append(backends, &proxy.Backend{URL: u, ServerName: name})
+	}
+
+	p, err := proxy.New(backends[0].URL.String(), false, proxy.WithRootCAs(pool))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+	defer p.Close()
+
+	if err := p.SetBackends(backends); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	//both backends are dialed by ip, each one verified against its own name.
+	seen := make(map[string]bool)
+	for range 4 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+		}
+		seen[recorder.Body.String()] = true
+	}
+
+	if !seen["a.internal"] || !seen["b.internal"] {
+		t.Errorf("expected both backends to answer, got %v", seen)
+	}
+}
+
+// newCertificate generates a self-signed certificate valid only for dnsName
+// and returns it with a pool that trusts it.
+func newCertificate(t *testing.T, dnsName string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate private key: %s", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: dnsName,
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{dnsName},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  private,
+		Leaf:        leaf,
+	}
+	return cert, pool
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	var dials atomic.Int32
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	//count every new connection made by the proxy.
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	tests := map[string]struct {
+		disable       bool
+		expectedDials int32
+	}{
+		"keep-alives enabled": {
+			disable:       false,
+			expectedDials: 1,
+		},
+		"keep-alives disabled": {
+			disable:       true,
+			expectedDials: 3,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dials.Store(0)
+
+			p, err := proxy.New(server.URL, true, proxy.WithDisableKeepAlives(tt.disable))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			for range 3 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				recorder := httptest.NewRecorder()
+				p.ServeHTTP(recorder, req)
+
+				if recorder.Code != http.StatusOK {
+					t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+				}
+			}
+
+			if got := dials.Load(); got != tt.expectedDials {
+				t.Errorf("dials=%d, got %d", tt.expectedDials, got)
+			}
+		})
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithAllowedMethods(http.MethodGet, http.MethodHead))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		method         string
+		expectedStatus int
+	}{
+		"get":  {method: http.MethodGet, expectedStatus: http.StatusOK},
+		"head": {method: http.MethodHead, expectedStatus: http.StatusOK},
+		"post": {method: http.MethodPost, expectedStatus: http.StatusMethodNotAllowed},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			if tt.expectedStatus == http.StatusMethodNotAllowed {
+				if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD" {
+					t.Errorf("allow=%q, got %q", "GET, HEAD", allow)
+				}
+			}
+		})
+	}
+
+	if hits.Load() != 2 {
+		t.Errorf("backend hits=2, got %d", hits.Load())
+	}
+}
+
+func TestServerWideOptions(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		opts          []proxy.Option
+		expectedAllow string
+	}{
+		"default": {expectedAllow: "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+		"allowed methods": {
+			opts:          []proxy.Option{proxy.WithAllowedMethods(http.MethodGet, http.MethodHead)},
+			expectedAllow: "GET, HEAD",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, false, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodOptions, "*", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusNoContent {
+				t.Errorf("status=%d, got %d", http.StatusNoContent, recorder.Code)
+			}
+
+			if allow := recorder.Header().Get("Allow"); allow != tt.expectedAllow {
+				t.Errorf("allow=%q, got %q", tt.expectedAllow, allow)
+			}
+		})
+	}
+
+	if hits.Load() != 0 {
+		t.Errorf("backend hits=0, got %d", hits.Load())
+	}
+}
+
+func TestPreserveHostHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		preserve bool
+		expected string
+	}{
+		"rewritten": {
+			preserve: false,
+			expected: server.Listener.Addr().String(),
+		},
+		"preserved": {
+			preserve: true,
+			expected: "www.example.com",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, true, proxy.WithPreserveHostHeader(tt.preserve))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Body.String() != tt.expected {
+				t.Errorf("host=%s, got %s", tt.expected, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing.Close()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	p, err := proxy.New(failing.URL, true, proxy.WithLogger(logger))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("status=%d, got %d", http.StatusBadGateway, recorder.Code)
+	}
+
+	if !strings.Contains(logs.String(), "connection refused") {
+		t.Errorf("expected the backend error to be logged, got %q", logs.String())
+	}
+
+	if strings.Contains(recorder.Body.String(), "connection refused") {
+		t.Errorf("expected the backend error to stay out of the response, got %q", recorder.Body.String())
+	}
+}
+
+func TestDefaultUpstreamScheme(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "over tls")
+	}))
+	defer backend.Close()
+
+	hostPort := strings.TrimPrefix(backend.URL, "https://")
+
+	p, err := proxy.New(hostPort, true, proxy.WithDefaultUpstreamScheme("https"))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	if got := p.Host.Scheme; got != "https" {
+		t.Errorf("scheme=https, got %q", got)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "over tls" {
+		t.Errorf("expected the backend to be dialed over tls, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	//without a default scheme the bare address is rejected.
+	if _, err := proxy.New(hostPort, true); err == nil {
+		t.Error("expected a backend without scheme to be rejected")
+	}
+
+	if _, err := proxy.New(hostPort, true, proxy.WithDefaultUpstreamScheme("ftp")); err == nil {
+		t.Error("expected an unsupported default scheme to be rejected")
+	}
+}
+
+func TestStatusRewrite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			w.Header().Set("Location", "/elsewhere")
+			w.WriteHeader(http.StatusPermanentRedirect)
+			fmt.Fprint(w, "moved")
+		case "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, "short and stout")
+		}
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithStatusRewrite(map[int]int{
+		http.StatusPermanentRedirect: http.StatusMovedPermanently,
+	}))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		path             string
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		"rewritten": {
+			path:             "/moved",
+			expectedStatus:   http.StatusMovedPermanently,
+			expectedLocation: "/elsewhere",
+			expectedBody:     "moved",
+		},
+		"not listed": {
+			path:           "/teapot",
+			expectedStatus: http.StatusTeapot,
+			expectedBody:   "short and stout",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			if location := recorder.Header().Get("Location"); location != tt.expectedLocation {
+				t.Errorf("location=%q, got %q", tt.expectedLocation, location)
+			}
+
+			if body := recorder.Body.String(); body != tt.expectedBody {
+				t.Errorf("body=%q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+
+	if _, err := proxy.New(server.URL, false, proxy.WithStatusRewrite(map[int]int{418: 42})); err == nil {
+		t.Errorf("expected an error for an invalid status")
+	}
+}
+
+func TestModifyResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		modify         func(resp *http.Response) error
+		expectedStatus int
+		expectedHeader string
+		expectedBody   string
+	}{
+		"add header": {
+			modify: func(resp *http.Response) error {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					return err
+				}
+				resp.Header.Set("X-Body-Length", strconv.Itoa(len(body)))
+				resp.Body = io.NopCloser(bytes.NewReader(body))
+				return nil
+			},
+			expectedStatus: http.StatusOK,
+			expectedHeader: "12",
+			expectedBody:   "Hello World!",
+		},
+		"error": {
+			modify: func(resp *http.Response) error {
+				resp.Header.Set("X-Body-Length", "0")
+				return errors.New("unexpected response shape")
+			},
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Bad Gateway\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, false, proxy.WithModifyResponse(tt.modify))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			if header := recorder.Header().Get("X-Body-Length"); header != tt.expectedHeader {
+				t.Errorf("X-Body-Length=%q, got %q", tt.expectedHeader, header)
+			}
+
+			if body := recorder.Body.String(); body != tt.expectedBody {
+				t.Errorf("body=%q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestDirector(t *testing.T) {
+	type seen struct {
+		path, query, forwardedFor, tenant string
+	}
+	requests := make(chan seen, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{
+			path:         r.URL.Path,
+			query:        r.URL.RawQuery,
+			forwardedFor: r.Header.Get("X-Forwarded-For"),
+			tenant:       r.Header.Get("X-Tenant"),
+		}
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithDirector(func(r *http.Request) {
+		r.URL.Path = "/v2" + r.URL.Path
+		r.URL.RawQuery = ""
+		//the proxy set it already, the director can override it.
+		r.Header.Set("X-Forwarded-For", "203.0.113.7")
+		r.Header.Set("X-Tenant", "acme")
+	}))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/users?debug=1", nil)
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	got := <-requests
+	expected := seen{path: "/v2/users", forwardedFor: "203.0.113.7", tenant: "acme"}
+	if got != expected {
+		t.Errorf("backend saw %+v, expected %+v", got, expected)
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Passthrough forwards TLS connections to backends chosen by the SNI server
+// name of the ClientHello, without terminating TLS. The backend completes
+// the handshake with the client, so the proxy never sees decrypted traffic.
+type Passthrough struct {
+	//Backends maps server names to the host:port their connections are sent to.
+	Backends map[string]string
+	Default  string //backend for unknown or missing server names, refused when empty.
+
+	DialTimeout  time.Duration //one second when zero.
+	HelloTimeout time.Duration //time to read the ClientHello in, five seconds when zero.
+	Logger       *slog.Logger  //slog.Default when nil.
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	active    sync.WaitGroup
+}
+
+// Serve accepts connections on l and forwards each one until l is closed.
+// After Shutdown it returns nil.
+func (p *Passthrough) Serve(l net.Listener) error {
+	if !p.track(l) {
+		l.Close()
+		return nil
+	}
+	defer p.untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
+			return err
+		}
+
+		if !p.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for the forwarded ones to
+// finish. When ctx is done first the remaining connections are closed and
+// its error is returned.
+func (p *Passthrough) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (p *Passthrough) track(l net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	if p.listeners == nil {
+		p.listeners = make(map[net.Listener]struct{})
+	}
+	p.listeners[l] = struct{}{}
+	return true
+}
+
+func (p *Passthrough) untrack(l net.Listener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.listeners, l)
+}
+
+func (p *Passthrough) trackConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	p.active.Add(1)
+	return true
+}
+
+func (p *Passthrough) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *Passthrough) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		p.active.Done()
+	}()
+
+	helloTimeout := p.HelloTimeout
+	if helloTimeout <= 0 {
+		helloTimeout = 5 * time.Second
+	}
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	serverName, hello, err := peekServerName(conn)
+	if err != nil {
+		loggerOrDefault(p.Logger).Error("passthrough: read client hello", "client", conn.RemoteAddr(), "err", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	addr, ok := p.backend(serverName)
+	if !ok {
+		loggerOrDefault(p.Logger).Error("passthrough: no backend for server name", "server_name", serverName)
+		return
+	}
+
+	dialTimeout := p.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = time.Second
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	backend, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		loggerOrDefault(p.Logger).Error("passthrough: dial backend", "backend", addr, "err", err)
+		return
+	}
+	defer backend.Close()
+
+	errs := make(chan error, 2)
+	go func() {
+		//replay the peeked ClientHello before the rest of the client stream.
+		_, err := io.Copy(backend, io.MultiReader(bytes.NewReader(hello), conn))
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backend)
+		errs <- err
+	}()
+
+	//once either side is done the deferred closes stop the other copy.
+	<-errs
+}
+
+// backend returns the address for serverName.
+func (p *Passthrough) backend(serverName string) (string, bool) {
+	for name, addr := range p.Backends {
+		if strings.EqualFold(name, serverName) {
+			return addr, true
+		}
+	}
+	return p.Default, p.Default != ""
+}
+
+// errHelloRead stops the handshake once the ClientHello has been parsed.
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the ClientHello from conn and returns its server
+// name along with the bytes read, which must be replayed to the backend.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var serverName string
+
+	cfg := tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}
+
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &cfg).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
@@ -0,0 +1,156 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestPassthroughSNI(t *testing.T) {
+	names := []string{"a.test", "b.test"}
+
+	backends := make(map[string]string)
+	clientConfigs := make(map[string]*tls.Config)
+	for _, name := range names {
+		cert, pool := newCertificate(t, name)
+
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		backend.StartTLS()
+		defer backend.Close()
+
+		backends[name] = backend.Listener.Addr().String()
+		clientConfigs[name] = &tls.Config{RootCAs: pool, ServerName: name}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	passthrough := proxy.Passthrough{Backends: backends}
+	go passthrough.Serve(l)
+
+	for _, name := range names {
+		client := http.Client{
+			Transport: &http.Transport{TLSClientConfig: clientConfigs[name]},
+		}
+
+		resp, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to send request for %s: %s", name, err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read body: %s", err)
+		}
+
+		if string(body) != name {
+			t.Errorf("body=%s, got %s", name, body)
+		}
+
+		//the certificate is the backend's own, the proxy did not terminate tls.
+		if peer := resp.TLS.PeerCertificates[0].Subject.CommonName; peer != name {
+			t.Errorf("certificate=%s, got %s", name, peer)
+		}
+	}
+}
+
+func TestPassthroughUnknownName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	passthrough := proxy.Passthrough{Backends: map[string]string{"a.test": "127.0.0.1:1"}}
+	go passthrough.Serve(l)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "c.test"})
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected handshake for an unknown server name to fail")
+	}
+}
+
+func TestPassthroughClientCertificate(t *testing.T) {
+	serverCert, serverPool := newCertificate(t, "backend.test")
+	clientCert, clientPool := newCertificate(t, "client.test")
+
+	//only a backend terminating tls itself can verify the client certificate.
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	passthrough := proxy.Passthrough{Default: backend.Listener.Addr().String()}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- passthrough.Serve(l) }()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      serverPool,
+				ServerName:   "backend.test",
+				Certificates: []tls.Certificate{clientCert},
+			},
+		},
+	}
+
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+
+	if string(body) != "client.test" {
+		t.Errorf("client certificate=client.test, got %s", body)
+	}
+
+	//the idle keep-alive connection is still forwarded and keeps shutdown waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := passthrough.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown error=%s, got %v", context.DeadlineExceeded, err)
+	}
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Errorf("expected serve to return nil after shutdown, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyProtocolV2 is the signature starting a binary PROXY protocol header.
+var proxyProtocolV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// probeListener keeps load balancer probes away from the server. Connections
+// that close before sending anything and PROXY protocol headers sent alone
+// are closed quietly instead of showing up as handshake errors in the server
+// log.
+type probeListener struct {
+	net.Listener
+	healthCheck string
+	timeout     time.Duration
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewProbeListener wraps l so probe connections never reach the server.
+// When healthCheck is set, a connection sending it as its first line is
+// answered with OK and closed, so plain TCP health checks can tell the
+// proxy is up.
+func NewProbeListener(l net.Listener, healthCheck string) net.Listener {
+	pl := probeListener{
+		Listener:    l,
+		healthCheck: healthCheck,
+		timeout:     10 * time.Second,
+		conns:       make(chan net.Conn),
+		errs:        make(chan error),
+		done:        make(chan struct{}),
+	}
+
+	go pl.acceptLoop()
+	return &pl
+}
+
+func (l *probeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.sniff(conn)
+	}
+}
+
+// sniff looks at the first bytes of conn and hands it to Accept unless it
+// is a probe.
+func (l *probeListener) sniff(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+
+	reader := bufio.NewReader(conn)
+	if _, err := reader.Peek(1); err != nil {
+		//connected and closed, or never said anything.
+		conn.Close()
+		return
+	}
+
+	data, _ := reader.Peek(reader.Buffered())
+
+	if l.healthCheck != "" && string(bytes.TrimRight(data, "\r\n")) == l.healthCheck {
+		conn.Write([]byte("OK\n"))
+		conn.Close()
+		return
+	}
+
+	if n, ok := proxyHeaderLen(reader, data); ok {
+		//a probe hangs up after the header, real traffic follows it.
+		if _, err := reader.Peek(n + 1); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	select {
+	case l.conns <- &peekedConn{Conn: conn, reader: reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// proxyHeaderLen returns the length of the PROXY protocol header data starts
+// with, reading the rest of it from reader, and whether it is a complete
+// one.
+func proxyHeaderLen(reader *bufio.Reader, data []byte) (int, bool) {
+	if bytes.HasPrefix(data, []byte("PROXY ")) {
+		//a version 1 header is a line of at most 107 bytes.
+		for n := len("PROXY \r\n"); n <= 107; n++ {
+			line, err := reader.Peek(n)
+			if err != nil {
+				return 0, false
+			}
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+
+	if bytes.HasPrefix(data, proxyProtocolV2) {
+		//the signature, version, family and the length of the addresses.
+		header, err := reader.Peek(16)
+		if err != nil {
+			return 0, false
+		}
+		return 16 + int(binary.BigEndian.Uint16(header[14:16])), true
+	}
+	return 0, false
+}
+
+// Accept returns the next connection that is not a probe.
+func (l *probeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *probeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekedConn replays the bytes read while sniffing before reading on.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
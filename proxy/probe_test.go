@@ -0,0 +1,149 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// syncBuffer is a bytes.Buffer safe to use as a log output.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProbeListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	var logs syncBuffer
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	server.Listener = proxy.NewProbeListener(inner, "PING")
+	server.Config.ErrorLog = log.New(&logs, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	addr := inner.Addr().String()
+
+	//a bare tcp probe connects and closes right away.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	conn.Close()
+
+	//a load balancer sending a PROXY protocol header.
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	fmt.Fprint(conn, "PROXY TCP4 10.0.0.1 10.0.0.2 56324 443\r\n")
+	//probes hang up once the header is sent.
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("expected the probe to be closed cleanly, got %s", err)
+	}
+	conn.Close()
+
+	//a tcp health check gets an answer.
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	fmt.Fprint(conn, "PING\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil {
+		t.Fatalf("failed to read health check reply: %s", err)
+	}
+
+	if reply != "OK\n" {
+		t.Errorf("reply=%q, got %q", "OK\n", reply)
+	}
+
+	//regular clients are still served.
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if logs.String() != "" {
+		t.Errorf("expected no server errors, got %q", logs.String())
+	}
+}
+
+func TestProbeListenerProxyProtocolTraffic(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	listener := proxy.NewProbeListener(inner, "")
+	defer listener.Close()
+
+	//the request follows the header in a later write.
+	const header = "PROXY TCP4 10.0.0.1 10.0.0.2 56324 443\r\n"
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, header)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(conn, request)
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, len(header)+len(request))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read the connection: %s", err)
+	}
+
+	if string(buf) != header+request {
+		t.Errorf("data=%q, got %q", header+request, buf)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// Protocol is the HTTP version requests are sent to a backend with.
+type Protocol string
+
+const (
+	//ProtocolDefault follows the clients, backends negotiating HTTP/2 are
+	//spoken to with it once the proxy served an HTTP/2 request.
+	ProtocolDefault Protocol = ""
+
+	//ProtocolHTTP1 always speaks HTTP/1.1.
+	ProtocolHTTP1 Protocol = "h1"
+
+	//ProtocolHTTP2 always speaks HTTP/2, over TLS to https backends and as
+	//cleartext h2c to http ones. Backends not speaking it fail the request.
+	ProtocolHTTP2 Protocol = "h2"
+
+	//ProtocolAuto offers both versions to https backends and uses the one
+	//they pick by ALPN, http backends are spoken to with HTTP/1.1.
+	ProtocolAuto Protocol = "auto"
+)
+
+// protocolTransports send requests to the backends configured with a
+// protocol of their own, whatever the protocol of the client.
+type protocolTransports struct {
+	h1   *http.Transport
+	auto *http.Transport
+	h2   *http2.Transport
+	h2c  *http2.Transport
+}
+
+// newProtocolTransports clones base into a transport for every protocol, base
+// is left untouched. HTTP/2 over TLS dials with the backend server names.
+func newProtocolTransports(base *http.Transport, names *serverNames) (*protocolTransports, error) {
+	h1 := base.Clone()
+	//a non nil map keeps the transport from upgrading to http2 on its own.
+	h1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	auto := base.Clone()
+	if err := http2.ConfigureTransport(auto); err != nil {
+		return nil, fmt.Errorf("configure http2 transport: %w", err)
+	}
+
+	dial := base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	h2, err := newHTTP2Transport(base)
+	if err != nil {
+		return nil, err
+	}
+	h2.TLSClientConfig = base.TLSClientConfig.Clone()
+	h2.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return dialTLS(ctx, dial, network, addr, names.config(cfg, addr), base.TLSHandshakeTimeout)
+	}
+
+	h2c, err := newHTTP2Transport(base)
+	if err != nil {
+		return nil, err
+	}
+	h2c.AllowHTTP = true
+	h2c.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+
+	return &protocolTransports{h1: h1, auto: auto, h2: h2, h2c: h2c}, nil
+}
+
+// newHTTP2Transport returns an HTTP/2 transport dialing on its own with the
+// response header and idle timeouts, keep alives and limits of base.
+func newHTTP2Transport(base *http.Transport) (*http2.Transport, error) {
+	//a clone of base lends its settings, requests never go through it.
+	t, err := http2.ConfigureTransports(base.Clone())
+	if err != nil {
+		return nil, fmt.Errorf("configure http2 transport: %w", err)
+	}
+	//the pool of a configured transport only takes connections dialed by
+	//the HTTP/1 one, the default pool dials.
+	t.ConnPool = nil
+	t.DisableCompression = base.DisableCompression
+	if base.MaxResponseHeaderBytes > 0 {
+		t.MaxHeaderListSize = uint32(min(base.MaxResponseHeaderBytes, math.MaxUint32))
+	}
+	return t, nil
+}
+
+// transport returns the transport requests to backend are sent with, nil
+// when backend follows the clients.
+func (t *protocolTransports) transport(backend *Backend) http.RoundTripper {
+	switch backend.Protocol {
+	case ProtocolHTTP1:
+		return t.h1
+	case ProtocolAuto:
+		if backend.URL.Scheme == "http" {
+			return t.h1
+		}
+		return t.auto
+	case ProtocolHTTP2:
+		if backend.URL.Scheme == "http" {
+			return t.h2c
+		}
+		return t.h2
+	}
+	return nil
+}
+
+// closeIdleConnections closes the idle connections of every transport.
+func (t *protocolTransports) closeIdleConnections() {
+	for _, rt := range []http.RoundTripper{t.h1, t.auto, t.h2, t.h2c} {
+		rt.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+	}
+}
+
+// validProtocol reports whether protocol is one of the known protocols.
+func validProtocol(protocol Protocol) bool {
+	switch protocol {
+	case ProtocolDefault, ProtocolHTTP1, ProtocolHTTP2, ProtocolAuto:
+		return true
+	}
+	return false
+}
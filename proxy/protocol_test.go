@@ -0,0 +1,198 @@
+package proxy_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestBackendProtocol(t *testing.T) {
+	//the backends only serve http2.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Proto", r.Proto)
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		}
+	})
+
+	h2Only := httptest.NewUnstartedServer(handler)
+	h2Only.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS}}
+	if err := http2.ConfigureServer(h2Only.Config, &http2.Server{}); err != nil {
+		t.Fatalf("failed to configure http2 server: %s", err)
+	}
+	h2Only.StartTLS()
+	defer h2Only.Close()
+
+	//cleartext http2 with prior knowledge.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	tests := map[string]struct {
+		backend        string
+		protocol       proxy.Protocol
+		expectedStatus int
+		expectedProto  string
+	}{
+		"h2 over tls": {
+			backend:        h2Only.URL,
+			protocol:       proxy.ProtocolHTTP2,
+			expectedStatus: http.StatusOK,
+			expectedProto:  "HTTP/2.0",
+		},
+		"negotiated by alpn": {
+			backend:        h2Only.URL,
+			protocol:       proxy.ProtocolAuto,
+			expectedStatus: http.StatusOK,
+			expectedProto:  "HTTP/2.0",
+		},
+		"following the client": {
+			backend:        h2Only.URL,
+			expectedStatus: http.StatusHTTPVersionNotSupported,
+			expectedProto:  "HTTP/1.1",
+		},
+		"h1": {
+			backend:        h2Only.URL,
+			protocol:       proxy.ProtocolHTTP1,
+			expectedStatus: http.StatusHTTPVersionNotSupported,
+			expectedProto:  "HTTP/1.1",
+		},
+		"h2c": {
+			backend:        "http://" + ln.Addr().String(),
+			protocol:       proxy.ProtocolHTTP2,
+			expectedStatus: http.StatusOK,
+			expectedProto:  "HTTP/2.0",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tt.backend)
+			if err != nil {
+				t.Fatalf("failed to parse backend url: %s", err)
+			}
+
+			p, err := proxy.New(tt.backend, true)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+			defer p.Close()
+
+			if err := p.SetBackends([]*proxy.Backend{{URL: u, Protocol: tt.protocol}}); err != nil {
+				t.Fatalf("failed to set backends: %s", err)
+			}
+
+			//requests sent by an http/1.1 client.
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, rec.Code)
+			}
+
+			if got := rec.Header().Get("X-Backend-Proto"); got != tt.expectedProto {
+				t.Errorf("backend proto=%q, got %q", tt.expectedProto, got)
+			}
+		})
+	}
+}
+
+func TestBackendProtocolTransportSettings(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		case "/large":
+			w.Header().Set("X-Large", strings.Repeat("a", 8<<10))
+		}
+	})
+
+	h2Only := httptest.NewUnstartedServer(handler)
+	h2Only.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS}}
+	if err := http2.ConfigureServer(h2Only.Config, &http2.Server{}); err != nil {
+		t.Fatalf("failed to configure http2 server: %s", err)
+	}
+	h2Only.StartTLS()
+	defer h2Only.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	tests := map[string]struct {
+		backend        string
+		path           string
+		expectedStatus int
+	}{
+		"h2 response header timeout":  {backend: h2Only.URL, path: "/slow", expectedStatus: http.StatusGatewayTimeout},
+		"h2c response header timeout": {backend: "http://" + ln.Addr().String(), path: "/slow", expectedStatus: http.StatusGatewayTimeout},
+		"h2 header limit":             {backend: h2Only.URL, path: "/large", expectedStatus: http.StatusBadGateway},
+		"h2c header limit":            {backend: "http://" + ln.Addr().String(), path: "/large", expectedStatus: http.StatusBadGateway},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tt.backend)
+			if err != nil {
+				t.Fatalf("failed to parse backend url: %s", err)
+			}
+
+			//forced http2 keeps the timeouts and limits of the proxy transport.
+			p, err := proxy.New(tt.backend, true,
+				proxy.WithResponseHeaderTimeout(100*time.Millisecond),
+				proxy.WithResponseHeaderLimits(4<<10, 0),
+			)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+			defer p.Close()
+
+			if err := p.SetBackends([]*proxy.Backend{{URL: u, Protocol: proxy.ProtocolHTTP2}}); err != nil {
+				t.Fatalf("failed to set backends: %s", err)
+			}
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, rec.Code)
+			}
+		})
+	}
+}
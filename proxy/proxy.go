@@ -1,13 +1,22 @@
 package proxy
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -15,111 +24,782 @@ import (
 
 // Proxy represents the proxy handler.
 type Proxy struct {
-	Host   *url.URL //right now one hardcoded host.
+	Host   *url.URL //the backend passed to New, first in the backend list, nil without backends.
 	Client *http.Client
+
+	pool           *pool
+	maxBackends    int
+	routes         []*route
+	retries        int
+	requestTimeout time.Duration
+	debug          bool
+	allowedMethods []string
+	normalizePaths bool
+	strictPaths    bool
+	cookieRewrite  *CookieRewrite
+	preserveHost   bool
+	uploadLimit    int64
+	downloads      *downloadLimiter
+
+	timeoutHeader    string
+	maxHeaderTimeout time.Duration
+
+	preserveHeaderCase bool
+	connLifetime       time.Duration
+
+	http2Once sync.Once
+	http2Err  error
+	protocols *protocolTransports
+
+	serverNames serverNames //of the default backends.
+
+	stopDNSChanges func() //unsubscribes from the dns refresher.
+
+	coalescer   *coalescer
+	idempotency *idempotencyStore
+	cache       Cache
+	cacheClock  Clock //tells the freshness of cached responses.
+
+	cacheStatuses []int
+	cacheMethods  []string
+
+	revalidating sync.Map //cache keys being refreshed in the background.
+
+	conns        connCounters
+	backendStats backendCounters
+
+	logger *slog.Logger
+
+	forward             bool
+	forwardHosts        []string
+	forwardConnectPorts []string
+	forwardTransport    *http.Transport
+
+	compress bool
+
+	stickyCookie string
+
+	forwardClientCert bool
+
+	concurrency *concurrencyLimiter
+
+	requestCompressSize int64
+	requestEncodings    sync.Map //whether backends accept gzipped requests, by backendKey.
+
+	trustedProxies []netip.Prefix
+	allowIPs       []netip.Prefix
+	denyIPs        []netip.Prefix
+	geoHook        GeoHook
+
+	buffers *bufferPool
+
+	maxResponseHeaders int
+
+	accessLog        bool
+	backendRequestID string
+
+	altSvc string
+
+	maintenance     atomic.Bool
+	draining        atomic.Bool
+	maintenancePage []byte
+
+	statusRewrites map[int]int
+	modifyResponse func(*http.Response) error
+	director       func(*http.Request)
+
+	//cancelled by Close, background work started by the proxy observes it.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	background sync.WaitGroup
 }
 
-func New(host string, skipVerify bool) (*Proxy, error) {
+// New creates a proxy forwarding requests to host and the backends added by
+// WithBackends. An empty host leaves only those, New fails when that leaves
+// no backend at all unless WithNoBackends allows it.
+func New(host string, skipVerify bool, opts ...Option) (*Proxy, error) {
 	var p Proxy
-	var err error
 
-	p.Host, err = url.Parse(host)
-	if err != nil {
-		return nil, fmt.Errorf("parse url: %w", err)
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var hosts []string
+	if host != "" {
+		hosts = append(hosts, host)
+	}
+	hosts = append(hosts, cfg.backends...)
+
+	if len(hosts) == 0 && !cfg.noBackends {
+		return nil, errors.New("invalid backends: no backends configured")
+	}
+	if cfg.defaultScheme != "" {
+		if cfg.defaultScheme != "http" && cfg.defaultScheme != "https" {
+			return nil, fmt.Errorf("default upstream scheme %q must be http or https", cfg.defaultScheme)
+		}
+
+		for i := range hosts {
+			hosts[i] = withDefaultScheme(hosts[i], cfg.defaultScheme)
+		}
+
+		routes := make([]Route, len(cfg.routes))
+		for i, rt := range cfg.routes {
+			rt.Backends = slices.Clone(rt.Backends)
+			for j := range rt.Backends {
+				rt.Backends[j] = withDefaultScheme(rt.Backends[j], cfg.defaultScheme)
+			}
+			routes[i] = rt
+		}
+		cfg.routes = routes
+	}
+
+	if errs := ValidateBackends(hosts, cfg.maxBackends); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid backends: %w", errors.Join(errs...))
+	}
+
+	var backends []*Backend
+	for _, backend := range hosts {
+		u, err := url.Parse(backend)
+		if err != nil {
+			return nil, fmt.Errorf("parse url: %w", err)
+		}
+		backends = append(backends, &Backend{URL: u})
+	}
+
+	if len(backends) > 0 {
+		p.Host = backends[0].URL
+	}
+	p.maxBackends = cfg.maxBackends
+	p.pool = newPool(backends)
+
+	for i, rt := range cfg.routes {
+		compiled, err := compileRoute(i, rt, clockOrDefault(cfg.clock))
+		if err != nil {
+			return nil, err
+		}
+		p.routes = append(p.routes, compiled)
+	}
+
+	if errs := ValidateRoutes(cfg.routes); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid routes: %w", errors.Join(errs...))
+	}
+
+	if cfg.peakEWMA {
+		for _, pl := range p.pools() {
+			pl.balancer = newPeakEWMA(cfg.ewmaDecay, clockOrDefault(cfg.clock))
+		}
+	}
+	p.retries = cfg.retries
+	p.requestTimeout = cfg.requestTimeout
+	if cfg.timeoutHeader != "" && cfg.maxHeaderTimeout <= 0 {
+		return nil, fmt.Errorf("timeout header %s needs a positive maximum", cfg.timeoutHeader)
+	}
+	p.timeoutHeader = cfg.timeoutHeader
+	p.maxHeaderTimeout = cfg.maxHeaderTimeout
+	p.debug = cfg.debug
+	p.normalizePaths = cfg.normalizePaths
+	p.strictPaths = cfg.strictPaths
+	p.cookieRewrite = cfg.cookieRewrite
+	p.preserveHost = cfg.preserveHost
+	p.logger = loggerOrDefault(cfg.logger)
+	for _, overlap := range RouteOverlaps(cfg.routes) {
+		p.logger.Warn("overlapping routes", "precedence", overlap)
+	}
+	p.forward = cfg.forward
+	p.forwardHosts = cfg.forwardHosts
+	p.forwardConnectPorts = cfg.forwardConnectPorts
+	if p.forwardConnectPorts == nil {
+		p.forwardConnectPorts = []string{"443"}
+	}
+	p.compress = cfg.compress
+	p.stickyCookie = cfg.stickyCookie
+	p.forwardClientCert = cfg.forwardClientCert
+	if cfg.concurrencyLimit != nil {
+		if cfg.concurrencyLimit.Max <= 0 {
+			return nil, fmt.Errorf("concurrency limit %d must be positive", cfg.concurrencyLimit.Max)
+		}
+		p.concurrency = newConcurrencyLimiter(*cfg.concurrencyLimit)
+	}
+	p.requestCompressSize = cfg.requestCompressSize
+	p.trustedProxies = cfg.trustedProxies
+	p.allowIPs = cfg.allowIPs
+	p.denyIPs = cfg.denyIPs
+	p.geoHook = cfg.geoHook
+	p.buffers = newBufferPool(cfg.copyBufferSize)
+	p.maxResponseHeaders = cfg.maxResponseHeaders
+	p.accessLog = cfg.accessLog
+	p.backendRequestID = cfg.backendRequestID
+	if cfg.altSvcPort != 0 {
+		if cfg.altSvcPort < 0 || cfg.altSvcPort > 65535 {
+			return nil, fmt.Errorf("alt-svc port %d is out of range", cfg.altSvcPort)
+		}
+		p.altSvc = altSvc(cfg.altSvcPort, cfg.altSvcMaxAge)
+	}
+	p.maintenancePage = cfg.maintenancePage
+	for from, to := range cfg.statusRewrites {
+		if from < 200 || from > 599 || to < 200 || to > 599 {
+			return nil, fmt.Errorf("status rewrite %d to %d: statuses must be between 200 and 599", from, to)
+		}
+	}
+	p.statusRewrites = cfg.statusRewrites
+	p.modifyResponse = cfg.modifyResponse
+	p.director = cfg.director
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.uploadLimit = cfg.uploadLimit
+	if cfg.downloadLimit > 0 {
+		p.downloads = newDownloadLimiter(cfg.downloadLimit)
+	}
+	for _, method := range cfg.allowedMethods {
+		p.allowedMethods = append(p.allowedMethods, strings.ToUpper(method))
+	}
+
+	expectContinueTimeout := cfg.expectContinueTimeout
+	if expectContinueTimeout <= 0 {
+		expectContinueTimeout = time.Second
+	}
+
+	responseHeaderTimeout := cfg.responseHeaderTimeout
+	if responseHeaderTimeout <= 0 {
+		responseHeaderTimeout = time.Second
 	}
 
 	//client
 	p.Client = &http.Client{
-		Timeout: time.Second * 5, // total request timeout.
+		//redirects are the client's to follow.
+		CheckRedirect: noRedirects,
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout: time.Second, //dial timeout
 			}).DialContext,
-			TLSHandshakeTimeout:   time.Second,
-			ResponseHeaderTimeout: time.Second,
+			TLSHandshakeTimeout:    time.Second,
+			ResponseHeaderTimeout:  responseHeaderTimeout,
+			DisableKeepAlives:      cfg.disableKeepAlives,
+			IdleConnTimeout:        cfg.idleConnTimeout,
+			MaxConnsPerHost:        cfg.maxConnsPerHost,
+			MaxResponseHeaderBytes: cfg.maxResponseHeaderBytes,
+			//the server sends 100 Continue to the client once the transport starts reading the body.
+			ExpectContinueTimeout: expectContinueTimeout,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: skipVerify,
+				ServerName:         cfg.serverName,
+				RootCAs:            cfg.rootCAs,
 			},
 		},
 	}
 
+	if cfg.socks5Addr != "" {
+		transport := p.Client.Transport.(*http.Transport)
+		dial, err := socks5Dial(cfg.socks5Addr, cfg.socks5Username, cfg.socks5Password, &net.Dialer{Timeout: time.Second})
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = dial
+	}
+
+	if cfg.dnsRefresher != nil {
+		transport := p.Client.Transport.(*http.Transport)
+		transport.DialContext = cfg.dnsRefresher.dialContext(transport.DialContext)
+	}
+
+	if cfg.connLifetime > 0 {
+		transport := p.Client.Transport.(*http.Transport)
+		transport.DialContext = limitConnLifetime(transport.DialContext, cfg.connLifetime)
+		p.connLifetime = cfg.connLifetime
+	}
+
+	if cfg.preserveHeaderCase {
+		p.preserveHeaderCase = true
+		preserveHeaderCasing(p.Client.Transport.(*http.Transport), &p.serverNames)
+	} else {
+		p.serverNames.dialTLS(p.Client.Transport.(*http.Transport))
+	}
+
+	if p.forward {
+		p.forwardTransport = newForwardTransport(responseHeaderTimeout)
+	}
+
+	protocols, err := newProtocolTransports(p.Client.Transport.(*http.Transport), &p.serverNames)
+	if err != nil {
+		return nil, err
+	}
+	//the clones offer the protocols of their own when dialing TLS.
+	if !cfg.preserveHeaderCase {
+		p.serverNames.dialTLS(protocols.h1)
+		p.serverNames.dialTLS(protocols.auto)
+	}
+	p.protocols = protocols
+
+	if cfg.coalesce {
+		p.coalescer = newCoalescer()
+	}
+	if cfg.idempotencyTTL > 0 {
+		//keys are picked by clients, only a bound keeps them from filling the memory.
+		if cfg.idempotencyMaxKeys <= 0 {
+			return nil, fmt.Errorf("idempotency max keys %d must be positive", cfg.idempotencyMaxKeys)
+		}
+		p.idempotency = newIdempotencyStore(cfg.idempotencyTTL, cfg.idempotencyMaxKeys, clockOrDefault(cfg.clock))
+	}
+	p.cache = cfg.cache
+	p.cacheClock = clockOrDefault(cfg.clock)
+	p.cacheStatuses = cfg.cacheStatuses
+	if p.cacheStatuses == nil {
+		p.cacheStatuses = defaultCacheStatuses
+	}
+	p.cacheMethods = cfg.cacheMethods
+	if p.cacheMethods == nil {
+		p.cacheMethods = defaultCacheMethods
+	}
+
+	//connections to the old addresses are dropped, the protocol transports
+	//included. Subscribing last leaves nothing to undo when New fails.
+	if cfg.dnsRefresher != nil {
+		p.stopDNSChanges = cfg.dnsRefresher.onChange(p.closeIdleConnections)
+	}
+
 	return &p, nil
 }
 
 // ServeHTTP implements the http handler interface.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.accessLog {
+		p.serveLogged(w, r)
+		return
+	}
+	p.serve(w, r)
+}
+
+// serve forwards r and copies the backend response to w.
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) {
+	p.closeWhenDraining(w, r)
+
+	if p.maintenance.Load() {
+		p.serveMaintenance(w, r)
+		return
+	}
+
+	if !p.clientAllowed(r) || (p.geoHook != nil && !p.applyGeo(r)) {
+		writeError(w, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	//OPTIONS * asks about the proxy itself, no backend resource is named.
+	if r.Method == http.MethodOptions && r.RequestURI == "*" {
+		p.serveServerOptions(w)
+		return
+	}
+
+	if len(p.allowedMethods) > 0 && !slices.Contains(p.allowedMethods, r.Method) {
+		w.Header().Set("Allow", strings.Join(p.allowedMethods, ", "))
+		writeError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+
+	if p.forward && isForward(r) {
+		p.serveForward(w, r)
+		return
+	}
+
+	if p.normalizePaths && !normalizeRequestPath(r, p.strictPaths) {
+		writeError(w, r, http.StatusBadRequest, "invalid request path")
+		return
+	}
+
+	//the request timeout covers backend selection, retries and the response,
+	//streamed responses are only bound until their headers arrive.
+	stopTimeout := func() bool { return true }
+	if timeout := p.requestTimeoutFor(r); timeout > 0 {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		timer := time.AfterFunc(timeout, func() { cancel(errRequestTimeout) })
+		defer timer.Stop()
+		stopTimeout = timer.Stop
+		r = r.WithContext(ctx)
+	}
+
+	//routing
+	pl := p.pool
+	uploadLimit := p.uploadLimit
+	if rt := p.match(r); rt != nil {
+		if rt.limiter != nil {
+			client, _ := p.clientIP(r)
+			if ok, retryAfter := rt.limiter.allow(r, client); !ok {
+				rejectRateLimited(w, r, retryAfter)
+				return
+			}
+		}
+		if rt.pool != nil {
+			pl = rt.pool
+		}
+		if rt.UploadLimit > 0 {
+			uploadLimit = rt.UploadLimit
+		}
+		r = r.WithContext(context.WithValue(r.Context(), routeKey{}, rt))
+	}
+	r = r.WithContext(context.WithValue(r.Context(), poolKey{}, pl))
+
+	if uploadLimit > 0 {
+		throttleRequestBody(r, uploadLimit)
+	}
+
 	//forwarding
-	r.Host = p.Host.Host
-	r.URL.Host = p.Host.Host
-	r.URL.Scheme = p.Host.Scheme
+	public := publicURL(r)
+	publicHost := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		publicHost = h
+	}
+
+	var stick bool
+	backend := preferredBackend(r, pl)
+	if backend == nil && p.stickyCookie != "" {
+		backend = p.stickyBackend(r, pl)
+		//new clients and those whose backend is gone are assigned by the balancer.
+		stick = backend == nil
+	}
+	if backend == nil {
+		backend = pl.next()
+	}
+
+	if target := r.Header.Get("X-Proxy-Target"); target != "" && p.debug {
+		//pin the request to one backend to reproduce issues on a specific instance.
+		pinned, ok := pl.find(target)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("X-Proxy-Target %s is not a configured backend", target))
+			return
+		}
+		//like the backend set by WithBackend, an unhealthy pin falls back to the balancer.
+		if pl.isHealthy(pinned) {
+			backend, stick = pinned, false
+		}
+	}
+	r.Header.Del("X-Proxy-Target")
+
+	if backend == nil {
+		if p.serveStale(w, r) {
+			return
+		}
+		writeError(w, r, http.StatusServiceUnavailable, "no backends available")
+		return
+	}
+
+	r = withClientURL(r)
+	addressTo(r, backend, p.preserveHost)
 	r.RequestURI = ""
 	//set X-FORWARDED-FOR
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	forwardedFor, err := p.forwardedFor(r)
 	if err != nil {
-		//internal
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, err)
+		p.fail(w, r, http.StatusInternalServerError, "parse remote address", err)
+		return
+	}
+	r.Header.Set("X-Forwarded-For", forwardedFor)
+	p.setClientCertHeaders(r)
+
+	if IsUpgrade(r) {
+		//an upgraded connection lives as long as its peers keep it open.
+		stopTimeout()
+		p.serveUpgrade(w, r)
 		return
 	}
-	r.Header.Set("X-Forwarded-For", ip)
 
 	if r.ProtoMajor == 2 {
-		//add http2 support
-		if err := http2.ConfigureTransport(p.Client.Transport.(*http.Transport)); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, err)
+		//add http2 support, the transport can only be configured once.
+		p.http2Once.Do(func() {
+			p.http2Err = http2.ConfigureTransport(p.Client.Transport.(*http.Transport))
+		})
+		if p.http2Err != nil {
+			p.fail(w, r, http.StatusInternalServerError, "configure http2 transport", p.http2Err)
+			return
+		}
+	}
+
+	var attempts *atomic.Int32
+	if p.debug && p.retries > 0 {
+		var ctx context.Context
+		ctx, attempts = withAttemptCounter(r.Context())
+		r = r.WithContext(ctx)
+	}
+
+	var casing *headerCasing
+	if p.preserveHeaderCase {
+		var ctx context.Context
+		ctx, casing = withHeaderCasing(r.Context())
+		r = r.WithContext(ctx)
+	}
+
+	if p.concurrency != nil {
+		release, err := p.concurrency.acquire(r)
+		if errors.Is(err, errShed) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "too many concurrent requests")
+			return
+		}
+		if err != nil {
+			//the client is gone, there is no one to answer.
 			return
 		}
+		defer release()
 	}
 
+	sent := countRequestBody(r)
+
 	//client
-	resp, err := p.Client.Do(r)
+	resp, err := p.fetch(r)
+	if errors.Is(err, errRequestTimeout) {
+		writeError(w, r, http.StatusGatewayTimeout, "request timeout exhausted before the backend responded")
+		return
+	}
+	if isHeaderLimitError(err) {
+		p.fail(w, r, http.StatusBadGateway, "backend response headers too large", err)
+		return
+	}
+	if isTimeout(err) {
+		p.fail(w, r, http.StatusGatewayTimeout, "backend timed out", err)
+		return
+	}
 	if err != nil {
-		//internal error
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, err)
+		p.fail(w, r, http.StatusBadGateway, "forward request", err)
+		return
+	}
+	//a client going away must not leave the backend writing into a full connection.
+	defer resp.Body.Close()
+
+	if isGRPCResponse(resp) || resp.ContentLength < 0 {
+		stopTimeout()
+	}
+
+	if p.maxResponseHeaders > 0 && headerCount(resp.Header) > p.maxResponseHeaders {
+		p.fail(w, r, http.StatusBadGateway, "backend response headers too large",
+			fmt.Errorf("%d headers, at most %d are allowed", headerCount(resp.Header), p.maxResponseHeaders))
 		return
 	}
+
+	if p.modifyResponse != nil {
+		body := resp.Body
+		if err := p.modifyResponse(resp); err != nil {
+			p.fail(w, r, http.StatusBadGateway, "modify response", err)
+			return
+		}
+
+		//the deferred close only covers the body the backend sent.
+		if resp.Body != body {
+			defer resp.Body.Close()
+		}
+	}
+
 	//copy headers
+	var rawNames map[string]string
+	if casing != nil {
+		rawNames = casing.get()
+	}
+
 	for header, values := range resp.Header {
+		if header == "Set-Cookie" && p.cookieRewrite != nil {
+			values = p.cookieRewrite.rewrite(values, publicHost)
+		}
+
+		if header == "Location" && resp.Request != nil {
+			if responder, ok := pl.find(resp.Request.URL.Host); ok {
+				values = []string{rewriteLocation(resp.Header.Get("Location"), responder, public)}
+			}
+		}
+
+		if raw, ok := rawNames[header]; ok && raw != header {
+			//assigning the map directly bypasses canonicalization.
+			w.Header()[raw] = values
+			continue
+		}
+
+		//headers such as Set-Cookie can not be folded, every value is kept.
+		w.Header().Del(header)
 		for _, val := range values {
-			w.Header().Set(header, val)
+			w.Header().Add(header, val)
 		}
 	}
 
+	//the backend's own alternatives are not reachable by the client.
+	if p.altSvc != "" {
+		w.Header().Set("Alt-Svc", p.altSvc)
+	}
+
+	if stick {
+		p.setStickyCookie(w, public, backend)
+	}
+
+	if attempts != nil {
+		w.Header().Set("X-Proxy-Retry-Count", strconv.Itoa(max(int(attempts.Load())-1, 0)))
+	}
+
 	//handle stream
-	done := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-time.Tick(time.Millisecond * 10):
-				w.(http.Flusher).Flush()
-			case <-done:
-				return
+	var dst io.Writer = w
+	var done chan struct{}
+	flusher, canFlush := w.(http.Flusher)
+
+	switch {
+	case canFlush && (isGRPCResponse(resp) || isChunked(resp)):
+		//every grpc message and backend chunk is flushed as soon as it's copied.
+		dst = &flushWriter{w: w, flusher: flusher}
+	case canFlush && resp.ContentLength < 0 && hasBody(r, resp):
+		//bodies of unknown length may be streams, those are flushed as they arrive.
+		done = make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(time.Millisecond * 10)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					flusher.Flush()
+				case <-done:
+					return
+				}
 			}
+		}()
+	}
+
+	if p.downloads != nil {
+		//clients are told apart like the rate limit does, by the ip the trusted proxies tell.
+		client := r.RemoteAddr
+		if ip, ok := p.clientIP(r); ok {
+			client = ip.String()
 		}
-	}()
+		bucket, release := p.downloads.acquire(client)
+		defer release()
+
+		throttled := &throttledWriter{w: dst, ctx: r.Context(), bucket: bucket}
+		if canFlush {
+			throttled.flusher = flusher
+		}
+		dst = throttled
+	}
+
+	var gz *gzip.Writer
+	if p.compress && negotiateEncoding(w, r, resp) {
+		gz = gzip.NewWriter(dst)
+		dst = gz
+	}
 
 	//handle trailers
-	trailerKeys := make([]string, 0, len(resp.Trailer))
+	var trailerKeys []string
 	for key := range resp.Trailer {
 		trailerKeys = append(trailerKeys, key)
 	}
 
 	//anounce the trailers
-	w.Header().Set("Trailer", strings.Join(trailerKeys, ","))
+	if len(trailerKeys) > 0 {
+		w.Header().Set("Trailer", strings.Join(trailerKeys, ","))
+	}
 
 	//copy response
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	status := resp.StatusCode
+	if rewritten, ok := p.statusRewrites[status]; ok {
+		status = rewritten
+	}
+	w.WriteHeader(status)
+	received, err := p.buffers.copy(dst, resp.Body)
+	//cached and shared responses have no request of their own, no backend served them.
+	if resp.Request != nil {
+		p.backendStats.add(backendName(resp.Request.URL), sent.Load(), received)
+	}
+	//the status is out already, aborting tells the client the body was cut
+	//short, a client that went away is not told anything.
+	clientGone := r.Context().Err() != nil && !errors.Is(context.Cause(r.Context()), errRequestTimeout)
+	if err != nil && !clientGone {
+		p.logger.Warn("copy response body", "backend", r.URL.Host, "path", r.URL.Path, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+	if gz != nil {
+		gz.Close()
+	}
 
-	//fill the trailer values
+	//fill the trailer values, http2 backends such as grpc servers send
+	//trailers they never announced, those need the trailer prefix.
 	for key, values := range resp.Trailer {
+		if !slices.Contains(trailerKeys, key) {
+			key = http.TrailerPrefix + key
+		}
+
+		//a trailer may carry several values, keep all of them.
+		w.Header().Del(key)
 		for _, val := range values {
-			w.Header().Set(key, val)
+			w.Header().Add(key, val)
+		}
+	}
+}
+
+// defaultAllowedMethods are advertised by OPTIONS * when WithAllowedMethods
+// was not used.
+var defaultAllowedMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// serveServerOptions answers OPTIONS * with the methods the proxy forwards.
+func (p *Proxy) serveServerOptions(w http.ResponseWriter) {
+	methods := p.allowedMethods
+	if len(methods) == 0 {
+		methods = defaultAllowedMethods
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Close stops the background work of the proxy, such as cache refreshes,
+// waits for it to exit and closes the idle backend connections. Requests
+// still being served are not interrupted.
+func (p *Proxy) Close() error {
+	p.cancel()
+	p.background.Wait()
+	if p.stopDNSChanges != nil {
+		p.stopDNSChanges()
+	}
+	p.closeIdleConnections()
+	return nil
+}
+
+// closeIdleConnections closes the idle connections of every transport.
+func (p *Proxy) closeIdleConnections() {
+	p.Client.CloseIdleConnections()
+	p.protocols.closeIdleConnections()
+	if p.forwardTransport != nil {
+		p.forwardTransport.CloseIdleConnections()
+	}
+}
+
+// do sends r to the backend, sharing a single upstream request between
+// identical concurrent requests when coalescing is enabled. Requests
+// repeating an Idempotency-Key get the response to the first one.
+func (p *Proxy) do(r *http.Request) (*http.Response, error) {
+	if p.idempotency != nil {
+		if key, ok := idempotencyKey(r); ok {
+			return p.idempotency.do(r.Context(), key, func() (*http.Response, error) {
+				return p.roundTrip(r)
+			})
 		}
 	}
 
-	//here we close the done
-	close(done)
+	if p.coalescer != nil {
+		if key, ok := coalesceKey(r); ok {
+			return p.coalescer.do(key, r.Header, func() (*http.Response, error) {
+				//the response is shared, one client going away must not cancel it for the rest.
+				return p.roundTrip(r.WithContext(context.WithoutCancel(r.Context())))
+			})
+		}
+	}
+	return p.roundTrip(r)
+}
+
+// fail logs err and answers r with status and its generic text. Errors may
+// name internal hosts and addresses, so they never reach the client.
+func (p *Proxy) fail(w http.ResponseWriter, r *http.Request, status int, msg string, err error) {
+	p.logger.Error(msg, "backend", r.URL.Host, "method", r.Method, "path", r.URL.Path, "err", err)
+	writeError(w, r, status, http.StatusText(status))
+}
+
+// loggerOrDefault returns l, or slog.Default when l is nil.
+func loggerOrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -164,6 +165,169 @@ func TestProxyStream(t *testing.T) {
 	}
 }
 
+func TestStreamingUpload(t *testing.T) {
+	received := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 1024)
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		close(received)
+
+		rest, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, int64(len(buf))+rest)
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithRetries(2))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	body, upload := io.Pipe()
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, 1)
+
+	go func() {
+		//a pipe has no length, the upload is chunked.
+		resp, err := http.Post(server.URL, "application/octet-stream", body)
+		results <- result{resp, err}
+	}()
+
+	chunk := make([]byte, 64<<10)
+	if _, err := upload.Write(chunk); err != nil {
+		t.Fatalf("failed to write first chunk: %s", err)
+	}
+
+	//the rest of the upload is only sent once the backend saw the start of it.
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the backend to receive data before the upload finished")
+	}
+
+	for range 15 {
+		if _, err := upload.Write(chunk); err != nil {
+			t.Fatalf("failed to write chunk: %s", err)
+		}
+	}
+	upload.Close()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("failed to send request: %s", res.err)
+	}
+	defer res.resp.Body.Close()
+
+	got, _ := io.ReadAll(res.resp.Body)
+	if expected := fmt.Sprint(16 * len(chunk)); string(got) != expected {
+		t.Errorf("received=%s, got %s", expected, got)
+	}
+}
+
+func TestSlowClientBackpressure(t *testing.T) {
+	const total = 256 << 20
+
+	var written atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 32<<10)
+		for written.Load() < total {
+			n, err := w.Write(chunk)
+			written.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	tests := map[string][]proxy.Option{
+		"direct":    nil,
+		"coalesced": {proxy.WithCoalescing(true)},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			written.Store(0)
+
+			p, err := proxy.New(backend.URL, false, opts...)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			server := httptest.NewServer(p)
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatalf("failed to send request: %s", err)
+			}
+
+			//the client reads nothing, only socket buffers may fill up.
+			time.Sleep(300 * time.Millisecond)
+			stalled := written.Load()
+
+			if _, err := io.CopyN(io.Discard, resp.Body, 1<<20); err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			resp.Body.Close()
+
+			if stalled > 32<<20 {
+				t.Errorf("expected the backend to be held back by the slow client, it wrote %d bytes", stalled)
+			}
+		})
+	}
+}
+
+func TestProxyClose(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+	}
+
+	//the backend connection is idle in the pool now.
+	select {
+	case <-closed:
+		t.Fatal("expected the backend connection to be kept for reuse")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("failed to close proxy: %s", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected closing the proxy to release its idle connections")
+	}
+}
+
 func TestHTTP2Proxy(t *testing.T) {
 	// Create an HTTP/2 server that will be the upstream server
 	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -237,3 +401,67 @@ func TestHTTP2Proxy(t *testing.T) {
 		t.Errorf("expected body %q, got %q", expectedBody, string(body))
 	}
 }
+
+func TestErrorBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		backend        string
+		prepare        func(r *http.Request)
+		hidden         string
+		expectedStatus int
+	}{
+		"unresolvable backend": {
+			backend:        "http://backend.internal.invalid:8080",
+			hidden:         "backend.internal.invalid",
+			expectedStatus: http.StatusBadGateway,
+		},
+		"upgrade to unresolvable backend": {
+			backend: "http://backend.internal.invalid:8080",
+			prepare: func(r *http.Request) {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			},
+			hidden:         "backend.internal.invalid",
+			expectedStatus: http.StatusBadGateway,
+		},
+		"malformed remote address": {
+			backend: server.URL,
+			prepare: func(r *http.Request) {
+				r.RemoteAddr = "10.1.2.3"
+			},
+			hidden:         "10.1.2.3",
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(tt.backend, true)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.prepare != nil {
+				tt.prepare(req)
+			}
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			body := recorder.Body.String()
+			if strings.Contains(body, tt.hidden) {
+				t.Errorf("expected %s to stay out of the response, got %q", tt.hidden, body)
+			}
+
+			if expected := http.StatusText(tt.expectedStatus) + "\n"; body != expected {
+				t.Errorf("body=%q, got %q", expected, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit caps how many requests a single client may send, clients are
+// told apart by their IP or by the value of a request header.
+type RateLimit struct {
+	Rate   float64 //requests per second.
+	Burst  int     //requests allowed at once, one when below one.
+	Header string  //header keying the limit, the client IP when empty.
+}
+
+// rateLimiter keeps a request bucket per client key.
+type rateLimiter struct {
+	RateLimit
+	clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*requestBucket
+	swept   time.Time
+}
+
+// requestBucket holds the tokens left to a client.
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit, clock Clock) *rateLimiter {
+	limit.Burst = max(limit.Burst, 1)
+	return &rateLimiter{
+		RateLimit: limit,
+		clock:     clock,
+		buckets:   make(map[string]*requestBucket),
+		swept:     clock.Now(),
+	}
+}
+
+// key returns the client r is counted against, client is its IP as told by
+// the trusted proxies.
+func (l *rateLimiter) key(r *http.Request, client netip.Addr) string {
+	if l.Header != "" {
+		return r.Header.Get(l.Header)
+	}
+
+	if !client.IsValid() {
+		return r.RemoteAddr
+	}
+	return client.String()
+}
+
+// allow takes a token for client, the client of r. When none is left it
+// reports how long until the next one.
+func (l *rateLimiter) allow(r *http.Request, client netip.Addr) (bool, time.Duration) {
+	key := l.key(r, client)
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	//buckets that refilled completely hold nothing worth keeping.
+	if full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second)); now.Sub(l.swept) > full {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &requestBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.Rate, float64(l.Burst))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rejectRateLimited answers a request over its limit.
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// noRedirects stops the client from following redirects, they are relayed
+// to the client like any other response.
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// publicURL returns the scheme and host the client used to reach the proxy.
+func publicURL(r *http.Request) *url.URL {
+	u := url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return &u
+}
+
+// rewriteLocation points a Location header naming backend at public
+// instead, so clients are not redirected to an address they can not reach.
+// The base path of backend is removed from the path. Relative locations and
+// those naming other hosts are returned as they are.
+func rewriteLocation(location string, backend, public *url.URL) string {
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() || !strings.EqualFold(u.Host, backend.Host) {
+		return location
+	}
+
+	u.Scheme = public.Scheme
+	u.Host = public.Host
+
+	if base := strings.TrimSuffix(backend.Path, "/"); base != "" {
+		if path, ok := strings.CutPrefix(u.Path, base); ok && (path == "" || path[0] == '/') {
+			u.Path = path
+			u.RawPath = ""
+			if u.Path == "" {
+				u.Path = "/"
+			}
+		}
+	}
+	return u.String()
+}
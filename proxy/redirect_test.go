@@ -0,0 +1,118 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestRedirectsRelayed(t *testing.T) {
+	var backendURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/relative":
+			http.Redirect(w, r, "/app/final", http.StatusFound)
+		case "/app/absolute":
+			http.Redirect(w, r, backendURL+"/app/final?from=absolute", http.StatusFound)
+		default:
+			io.WriteString(w, "final")
+		}
+	}))
+	defer backend.Close()
+	backendURL = backend.URL
+
+	p, err := proxy.New(backend.URL+"/app", false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := map[string]struct {
+		path             string
+		expectedLocation string
+	}{
+		"relative location": {
+			path:             "/relative",
+			expectedLocation: "/app/final",
+		},
+		"location naming the backend": {
+			path:             "/absolute",
+			expectedLocation: server.URL + "/final?from=absolute",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := client.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("failed to send request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusFound {
+				t.Fatalf("status=%d, got %d", http.StatusFound, resp.StatusCode)
+			}
+
+			if got := resp.Header.Get("Location"); got != tt.expectedLocation {
+				t.Errorf("location=%q, got %q", tt.expectedLocation, got)
+			}
+		})
+	}
+}
+
+func TestPermanentRedirectVerbatim(t *testing.T) {
+	var followed atomic.Bool
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed.Store(true)
+	}))
+	defer elsewhere.Close()
+
+	location := elsewhere.URL + "/moved?a=1&b=2"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", location)
+		w.Header().Set("X-Reason", "renamed")
+		w.WriteHeader(http.StatusMovedPermanently)
+		io.WriteString(w, "moved")
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/old", nil))
+
+	if rec.Code != http.StatusMovedPermanently {
+		t.Fatalf("status=%d, got %d", http.StatusMovedPermanently, rec.Code)
+	}
+
+	if got := rec.Header().Get("Location"); got != location {
+		t.Errorf("location=%q, got %q", location, got)
+	}
+
+	if got := rec.Header().Get("X-Reason"); got != "renamed" {
+		t.Errorf("X-Reason=renamed, got %q", got)
+	}
+
+	if rec.Body.String() != "moved" {
+		t.Errorf("body=moved, got %q", rec.Body.String())
+	}
+
+	if followed.Load() {
+		t.Error("expected the proxy not to follow the redirect")
+	}
+}
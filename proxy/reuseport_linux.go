@@ -0,0 +1,5 @@
+package proxy
+
+// soReusePort is SO_REUSEPORT, the syscall package does not define it on
+// linux.
+const soReusePort = 0xf
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import "syscall"
+
+// reusePortSupported reports whether listeners can share a port.
+const reusePortSupported = false
+
+// reusePort is never used where the platform has no SO_REUSEPORT.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
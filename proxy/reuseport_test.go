@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestListenReusePort(t *testing.T) {
+	lc := proxy.ListenConfig{ReusePort: true}
+
+	first, err := lc.Listen(context.Background(), []string{"127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer first[0].Close()
+
+	addr := first[0].Addr().String()
+
+	//a second instance binds the same port while the first still listens.
+	second, err := lc.Listen(context.Background(), []string{addr})
+	if err != nil {
+		t.Fatalf("expected the port to be shared: %s", err)
+	}
+	defer second[0].Close()
+
+	//without the option the port is taken.
+	if l, err := net.Listen("tcp", addr); err == nil {
+		l.Close()
+		t.Errorf("expected %s to be taken without SO_REUSEPORT", addr)
+	}
+}
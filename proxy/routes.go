@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Route sends matching requests to its own backends. Routes are matched in
+// the order they are configured and the first match wins.
+type Route struct {
+	Name string
+
+	Host       string   //request host to match, any host when empty.
+	Methods    []string //methods to match, any method when empty.
+	PathPrefix string   //matches whole path segments, any path when empty.
+
+	//Backends serving the route, the default backends when empty.
+	Backends []string
+
+	//UploadLimit caps request bodies in bytes per second, the proxy wide limit when zero.
+	UploadLimit int64
+
+	//RateLimit caps the requests each client sends to the route, unlimited when nil.
+	RateLimit *RateLimit
+}
+
+// route is a Route prepared for matching.
+type route struct {
+	Route
+	index   int
+	pool    *pool
+	limiter *rateLimiter
+}
+
+// routeKey is the context key of the route a request matched.
+type routeKey struct{}
+
+// compileRoute parses the backends of rt.
+func compileRoute(index int, rt Route, clock Clock) (*route, error) {
+	compiled := route{
+		Route: rt,
+		index: index,
+	}
+
+	var backends []*Backend
+	for _, backend := range rt.Backends {
+		u, err := parseBackendURL(backend)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeName(index, rt), err)
+		}
+		backends = append(backends, &Backend{URL: u})
+	}
+
+	if len(backends) > 0 {
+		compiled.pool = newPool(backends)
+	}
+
+	if rt.RateLimit != nil {
+		compiled.limiter = newRateLimiter(*rt.RateLimit, clock)
+	}
+	return &compiled, nil
+}
+
+// match returns the first route matching r, nil when none does.
+func (p *Proxy) match(r *http.Request) *route {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+
+	for _, rt := range p.routes {
+		if rt.Host != "" && !strings.EqualFold(rt.Host, host) {
+			continue
+		}
+
+		if len(rt.Methods) > 0 && !slices.ContainsFunc(rt.Methods, func(m string) bool { return strings.EqualFold(m, r.Method) }) {
+			continue
+		}
+
+		if !matchPrefix(rt.PathPrefix, r.URL.Path) {
+			continue
+		}
+		return rt
+	}
+	return nil
+}
+
+// routePrefix returns a key prefix telling apart requests with the same
+// path that matched different routes, and so different backends.
+func routePrefix(r *http.Request) string {
+	if rt, ok := r.Context().Value(routeKey{}).(*route); ok {
+		return strconv.Itoa(rt.index) + " "
+	}
+	return ""
+}
+
+// matchPrefix reports whether path lies under prefix, comparing whole
+// segments so /api does not match /apiv2.
+func matchPrefix(prefix, path string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// ValidateRoutes checks the routes for invalid values and for routes that
+// can never match because an earlier route has the same host, path prefix
+// and methods. Routes that only overlap are valid, see RouteOverlaps.
+func ValidateRoutes(routes []Route) []error {
+	var errs []error
+
+	for i, rt := range routes {
+		if rt.PathPrefix != "" && !strings.HasPrefix(rt.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("route %s: path prefix %q must start with /", routeName(i, rt), rt.PathPrefix))
+		}
+
+		for _, backend := range rt.Backends {
+			if _, err := parseBackendURL(backend); err != nil {
+				errs = append(errs, fmt.Errorf("route %s: %w", routeName(i, rt), err))
+			}
+		}
+
+		if rt.RateLimit != nil && rt.RateLimit.Rate <= 0 {
+			errs = append(errs, fmt.Errorf("route %s: rate limit must be positive", routeName(i, rt)))
+		}
+	}
+
+	for j, later := range routes {
+		for i, earlier := range routes[:j] {
+			if duplicateRoute(earlier, later) {
+				errs = append(errs, fmt.Errorf("route %s duplicates route %s", routeName(j, later), routeName(i, earlier)))
+			}
+		}
+	}
+
+	return errs
+}
+
+// RouteOverlaps describes the requests a later route loses to an earlier
+// one, routes are matched in order. New logs them so the precedence is
+// visible, duplicates are left to ValidateRoutes.
+func RouteOverlaps(routes []Route) []string {
+	var overlaps []string
+	for j, later := range routes {
+		for i, earlier := range routes[:j] {
+			if duplicateRoute(earlier, later) {
+				continue
+			}
+			if overlap := routeOverlap(i, earlier, j, later); overlap != "" {
+				overlaps = append(overlaps, overlap)
+			}
+		}
+	}
+	return overlaps
+}
+
+// duplicateRoute reports whether later matches exactly the requests of
+// earlier.
+func duplicateRoute(earlier, later Route) bool {
+	return strings.EqualFold(earlier.Host, later.Host) &&
+		pathOrRoot(earlier.PathPrefix) == pathOrRoot(later.PathPrefix) &&
+		methodList(earlier.Methods) == methodList(later.Methods)
+}
+
+// routeOverlap describes how the earlier route takes requests of the later
+// one, empty when they do not overlap.
+func routeOverlap(i int, earlier Route, j int, later Route) string {
+	//an earlier host specific route leaves the other hosts to a later catch-all.
+	if earlier.Host != "" && !strings.EqualFold(earlier.Host, later.Host) {
+		return ""
+	}
+
+	//a more specific later prefix is shadowed, a more general one only loses the overlap.
+	if !matchPrefix(earlier.PathPrefix, pathOrRoot(later.PathPrefix)) {
+		return ""
+	}
+
+	methods, ok := methodOverlap(earlier.Methods, later.Methods)
+	if !ok {
+		return ""
+	}
+
+	host := later.Host
+	if host == "" {
+		host = "any host"
+	}
+	return fmt.Sprintf("route %s overlaps route %s: %s requests to %s%s match route %s first", routeName(j, later), routeName(i, earlier), methods, host, pathOrRoot(later.PathPrefix), routeName(i, earlier))
+}
+
+// methodOverlap returns the methods both lists match and whether there are
+// any, an empty list matches every method.
+func methodOverlap(a, b []string) (string, bool) {
+	switch {
+	case len(a) == 0:
+		return methodList(b), true
+	case len(b) == 0:
+		return methodList(a), true
+	}
+
+	var common []string
+	for _, m := range a {
+		if slices.ContainsFunc(b, func(o string) bool { return strings.EqualFold(m, o) }) {
+			common = append(common, m)
+		}
+	}
+
+	if len(common) == 0 {
+		return "", false
+	}
+	return methodList(common), true
+}
+
+// methodList formats methods for messages.
+func methodList(methods []string) string {
+	if len(methods) == 0 {
+		return "all"
+	}
+
+	upper := make([]string, len(methods))
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+	}
+	slices.Sort(upper)
+	return strings.Join(upper, ",")
+}
+
+func pathOrRoot(prefix string) string {
+	if prefix == "" {
+		return "/"
+	}
+	return prefix
+}
+
+// routeName names a route in messages, by its position when it has no name.
+func routeName(index int, rt Route) string {
+	if rt.Name != "" {
+		return rt.Name
+	}
+	return fmt.Sprintf("#%d", index)
+}
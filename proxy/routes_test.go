@@ -0,0 +1,277 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	tests := map[string]struct {
+		routes           []proxy.Route
+		expected         []string
+		expectedOverlaps []string
+	}{
+		"specific prefix first": {
+			routes: []proxy.Route{
+				{Name: "api", PathPrefix: "/api"},
+				{Name: "root", PathPrefix: "/"},
+			},
+		},
+		"general prefix shadows specific": {
+			routes: []proxy.Route{
+				{Name: "root", PathPrefix: "/"},
+				{Name: "api", PathPrefix: "/api", Methods: []string{"GET", "POST"}},
+			},
+			expectedOverlaps: []string{"route api overlaps route root: GET,POST requests to any host/api match route root first"},
+		},
+		"partial method overlap": {
+			routes: []proxy.Route{
+				{Name: "reads", PathPrefix: "/api", Methods: []string{"GET"}},
+				{Name: "api", PathPrefix: "/api/users", Methods: []string{"GET", "POST"}},
+			},
+			expectedOverlaps: []string{"route api overlaps route reads: GET requests to any host/api/users match route reads first"},
+		},
+		"methods before all methods": {
+			routes: []proxy.Route{
+				{Name: "reads", PathPrefix: "/static", Methods: []string{"GET"}},
+				{Name: "static", PathPrefix: "/static"},
+			},
+			expectedOverlaps: []string{"route static overlaps route reads: GET requests to any host/static match route reads first"},
+		},
+		"duplicate host and method": {
+			routes: []proxy.Route{
+				{Name: "a", Host: "example.com", Methods: []string{"GET"}, PathPrefix: "/"},
+				{Name: "b", Host: "example.com", Methods: []string{"get"}, PathPrefix: "/"},
+			},
+			expected: []string{"route b duplicates route a"},
+		},
+		"disjoint methods": {
+			routes: []proxy.Route{
+				{Name: "reads", PathPrefix: "/", Methods: []string{"GET"}},
+				{Name: "writes", PathPrefix: "/", Methods: []string{"POST"}},
+			},
+		},
+		"different hosts": {
+			routes: []proxy.Route{
+				{Name: "a", Host: "a.example.com"},
+				{Name: "b", Host: "b.example.com"},
+			},
+		},
+		"segments are compared whole": {
+			routes: []proxy.Route{
+				{Name: "api", PathPrefix: "/api"},
+				{Name: "apiv2", PathPrefix: "/apiv2"},
+			},
+		},
+		"non positive rate limit": {
+			routes: []proxy.Route{
+				{Name: "login", PathPrefix: "/login", RateLimit: &proxy.RateLimit{Burst: 5}},
+			},
+			expected: []string{"route login: rate limit must be positive"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			errs := proxy.ValidateRoutes(tt.routes)
+			if len(errs) != len(tt.expected) {
+				t.Fatalf("errors=%d, got %d: %v", len(tt.expected), len(errs), errs)
+			}
+
+			for i, err := range errs {
+				if err.Error() != tt.expected[i] {
+					t.Errorf("error=%q, got %q", tt.expected[i], err.Error())
+				}
+			}
+
+			overlaps := proxy.RouteOverlaps(tt.routes)
+			if len(overlaps) != len(tt.expectedOverlaps) {
+				t.Fatalf("overlaps=%d, got %d: %v", len(tt.expectedOverlaps), len(overlaps), overlaps)
+			}
+
+			for i, overlap := range overlaps {
+				if overlap != tt.expectedOverlaps[i] {
+					t.Errorf("overlap=%q, got %q", tt.expectedOverlaps[i], overlap)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsDuplicateRoutes(t *testing.T) {
+	_, err := proxy.New("http://localhost:9000", true, proxy.WithRoutes(
+		proxy.Route{Name: "api", PathPrefix: "/api"},
+		proxy.Route{Name: "api-again", PathPrefix: "/api"},
+	))
+	if err == nil {
+		t.Fatal("expected duplicate routes to be rejected")
+	}
+
+	if !strings.Contains(err.Error(), "route api-again duplicates route api") {
+		t.Errorf("expected error to describe the duplicate, got %q", err)
+	}
+}
+
+func TestNewLogsOverlappingRoutes(t *testing.T) {
+	var handler recordHandler
+	_, err := proxy.New("http://localhost:9000", true,
+		proxy.WithLogger(slog.New(&handler)),
+		proxy.WithRoutes(
+			proxy.Route{Name: "reads", PathPrefix: "/static", Methods: []string{"GET"}},
+			proxy.Route{Name: "static", PathPrefix: "/static"},
+		),
+	)
+	if err != nil {
+		t.Fatalf("expected overlapping routes to be accepted: %s", err)
+	}
+
+	entries := handler.attrs("overlapping routes")
+	if len(entries) != 1 {
+		t.Fatalf("overlap warnings=1, got %d", len(entries))
+	}
+
+	expected := "route static overlaps route reads: GET requests to any host/static match route reads first"
+	if got := entries[0]["precedence"].String(); got != expected {
+		t.Errorf("precedence=%q, got %q", expected, got)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+	}
+
+	defaultServer := backend("default")
+	defer defaultServer.Close()
+
+	apiServer := backend("api")
+	defer apiServer.Close()
+
+	p, err := proxy.New(defaultServer.URL, true, proxy.WithRoutes(
+		proxy.Route{Name: "api", PathPrefix: "/api", Backends: []string{apiServer.URL}},
+	))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]string{
+		"/api/users": "api",
+		"/api":       "api",
+		"/apiv2":     "default",
+		"/":          "default",
+	}
+
+	for path, expected := range tests {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			bs, err := io.ReadAll(recorder.Body)
+			if err != nil {
+				t.Fatalf("failed to read response body: %s", err)
+			}
+
+			if string(bs) != expected {
+				t.Errorf("backend=%s, got %s", expected, string(bs))
+			}
+		})
+	}
+}
+
+func TestRouteRateLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithRoutes(
+		proxy.Route{Name: "login", PathPrefix: "/login", RateLimit: &proxy.RateLimit{Rate: 0.1, Burst: 2}},
+		proxy.Route{Name: "static", PathPrefix: "/static", RateLimit: &proxy.RateLimit{Rate: 0.1, Burst: 5, Header: "X-Api-Key"}},
+	))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	send := func(path, apiKey string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := range 3 {
+		expected := http.StatusOK
+		if i == 2 {
+			expected = http.StatusTooManyRequests
+		}
+		if got := send("/login", "a"); got != expected {
+			t.Errorf("login request %d: status=%d, got %d", i, expected, got)
+		}
+	}
+
+	//the login limit being used up leaves the static route alone.
+	for i := range 5 {
+		if got := send("/static/app.js", "a"); got != http.StatusOK {
+			t.Errorf("static request %d: status=%d, got %d", i, http.StatusOK, got)
+		}
+	}
+
+	if got := send("/static/app.js", "a"); got != http.StatusTooManyRequests {
+		t.Errorf("status=%d, got %d", http.StatusTooManyRequests, got)
+	}
+
+	//static is keyed by header, another key has its own budget.
+	if got := send("/static/app.js", "b"); got != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, got)
+	}
+}
+
+func TestRouteRateLimitsBehindTrustedProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false,
+		proxy.WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")),
+		proxy.WithRoutes(proxy.Route{Name: "login", PathPrefix: "/login", RateLimit: &proxy.RateLimit{Rate: 0.1, Burst: 1}}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	//every request comes through the same load balancer.
+	send := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/login", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		client       string
+		expectedCode int
+	}{
+		{client: "203.0.113.1", expectedCode: http.StatusOK},
+		{client: "203.0.113.2", expectedCode: http.StatusOK},
+		{client: "203.0.113.1", expectedCode: http.StatusTooManyRequests},
+	}
+
+	for i, tt := range tests {
+		if got := send(tt.client); got != tt.expectedCode {
+			t.Errorf("request %d from %s: status=%d, got %d", i, tt.client, tt.expectedCode, got)
+		}
+	}
+}
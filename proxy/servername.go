@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverNames are the TLS server names of the backends configured with a
+// ServerName, by the address their connections are dialed to. Connections
+// are pooled by address, so one name per address is all a dial needs.
+type serverNames struct {
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+// set replaces the names with the ones of backends.
+func (s *serverNames) set(backends []*Backend) {
+	names := make(map[string]string)
+	for _, backend := range backends {
+		if backend.ServerName != "" {
+			names[backendAddr(backend.URL)] = backend.ServerName
+		}
+	}
+
+	s.mu.Lock()
+	s.names = names
+	s.mu.Unlock()
+}
+
+// config returns cfg for a connection to addr, with the server name of the
+// backend at addr when it has one.
+func (s *serverNames) config(cfg *tls.Config, addr string) *tls.Config {
+	s.mu.RLock()
+	name := s.names[addr]
+	s.mu.RUnlock()
+
+	if name == "" {
+		return cfg
+	}
+
+	cfg = cfg.Clone()
+	cfg.ServerName = name
+	return cfg
+}
+
+// dialTLS makes t dial its TLS connections itself so every backend gets its
+// own server name. The settings of t are read on every dial, they may still
+// change afterwards.
+func (s *serverNames) dialTLS(t *http.Transport) {
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		return dialTLS(ctx, dial, network, addr, s.config(t.TLSClientConfig, addr), t.TLSHandshakeTimeout)
+	}
+}
+
+// dialTLS dials addr with dial and makes the TLS handshake with cfg, taking
+// at most timeout when it is not zero. The host of addr is the server name
+// when cfg has none.
+func dialTLS(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, addr string, cfg *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
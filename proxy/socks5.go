@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// socks5Dial returns a dial function reaching backends through the SOCKS5
+// server at addr, which is itself dialed with forward. Credentials are only
+// sent when username is set.
+func socks5Dial(addr, username, password string, forward *net.Dialer) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	var auth *netproxy.Auth
+	if username != "" {
+		auth = &netproxy.Auth{User: username, Password: password}
+	}
+
+	dialer, err := netproxy.SOCKS5("tcp", addr, auth, forward)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 dialer: %w", err)
+	}
+	return dialer.(netproxy.ContextDialer).DialContext, nil
+}
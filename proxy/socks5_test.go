@@ -0,0 +1,233 @@
+package proxy_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// socks5Server is a minimal SOCKS5 server supporting CONNECT, optionally
+// requiring the proxy:secret credentials.
+type socks5Server struct {
+	listener    net.Listener
+	requireAuth bool
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newSOCKS5Server(t *testing.T, requireAuth bool) *socks5Server {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	s := &socks5Server{listener: l, requireAuth: requireAuth}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) close() {
+	s.listener.Close()
+}
+
+func (s *socks5Server) connected() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func (s *socks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	//greeting: version, method count and methods.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if !s.requireAuth {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if !s.authenticate(conn) {
+			return
+		}
+	}
+
+	//request: version, command, reserved and the address type.
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	default:
+		return
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+// authenticate runs the username and password subnegotiation.
+func (s *socks5Server) authenticate(conn net.Conn) bool {
+	read := func() (string, bool) {
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", false
+		}
+		value := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, value); err != nil {
+			return "", false
+		}
+		return string(value), true
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return false
+	}
+	username, ok := read()
+	if !ok {
+		return false
+	}
+	password, ok := read()
+	if !ok {
+		return false
+	}
+
+	if username != "proxy" || password != "secret" {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+func TestSOCKS5Backend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		requireAuth    bool
+		username       string
+		password       string
+		expectedStatus int
+		expectedConns  int
+	}{
+		"no auth": {
+			expectedStatus: http.StatusOK,
+			expectedConns:  1,
+		},
+		"auth": {
+			requireAuth:    true,
+			username:       "proxy",
+			password:       "secret",
+			expectedStatus: http.StatusOK,
+			expectedConns:  1,
+		},
+		"wrong password": {
+			requireAuth:    true,
+			username:       "proxy",
+			password:       "wrong",
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			socks := newSOCKS5Server(t, tt.requireAuth)
+			defer socks.close()
+
+			p, err := proxy.New(server.URL, false, proxy.WithSOCKS5(socks.listener.Addr().String(), tt.username, tt.password))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			targets := socks.connected()
+			if len(targets) != tt.expectedConns {
+				t.Fatalf("connections=%d, got %d", tt.expectedConns, len(targets))
+			}
+
+			for _, target := range targets {
+				if target != server.Listener.Addr().String() {
+					t.Errorf("target=%s, got %s", server.Listener.Addr().String(), target)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SRVLookuper looks up DNS SRV records, *net.Resolver implements it.
+type SRVLookuper interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVResolver keeps the backends of a proxy in sync with the targets of a
+// DNS SRV record. Target priorities and weights carry over to the backends,
+// so selection prefers the lowest priority and balances by weight.
+type SRVResolver struct {
+	Proxy *Proxy
+
+	//Service, Proto and Name are passed to LookupSRV, with empty Service and
+	//Proto Name is looked up directly.
+	Service string
+	Proto   string
+	Name    string
+
+	Scheme   string        //scheme used to dial the targets, http when empty.
+	Interval time.Duration //how often the record is looked up again.
+	Lookuper SRVLookuper   //net.DefaultResolver when nil.
+	Logger   *slog.Logger  //slog.Default when nil.
+}
+
+// Resolve looks the record up once and replaces the proxy backends with its
+// targets. The backends are left untouched when the lookup fails.
+func (s *SRVResolver) Resolve(ctx context.Context) error {
+	lookuper := s.Lookuper
+	if lookuper == nil {
+		lookuper = net.DefaultResolver
+	}
+
+	scheme := s.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	_, records, err := lookuper.LookupSRV(ctx, s.Service, s.Proto, s.Name)
+	if err != nil {
+		return fmt.Errorf("lookup srv %s: %w", s.Name, err)
+	}
+
+	if len(records) == 0 {
+		return fmt.Errorf("lookup srv %s: no targets", s.Name)
+	}
+
+	backends := make([]*Backend, 0, len(records))
+	for _, record := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		backends = append(backends, &Backend{
+			URL:      &url.URL{Scheme: scheme, Host: host},
+			Weight:   int(record.Weight),
+			Priority: int(record.Priority),
+		})
+	}
+
+	if err := s.Proxy.SetBackends(backends); err != nil {
+		return fmt.Errorf("srv %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// Run resolves the record right away and then on every interval until ctx
+// is cancelled. Failed lookups keep the previous backends and are retried on
+// the next tick.
+func (s *SRVResolver) Run(ctx context.Context) error {
+	if s.Interval <= 0 {
+		return errors.New("srv resolver interval must be positive")
+	}
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Resolve(ctx); err != nil {
+			loggerOrDefault(s.Logger).Error("srv resolver", "name", s.Name, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
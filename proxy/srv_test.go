@@ -0,0 +1,97 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+type stubSRV struct {
+	records []*net.SRV
+}
+
+func (s stubSRV) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", s.records, nil
+}
+
+func TestSRVResolver(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+		}
+	}
+
+	heavy := httptest.NewServer(handler("heavy"))
+	defer heavy.Close()
+
+	light := httptest.NewServer(handler("light"))
+	defer light.Close()
+
+	fallback := httptest.NewServer(handler("fallback"))
+	defer fallback.Close()
+
+	record := func(server *httptest.Server, priority, weight uint16) *net.SRV {
+		_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to split listener address: %s", err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			t.Fatalf("failed to parse port: %s", err)
+		}
+		return &net.SRV{Target: "127.0.0.1.", Port: uint16(p), Priority: priority, Weight: weight}
+	}
+
+	p, err := proxy.New("http://127.0.0.1:1", true)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	resolver := proxy.SRVResolver{
+		Proxy: p,
+		Name:  "_http._tcp.backend.internal",
+		Lookuper: stubSRV{
+			records: []*net.SRV{
+				record(fallback, 20, 1),
+				record(heavy, 10, 3),
+				record(light, 10, 1),
+			},
+		},
+	}
+
+	if err := resolver.Resolve(context.Background()); err != nil {
+		t.Fatalf("failed to resolve srv record: %s", err)
+	}
+
+	if got := len(p.Backends()); got != 3 {
+		t.Fatalf("backends=%d, got %d", 3, got)
+	}
+
+	for range 8 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+		}
+	}
+
+	expected := map[string]int{"heavy": 6, "light": 2, "fallback": 0}
+	for name, count := range expected {
+		if hits[name] != count {
+			t.Errorf("%s hits=%d, got %d", name, count, hits[name])
+		}
+	}
+}
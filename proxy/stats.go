@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnStats counts how requests to the backends got their connections, a
+// low share of reused connections points at connection churn.
+type ConnStats struct {
+	Reused int64 //requests sent on an idle connection kept from earlier requests.
+	Dialed int64 //requests that had to open a new connection.
+}
+
+// connCounters backs ConnStats.
+type connCounters struct {
+	reused atomic.Int64
+	dialed atomic.Int64
+}
+
+// trace returns r with a trace counting the connection it is sent on.
+func (c *connCounters) trace(r *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.reused.Add(1)
+			} else {
+				c.dialed.Add(1)
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// ConnStats returns how many backend requests reused a connection and how
+// many dialed a new one since the proxy was created.
+func (p *Proxy) ConnStats() ConnStats {
+	return ConnStats{
+		Reused: p.conns.reused.Load(),
+		Dialed: p.conns.dialed.Load(),
+	}
+}
+
+// BackendStats is the traffic a backend served.
+type BackendStats struct {
+	Requests      int64 `json:"requests"`       //responses the backend sent.
+	BytesSent     int64 `json:"bytes_sent"`     //request body bytes sent to the backend.
+	BytesReceived int64 `json:"bytes_received"` //response body bytes received from the backend.
+}
+
+// backendCounters backs BackendStats, by backend URL.
+type backendCounters struct {
+	mu    sync.Mutex
+	stats map[string]*BackendStats
+}
+
+// add records a response of backend.
+func (c *backendCounters) add(backend string, sent, received int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats == nil {
+		c.stats = make(map[string]*BackendStats)
+	}
+
+	stats, ok := c.stats[backend]
+	if !ok {
+		stats = &BackendStats{}
+		c.stats[backend] = stats
+	}
+	stats.Requests++
+	stats.BytesSent += sent
+	stats.BytesReceived += received
+}
+
+// BackendStats returns the traffic every backend served since the proxy was
+// created, by backend URL. Responses served from the cache or shared with
+// coalesced requests are only counted once, for the request that fetched
+// them.
+func (p *Proxy) BackendStats() map[string]BackendStats {
+	p.backendStats.mu.Lock()
+	defer p.backendStats.mu.Unlock()
+
+	stats := make(map[string]BackendStats, len(p.backendStats.stats))
+	for backend, s := range p.backendStats.stats {
+		stats[backend] = *s
+	}
+	return stats
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countRequestBody counts the body bytes of r sent to a backend, the count
+// starts over when the body is recreated for a retry.
+func countRequestBody(r *http.Request) *atomic.Int64 {
+	n := new(atomic.Int64)
+	if r.Body == nil || r.Body == http.NoBody {
+		return n
+	}
+
+	r.Body = countingBody{ReadCloser: r.Body, n: n}
+
+	if getBody := r.GetBody; getBody != nil {
+		r.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			n.Store(0)
+			return countingBody{ReadCloser: body, n: n}, nil
+		}
+	}
+	return n
+}
+
+// backendName names the backend u was sent to in BackendStats.
+func backendName(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
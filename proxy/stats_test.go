@@ -0,0 +1,92 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestConnStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	expected := []proxy.ConnStats{
+		{Dialed: 1},
+		{Dialed: 1, Reused: 1},
+	}
+
+	for i, stats := range expected {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, recorder.Code)
+		}
+
+		if got := p.ConnStats(); got != stats {
+			t.Errorf("request %d: stats=%+v, got %+v", i, stats, got)
+		}
+	}
+}
+
+func TestBackendStats(t *testing.T) {
+	responses := []string{"short", "a longer response"}
+	expected := make(map[string]proxy.BackendStats)
+
+	var urls []string
+	for _, body := range responses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			fmt.Fprint(w, body)
+		}))
+		defer server.Close()
+
+		urls = append(urls, server.URL)
+		//round robin sends every backend two of the four requests.
+		expected[server.URL] = proxy.BackendStats{Requests: 2, BytesSent: 2 * int64(len("hello")), BytesReceived: 2 * int64(len(body))}
+	}
+
+	p, err := proxy.New(urls[0], false, proxy.WithBackends(urls[1]))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	for range 4 {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status=%d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	proxy.NewAdminHandler(p, "secret").ServeHTTP(rec, req)
+
+	var report struct {
+		Backends map[string]proxy.BackendStats `json:"backends"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode stats: %s", err)
+	}
+
+	if !maps.Equal(report.Backends, expected) {
+		t.Errorf("stats=%+v, got %+v", expected, report.Backends)
+	}
+}
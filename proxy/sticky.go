@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+)
+
+// stickyBackend returns the backend of pl the client of r is stuck to by
+// its sticky session cookie, nil when it has none or the backend it names
+// was removed or fails its health check.
+func (p *Proxy) stickyBackend(r *http.Request, pl *pool) *url.URL {
+	cookie, err := r.Cookie(p.stickyCookie)
+	if err != nil {
+		return nil
+	}
+
+	for _, backend := range pl.list() {
+		if stickyID(backend.URL) == cookie.Value && pl.isHealthy(backend.URL) {
+			return backend.URL
+		}
+	}
+	return nil
+}
+
+// stickyID names backend in sticky session cookies without telling clients
+// its address.
+func stickyID(backend *url.URL) string {
+	sum := sha256.Sum256([]byte(backendKey(backend)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// setStickyCookie sticks the client to backend for the rest of its session.
+func (p *Proxy) setStickyCookie(w http.ResponseWriter, public, backend *url.URL) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.stickyCookie,
+		Value:    stickyID(backend),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   public.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,111 @@
+package proxy_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestWeightedStickySessions(t *testing.T) {
+	var backends []*proxy.Backend
+	weights := []struct {
+		name   string
+		weight int
+	}{{name: "a", weight: 1}, {name: "b", weight: 3}}
+
+	for _, tt := range weights {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", tt.name)
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatalf("failed to parse backend url: %s", err)
+		}
+		backends = append(backends, &proxy.Backend{URL: u, Weight: tt.weight})
+	}
+
+	p, err := proxy.New(backends[0].URL.String(), false, proxy.WithStickySessions("backend"))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	if err := p.SetBackends(backends); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	send := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	stickyCookie := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == "backend" {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	const clients = 400
+	assigned := make(map[string]int)
+	cookies := make(map[string]*http.Cookie)
+	for range clients {
+		rec := send(nil)
+		cookie := stickyCookie(rec)
+		if cookie == nil {
+			t.Fatal("expected new clients to get a sticky session cookie")
+		}
+
+		backend := rec.Header().Get("X-Backend")
+		assigned[backend]++
+		cookies[backend] = cookie
+	}
+
+	//the assignments follow the 1:3 weights.
+	expected := map[string]float64{"a": 0.25, "b": 0.75}
+	for backend, share := range expected {
+		if got := float64(assigned[backend]) / clients; math.Abs(got-share) > 0.05 {
+			t.Errorf("backend %s: share=%.2f, got %.2f", backend, share, got)
+		}
+	}
+
+	//clients coming back stay on their backend, without a new cookie.
+	for backend, cookie := range cookies {
+		for range 4 {
+			rec := send(cookie)
+			if got := rec.Header().Get("X-Backend"); got != backend {
+				t.Errorf("backend=%s, got %s", backend, got)
+			}
+
+			if stickyCookie(rec) != nil {
+				t.Errorf("expected clients stuck to %s to keep their cookie", backend)
+			}
+		}
+	}
+
+	//clients of a removed backend are assigned again.
+	if err := p.SetBackends(backends[1:]); err != nil {
+		t.Fatalf("failed to set backends: %s", err)
+	}
+
+	rec := send(cookies["a"])
+	if got := rec.Header().Get("X-Backend"); got != "b" {
+		t.Errorf("backend=b, got %s", got)
+	}
+
+	if cookie := stickyCookie(rec); cookie == nil || cookie.Value != cookies["b"].Value {
+		t.Errorf("expected the client to be stuck to b, got cookie %v", cookie)
+	}
+}
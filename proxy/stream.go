@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// flushWriter flushes every write to the client right away, so messages of
+// a stream are not held back in buffers.
+type flushWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// isGRPCResponse reports whether resp carries a gRPC stream.
+func isGRPCResponse(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc")
+}
+
+// isChunked reports whether the backend sent resp with chunked transfer
+// encoding. Its reads then end at chunk boundaries, flushing after each one
+// hands the chunks on to the client as the backend framed them.
+func isChunked(resp *http.Response) bool {
+	return slices.Contains(resp.TransferEncoding, "chunked")
+}
+
+// hasBody reports whether resp may carry a body, responses to HEAD and
+// those with a status forbidding a body have nothing to stream.
+func hasBody(r *http.Request, resp *http.Response) bool {
+	switch {
+	case r.Method == http.MethodHead,
+		resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	return resp.ContentLength != 0
+}
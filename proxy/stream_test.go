@@ -0,0 +1,74 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+// slowFlushRecorder takes its time writing the status and counts the
+// flushes, streams of unknown length get flushed by the proxy meanwhile.
+type slowFlushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes atomic.Int32
+}
+
+func (s *slowFlushRecorder) WriteHeader(status int) {
+	time.Sleep(50 * time.Millisecond)
+	s.ResponseRecorder.WriteHeader(status)
+}
+
+func (s *slowFlushRecorder) Flush() {
+	s.flushes.Add(1)
+}
+
+func TestNoFlushingWithoutBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Done", "true")
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		//flushing without a content length makes the response chunked.
+		w.(http.Flusher).Flush()
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		method       string
+		path         string
+		expectedCode int
+	}{
+		"no content": {method: http.MethodGet, path: "/empty", expectedCode: http.StatusNoContent},
+		"head":       {method: http.MethodHead, path: "/", expectedCode: http.StatusOK},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := &slowFlushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			p.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rec.Code != tt.expectedCode {
+				t.Errorf("status=%d, got %d", tt.expectedCode, rec.Code)
+			}
+
+			if rec.Header().Get("X-Done") != "true" {
+				t.Errorf("X-Done=true, got %q", rec.Header().Get("X-Done"))
+			}
+
+			if got := rec.flushes.Load(); got != 0 {
+				t.Errorf("flushes=0, got %d", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket paces a byte stream to rate bytes per second, allowing bursts
+// of up to one second worth of bytes.
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// burst is the most bytes a single read or write may move at once.
+func (b *tokenBucket) burst() int {
+	return max(int(b.rate), 1)
+}
+
+// take removes n tokens, waiting until the bucket refilled enough to pay for
+// them or ctx is done.
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// throttledReader reads from r no faster than its bucket allows.
+type throttledReader struct {
+	r      io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.bucket.burst() {
+		p = p[:t.bucket.burst()]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.bucket.take(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	return t.r.Close()
+}
+
+// throttledWriter writes to w no faster than its bucket allows, flushing
+// every chunk so streamed responses keep moving.
+type throttledWriter struct {
+	w       io.Writer
+	flusher http.Flusher //nil when w can not flush.
+	ctx     context.Context
+	bucket  *tokenBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), t.bucket.burst())]
+
+		//a client too slow for the limit gives up its slot once it goes away.
+		if err := t.bucket.take(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if t.flusher != nil {
+			t.flusher.Flush()
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// downloadLimiter shares a bandwidth bucket between the downloads of each
+// client, so parallel downloads split its limit instead of multiplying it.
+// Buckets idle long enough to refill completely hold nothing worth keeping
+// and are swept.
+type downloadLimiter struct {
+	bytesPerSec int64
+
+	mu      sync.Mutex
+	buckets map[string]*clientBucket
+	swept   time.Time
+}
+
+// clientBucket is the bucket of a client with its downloads in flight.
+type clientBucket struct {
+	*tokenBucket
+	active int
+	idle   time.Time //when the last download ended.
+}
+
+func newDownloadLimiter(bytesPerSec int64) *downloadLimiter {
+	return &downloadLimiter{
+		bytesPerSec: bytesPerSec,
+		buckets:     make(map[string]*clientBucket),
+		swept:       time.Now(),
+	}
+}
+
+// acquire returns the bucket of client for a download, release must be
+// called once it is done.
+func (l *downloadLimiter) acquire(client string) (bucket *tokenBucket, release func()) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	//a bucket refills completely within a second.
+	if now.Sub(l.swept) > time.Second {
+		for k, b := range l.buckets {
+			if b.active == 0 && now.Sub(b.idle) > time.Second {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &clientBucket{tokenBucket: newTokenBucket(l.bytesPerSec)}
+		l.buckets[client] = b
+	}
+	b.active++
+
+	return b.tokenBucket, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		b.active--
+		b.idle = time.Now()
+	}
+}
+
+// throttleRequestBody limits the upload of the body of r to bytesPerSec.
+func throttleRequestBody(r *http.Request, bytesPerSec int64) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+
+	r.Body = &throttledReader{r: r.Body, ctx: r.Context(), bucket: newTokenBucket(bytesPerSec)}
+
+	if getBody := r.GetBody; getBody != nil {
+		r.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return &throttledReader{r: body, ctx: r.Context(), bucket: newTokenBucket(bytesPerSec)}, nil
+		}
+	}
+}
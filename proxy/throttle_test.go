@@ -0,0 +1,177 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestUploadLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		opts    []proxy.Option
+		path    string
+		minimum time.Duration
+	}{
+		"global": {
+			opts:    []proxy.Option{proxy.WithUploadLimit(64 << 10)},
+			path:    "/",
+			minimum: 450 * time.Millisecond,
+		},
+		"route": {
+			opts: []proxy.Option{
+				proxy.WithUploadLimit(1 << 20),
+				proxy.WithRoutes(proxy.Route{Name: "uploads", PathPrefix: "/uploads", UploadLimit: 48 << 10}),
+			},
+			path:    "/uploads",
+			minimum: 900 * time.Millisecond,
+		},
+	}
+
+	//a second worth of bytes passes as the initial burst.
+	body := bytes.Repeat([]byte("a"), 96<<10)
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, false, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			p.Client.Timeout = 10 * time.Second
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body))
+			recorder := httptest.NewRecorder()
+
+			start := time.Now()
+			p.ServeHTTP(recorder, req)
+			elapsed := time.Since(start)
+
+			if recorder.Body.String() != fmt.Sprint(len(body)) {
+				t.Fatalf("body=%d, got %s", len(body), recorder.Body.String())
+			}
+
+			if elapsed < tt.minimum {
+				t.Errorf("expected the upload to take at least %s, took %s", tt.minimum, elapsed)
+			}
+		})
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 96<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithDownloadLimit(64<<10))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+
+	start := time.Now()
+	p.ServeHTTP(recorder, req)
+	elapsed := time.Since(start)
+
+	if recorder.Body.Len() != len(body) {
+		t.Fatalf("body=%d, got %d", len(body), recorder.Body.Len())
+	}
+
+	if elapsed < 450*time.Millisecond {
+		t.Errorf("expected the download to take at least 450ms, took %s", elapsed)
+	}
+
+	if !recorder.Flushed {
+		t.Errorf("expected the throttled response to be flushed")
+	}
+}
+
+func TestDownloadLimitPerClient(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 48<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	//each download alone fits in the burst, together they go past it.
+	tests := map[string]struct {
+		remoteAddrs []string
+		slow        bool
+	}{
+		"one client":  {remoteAddrs: []string{"10.0.0.1:1000", "10.0.0.1:1001"}, slow: true},
+		"two clients": {remoteAddrs: []string{"10.0.0.1:1000", "10.0.0.2:1000"}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := proxy.New(server.URL, false, proxy.WithDownloadLimit(64<<10))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for _, remoteAddr := range tt.remoteAddrs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.RemoteAddr = remoteAddr
+					p.ServeHTTP(httptest.NewRecorder(), req)
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+
+			if tt.slow && elapsed < 400*time.Millisecond {
+				t.Errorf("expected parallel downloads to share the limit, took %s", elapsed)
+			}
+			if !tt.slow && elapsed > 300*time.Millisecond {
+				t.Errorf("expected clients to have a limit each, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestDownloadLimitClientGone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 1<<20))
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithDownloadLimit(16<<10))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+
+	start := time.Now()
+	p.ServeHTTP(recorder, req)
+
+	//at the limit the whole body would take over a minute.
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the copy to stop once the client went away, took %s", elapsed)
+	}
+}
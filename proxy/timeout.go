@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcTimeoutUnits are the units of the Grpc-Timeout header.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// requestTimeoutFor returns how long r may take, the configured request
+// timeout or the one the client asked for in the timeout header when that is
+// shorter. Zero means no timeout.
+func (p *Proxy) requestTimeoutFor(r *http.Request) time.Duration {
+	if p.timeoutHeader == "" {
+		return p.requestTimeout
+	}
+
+	requested, ok := parseTimeoutHeader(p.timeoutHeader, r.Header.Get(p.timeoutHeader))
+	if !ok {
+		return p.requestTimeout
+	}
+
+	requested = min(requested, p.maxHeaderTimeout)
+	if p.requestTimeout > 0 {
+		requested = min(requested, p.requestTimeout)
+	}
+	return requested
+}
+
+// parseTimeoutHeader parses the value of the timeout header name. Grpc-Timeout
+// carries an amount and a unit letter, any other header a number of seconds
+// or a duration such as 1.5s.
+func parseTimeoutHeader(name, value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if http.CanonicalHeaderKey(name) == "Grpc-Timeout" {
+		unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+		if !ok {
+			return 0, false
+		}
+
+		amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil || amount <= 0 {
+			return 0, false
+		}
+
+		//hours of up to 8 digits run past what a Duration holds.
+		if amount > math.MaxInt64/int64(unit) {
+			return math.MaxInt64, true
+		}
+		return time.Duration(amount) * unit, true
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if !(seconds > 0) {
+			return 0, false
+		}
+		seconds = min(seconds, float64(math.MaxInt64/time.Second))
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	d, err := time.ParseDuration(value)
+	return d, err == nil && d > 0
+}
+
+// isTimeout reports whether err is the backend running out of time, such
+// as a response whose headers did not arrive within the response header
+// timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestTimeoutHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Millisecond * 600):
+			fmt.Fprint(w, "Hello World!")
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		header         string
+		value          string
+		max            time.Duration
+		expectedStatus int
+		expectedWithin time.Duration
+	}{
+		"seconds": {
+			header:         "X-Timeout",
+			value:          "0.2",
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedWithin: time.Millisecond * 200,
+		},
+		"duration": {
+			header:         "X-Timeout",
+			value:          "200ms",
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedWithin: time.Millisecond * 200,
+		},
+		"grpc": {
+			header:         "Grpc-Timeout",
+			value:          "200m",
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedWithin: time.Millisecond * 200,
+		},
+		"capped at the maximum": {
+			header:         "X-Timeout",
+			value:          "60",
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedWithin: time.Millisecond * 300,
+		},
+		"invalid value is ignored": {
+			header:         "X-Timeout",
+			value:          "soon",
+			expectedStatus: http.StatusOK,
+			expectedWithin: time.Second,
+		},
+		"long enough": {
+			header:         "X-Timeout",
+			value:          "0.9",
+			max:            time.Second,
+			expectedStatus: http.StatusOK,
+			expectedWithin: time.Millisecond * 900,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			max := tt.max
+			if max == 0 {
+				max = time.Millisecond * 300
+			}
+
+			p, err := proxy.New(server.URL, false, proxy.WithTimeoutHeader(tt.header, max))
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(tt.header, tt.value)
+			recorder := httptest.NewRecorder()
+
+			start := time.Now()
+			p.ServeHTTP(recorder, req)
+			elapsed := time.Since(start)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, recorder.Code)
+			}
+
+			if elapsed > tt.expectedWithin+time.Millisecond*150 {
+				t.Errorf("expected request to finish within %s, took %s", tt.expectedWithin, elapsed)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			select {
+			case <-time.After(time.Millisecond * 300):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		//the body streaming after the headers is not bound by the timeout.
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Millisecond * 300)
+		fmt.Fprint(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, false, proxy.WithResponseHeaderTimeout(time.Millisecond*100))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	tests := map[string]struct {
+		path         string
+		expectedCode int
+	}{
+		"slow headers": {path: "/slow-headers", expectedCode: http.StatusGatewayTimeout},
+		"slow body":    {path: "/slow-body", expectedCode: http.StatusOK},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.expectedCode {
+				t.Errorf("status=%d, got %d", tt.expectedCode, rec.Code)
+			}
+		})
+	}
+}
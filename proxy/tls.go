@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TLSSettings configures the TLS the proxy server offers to clients, names
+// use the crypto/tls spelling such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// or X25519.
+type TLSSettings struct {
+	MinVersion   string   //"1.0" to "1.3", "1.2" when empty.
+	CipherSuites []string //TLS 1.0-1.2 suites, the crypto/tls defaults when empty.
+	Curves       []string //curve preferences, the crypto/tls defaults when empty.
+
+	//DisableSessionTickets turns off session resumption with tickets.
+	DisableSessionTickets bool
+
+	//ClientCAs verifies the certificates presented by clients.
+	ClientCAs *x509.CertPool
+
+	//ClientAuth is "none", "request", "require", "verify-if-given" or
+	//"require-and-verify", the last one when empty and ClientCAs is set.
+	ClientAuth string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// ServerTLSConfig builds the server tls.Config for s, returning every
+// unsupported choice it found.
+func ServerTLSConfig(s TLSSettings) (*tls.Config, error) {
+	var errs []error
+
+	cfg := tls.Config{
+		MinVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: s.DisableSessionTickets,
+	}
+
+	if s.MinVersion != "" {
+		version, ok := tlsVersions[s.MinVersion]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unsupported tls version %q", s.MinVersion))
+		}
+		cfg.MinVersion = version
+	}
+
+	for _, name := range s.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	if len(cfg.CipherSuites) > 0 && cfg.MinVersion == tls.VersionTLS13 {
+		errs = append(errs, errors.New("cipher suites can not be configured with tls 1.3 as the minimum version"))
+	}
+
+	for _, name := range s.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unsupported curve %q", name))
+			continue
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	clientAuth := s.ClientAuth
+	if clientAuth == "" && s.ClientCAs != nil {
+		clientAuth = "require-and-verify"
+	}
+
+	if clientAuth != "" {
+		authType, ok := tlsClientAuth[clientAuth]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("unsupported client auth %q", clientAuth))
+		case authType >= tls.VerifyClientCertIfGiven && s.ClientCAs == nil:
+			errs = append(errs, fmt.Errorf("client auth %s needs client cas to verify certificates", clientAuth))
+		}
+		cfg.ClientAuth = authType
+		cfg.ClientCAs = s.ClientCAs
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &cfg, nil
+}
+
+// cipherSuite looks up a configurable cipher suite by name, insecure suites
+// and the fixed TLS 1.3 suites are rejected.
+func cipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.InsecureCipherSuites() {
+		if strings.EqualFold(suite.Name, name) {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+
+	for _, suite := range tls.CipherSuites() {
+		if !strings.EqualFold(suite.Name, name) {
+			continue
+		}
+
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return 0, fmt.Errorf("cipher suite %s is tls 1.3 only and can not be configured", name)
+		}
+		return suite.ID, nil
+	}
+	return 0, fmt.Errorf("unsupported cipher suite %q", name)
+}
@@ -0,0 +1,243 @@
+package proxy_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func newTLSServer(t *testing.T, settings proxy.TLSSettings) (*httptest.Server, *tls.Config) {
+	t.Helper()
+
+	cfg, err := proxy.ServerTLSConfig(settings)
+	if err != nil {
+		t.Fatalf("failed to build tls config: %s", err)
+	}
+
+	cert, pool := newCertificate(t, "proxy.test")
+	cfg.Certificates = []tls.Certificate{cert}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = cfg
+	server.StartTLS()
+
+	return server, &tls.Config{RootCAs: pool, ServerName: "proxy.test"}
+}
+
+func TestServerTLSCipherSuites(t *testing.T) {
+	server, clientCfg := newTLSServer(t, proxy.TLSSettings{
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	})
+	defer server.Close()
+
+	clientCfg.MaxVersion = tls.VersionTLS12
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatalf("failed to complete handshake: %s", err)
+	}
+	defer conn.Close()
+
+	if suite := conn.ConnectionState().CipherSuite; suite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("cipher suite=%s, got %s", tls.CipherSuiteName(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), tls.CipherSuiteName(suite))
+	}
+}
+
+func TestServerTLSMinVersion(t *testing.T) {
+	server, clientCfg := newTLSServer(t, proxy.TLSSettings{MinVersion: "1.3"})
+	defer server.Close()
+
+	clientCfg.MaxVersion = tls.VersionTLS12
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), clientCfg)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected handshake below the minimum version to fail")
+	}
+}
+
+func TestServerTLSConfigInvalid(t *testing.T) {
+	tests := map[string]struct {
+		settings proxy.TLSSettings
+		expected string
+	}{
+		"version": {
+			settings: proxy.TLSSettings{MinVersion: "1.4"},
+			expected: `unsupported tls version "1.4"`,
+		},
+		"unknown suite": {
+			settings: proxy.TLSSettings{CipherSuites: []string{"TLS_FAKE"}},
+			expected: `unsupported cipher suite "TLS_FAKE"`,
+		},
+		"insecure suite": {
+			settings: proxy.TLSSettings{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			expected: "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure",
+		},
+		"tls 1.3 suite": {
+			settings: proxy.TLSSettings{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+			expected: "cipher suite TLS_AES_128_GCM_SHA256 is tls 1.3 only",
+		},
+		"curve": {
+			settings: proxy.TLSSettings{Curves: []string{"P224"}},
+			expected: `unsupported curve "P224"`,
+		},
+		"client auth": {
+			settings: proxy.TLSSettings{ClientAuth: "always"},
+			expected: `unsupported client auth "always"`,
+		},
+		"client auth without cas": {
+			settings: proxy.TLSSettings{ClientAuth: "require-and-verify"},
+			expected: "client auth require-and-verify needs client cas",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := proxy.ServerTLSConfig(test.settings)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("error=%q, got %q", test.expected, err.Error())
+			}
+		})
+	}
+}
+
+// newMTLSFrontend serves p over TLS to clients presenting the returned
+// certificate, the returned config trusts the frontend.
+func newMTLSFrontend(t *testing.T, p *proxy.Proxy) (*httptest.Server, tls.Certificate, *tls.Config) {
+	t.Helper()
+
+	clientCert, clientCAs := newCertificate(t, "client.test")
+	cfg, err := proxy.ServerTLSConfig(proxy.TLSSettings{ClientCAs: clientCAs})
+	if err != nil {
+		t.Fatalf("failed to build tls config: %s", err)
+	}
+
+	serverCert, serverCAs := newCertificate(t, "proxy.test")
+	cfg.Certificates = []tls.Certificate{serverCert}
+
+	frontend := httptest.NewUnstartedServer(p)
+	frontend.TLS = cfg
+	frontend.StartTLS()
+
+	return frontend, clientCert, &tls.Config{RootCAs: serverCAs, ServerName: "proxy.test"}
+}
+
+// sendWithCert sends a GET to frontend with headers, presenting certs.
+func sendWithCert(t *testing.T, frontend *httptest.Server, clientCfg *tls.Config, certs []tls.Certificate, headers http.Header) (*http.Response, error) {
+	t.Helper()
+
+	cfg := clientCfg.Clone()
+	cfg.Certificates = certs
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+	req, err := http.NewRequest(http.MethodGet, frontend.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header = headers
+	return client.Do(req)
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-CN", r.Header.Get("X-Client-Cert-CN"))
+		w.Header().Set("X-Seen-SAN", r.Header.Get("X-Client-Cert-SAN"))
+		w.Header().Set("X-Seen-Cert", r.Header.Get("X-Client-Cert"))
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	frontend, clientCert, clientCfg := newMTLSFrontend(t, p)
+	defer frontend.Close()
+
+	//a client naming itself is not believed.
+	spoofed := http.Header{"X-Client-Cert-Cn": {"admin"}, "X-Client-Cert": {"forged"}}
+
+	if resp, err := sendWithCert(t, frontend, clientCfg, nil, spoofed); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected a client without a certificate to be rejected, got status %d", resp.StatusCode)
+	}
+
+	resp, err := sendWithCert(t, frontend, clientCfg, []tls.Certificate{clientCert}, spoofed)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	expected := map[string]string{
+		"X-Seen-CN":   "client.test",
+		"X-Seen-SAN":  "client.test",
+		"X-Seen-Cert": "",
+	}
+	for header, value := range expected {
+		if got := resp.Header.Get(header); got != value {
+			t.Errorf("%s=%q, got %q", header, value, got)
+		}
+	}
+}
+
+func TestClientCertForwarding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range []string{"X-Client-Cert", "X-Client-Cert-Subject", "X-Client-Cert-Fingerprint"} {
+			w.Header().Set("X-Seen-"+strings.TrimPrefix(header, "X-"), r.Header.Get(header))
+		}
+	}))
+	defer backend.Close()
+
+	p, err := proxy.New(backend.URL, false, proxy.WithClientCertForwarding(true))
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	frontend, clientCert, clientCfg := newMTLSFrontend(t, p)
+	defer frontend.Close()
+
+	spoofed := http.Header{
+		"X-Client-Cert":             {"forged"},
+		"X-Client-Cert-Subject":     {"CN=admin"},
+		"X-Client-Cert-Fingerprint": {"00"},
+	}
+	resp, err := sendWithCert(t, frontend, clientCfg, []tls.Certificate{clientCert}, spoofed)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	resp.Body.Close()
+
+	forwarded, err := url.QueryUnescape(resp.Header.Get("X-Seen-Client-Cert"))
+	if err != nil {
+		t.Fatalf("failed to unescape certificate: %s", err)
+	}
+
+	block, _ := pem.Decode([]byte(forwarded))
+	if block == nil || !bytes.Equal(block.Bytes, clientCert.Leaf.Raw) {
+		t.Errorf("expected the presented certificate to be forwarded, got %q", forwarded)
+	}
+
+	if got := resp.Header.Get("X-Seen-Client-Cert-Subject"); got != "CN=client.test" {
+		t.Errorf("subject=%q, got %q", "CN=client.test", got)
+	}
+
+	sum := sha256.Sum256(clientCert.Leaf.Raw)
+	if got := resp.Header.Get("X-Seen-Client-Cert-Fingerprint"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("fingerprint=%q, got %q", hex.EncodeToString(sum[:]), got)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// IsUpgrade reports whether r asks to switch protocols, e.g. to WebSocket.
+// Upgraded connections are long lived and must not be wrapped in handlers
+// that buffer or time out the response.
+func IsUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
+
+// serveUpgrade forwards a protocol upgrade request to the backend. The
+// handshake headers, including Sec-WebSocket-Key, Sec-WebSocket-Protocol and
+// Sec-WebSocket-Extensions, are forwarded untouched. When the backend
+// switches protocols its 101 response is relayed to the client and bytes are
+// copied in both directions, otherwise its response is relayed as is.
+func (p *Proxy) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	//an upgraded connection lives until either side closes it, not until its lifetime ran out.
+	if p.connLifetime > 0 {
+		var release func()
+		r, release = traceConnLifetime(r)
+		defer release()
+	}
+
+	backend, _ := p.poolFor(r).backend(r.URL)
+	r = p.prepareAttempt(r, backend)
+
+	//the client would follow redirects, an upgrade is a single exchange with the transport.
+	resp, err := p.backendClient(backend).Transport.RoundTrip(r)
+	if err != nil {
+		p.fail(w, r, http.StatusBadGateway, "forward upgrade", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		//backend declined the upgrade
+		defer resp.Body.Close()
+		for header, values := range resp.Header {
+			for _, val := range values {
+				w.Header().Add(header, val)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		p.fail(w, r, http.StatusBadGateway, "forward upgrade", errors.New("backend connection does not support upgrades"))
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.fail(w, r, http.StatusInternalServerError, "forward upgrade", errors.New("client connection does not support upgrades"))
+		return
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		p.fail(w, r, http.StatusInternalServerError, "hijack client connection", err)
+		return
+	}
+	defer conn.Close()
+
+	//deadlines set by the server for the http exchange do not apply anymore.
+	conn.SetDeadline(time.Time{})
+
+	//relay the handshake response with the backend's negotiated subprotocol and extensions.
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		//brw may already hold bytes the client sent after the handshake.
+		_, err := io.Copy(upstream, brw)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, upstream)
+		errs <- err
+	}()
+
+	//once either side is done the deferred closes stop the other copy.
+	<-errs
+}
@@ -0,0 +1,227 @@
+package proxy_test
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Sec-WebSocket-Key"); got != key {
+			t.Errorf("Sec-WebSocket-Key=%s, got %s", key, got)
+		}
+
+		extensions := r.Header.Get("Sec-WebSocket-Extensions")
+		if extensions != "permessage-deflate" {
+			t.Errorf("Sec-WebSocket-Extensions=%s, got %s", "permessage-deflate", extensions)
+		}
+
+		var protocol string
+		for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+			if strings.TrimSpace(p) == "chat" {
+				protocol = "chat"
+			}
+		}
+
+		if protocol == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("failed to hijack connection: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\n")
+		fmt.Fprint(brw, "Upgrade: websocket\r\n")
+		fmt.Fprint(brw, "Connection: Upgrade\r\n")
+		fmt.Fprintf(brw, "Sec-WebSocket-Accept: %s\r\n", acceptKey(key))
+		fmt.Fprintf(brw, "Sec-WebSocket-Protocol: %s\r\n\r\n", protocol)
+		brw.Flush()
+
+		//echo whatever the client sends.
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(brw, buf); err != nil {
+			t.Errorf("failed to read from client: %s", err)
+			return
+		}
+		conn.Write(buf)
+	}))
+	defer server.Close()
+
+	p, err := proxy.New(server.URL, true)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	tests := map[string]struct {
+		protocols      string
+		expectedStatus int
+	}{
+		"negotiated": {
+			protocols:      "superchat, chat",
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		"declined": {
+			protocols:      "superchat",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+			if err != nil {
+				t.Fatalf("failed to dial proxy server: %s", err)
+			}
+			defer conn.Close()
+
+			req, err := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+			if err != nil {
+				t.Fatalf("failed to create a new request: %s", err)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", key)
+			req.Header.Set("Sec-WebSocket-Protocol", tt.protocols)
+			req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+
+			if err := req.Write(conn); err != nil {
+				t.Fatalf("failed to write request: %s", err)
+			}
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatalf("failed to read response: %s", err)
+			}
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("status=%d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			if tt.expectedStatus != http.StatusSwitchingProtocols {
+				return
+			}
+
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat" {
+				t.Errorf("Sec-WebSocket-Protocol=%s, got %s", "chat", got)
+			}
+
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != acceptKey(key) {
+				t.Errorf("Sec-WebSocket-Accept=%s, got %s", acceptKey(key), got)
+			}
+
+			//the upgraded connection must relay bytes both ways.
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("failed to write to upgraded connection: %s", err)
+			}
+
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				t.Fatalf("failed to read from upgraded connection: %s", err)
+			}
+
+			if string(buf) != "ping" {
+				t.Errorf("echo=%s, got %s", "ping", string(buf))
+			}
+		})
+	}
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestUpgradeBackendHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("failed to hijack connection: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	tests := map[string]struct {
+		backend        string
+		expectedStatus int
+	}{
+		"backend headers": {backend: server.URL, expectedStatus: http.StatusSwitchingProtocols},
+		"unreachable":     {backend: closed.URL, expectedStatus: http.StatusBadGateway},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tt.backend)
+			if err != nil {
+				t.Fatalf("failed to parse backend url: %s", err)
+			}
+
+			p, err := proxy.New(tt.backend, true)
+			if err != nil {
+				t.Fatalf("failed to create proxy: %s", err)
+			}
+
+			backend := &proxy.Backend{URL: u, Headers: http.Header{"X-Token": {"secret"}}}
+			if err := p.SetBackends([]*proxy.Backend{backend}); err != nil {
+				t.Fatalf("failed to set backends: %s", err)
+			}
+
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("status=%d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
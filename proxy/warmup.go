@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Warmup sends one request for path to every backend, the default ones and
+// those of every route, so DNS lookups and TLS handshakes are done and the
+// connections are idle in the pool before traffic arrives. Backends are
+// warmed concurrently and each only once, whatever they answer. Warmup
+// returns when all of them answered or ctx is done, the returned error
+// lists the backends that could not be reached.
+func (p *Proxy) Warmup(ctx context.Context, path string) error {
+	if path == "" {
+		path = "/"
+	}
+
+	seen := make(map[string]bool)
+	var targets []*url.URL
+	for _, pl := range p.pools() {
+		for _, backend := range pl.list() {
+			if key := backendKey(backend.URL); !seen[key] {
+				seen[key] = true
+				targets = append(targets, backend.URL)
+			}
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.warm(ctx, target, path); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("backend %s: %w", target, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// warm requests path from backend and reads the response so its connection
+// goes back to the pool.
+func (p *Proxy) warm(ctx context.Context, backend *url.URL, path string) error {
+	target := url.URL{Scheme: backend.Scheme, Host: backend.Host, Path: path}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	//a body left unread closes the connection instead of keeping it.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBody))
+	return nil
+}
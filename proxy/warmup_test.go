@@ -0,0 +1,105 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/reverse-proxy/proxy"
+)
+
+func TestWarmup(t *testing.T) {
+	type backend struct {
+		server *httptest.Server
+		conns  *atomic.Int32
+		hits   *atomic.Int32
+	}
+
+	newBackend := func() backend {
+		b := backend{conns: new(atomic.Int32), hits: new(atomic.Int32)}
+		b.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b.hits.Add(1)
+			fmt.Fprint(w, "Hello World!")
+		}))
+		b.server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				b.conns.Add(1)
+			}
+		}
+		b.server.Start()
+		return b
+	}
+
+	backends := []backend{newBackend(), newBackend(), newBackend()}
+	for _, b := range backends {
+		defer b.server.Close()
+	}
+
+	p, err := proxy.New(backends[0].server.URL, false,
+		proxy.WithBackends(backends[1].server.URL),
+		//listed by a route too, it must still be warmed once.
+		proxy.WithRoutes(proxy.Route{Name: "api", Backends: []string{backends[1].server.URL, backends[2].server.URL}}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := p.Warmup(ctx, "/healthz"); err != nil {
+		t.Fatalf("failed to warm up: %s", err)
+	}
+
+	for i, b := range backends {
+		if got := b.hits.Load(); got != 1 {
+			t.Errorf("backend %d: hits=1, got %d", i, got)
+		}
+	}
+
+	//the warmed connection serves the first proxied request.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status=%d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	for i, b := range backends {
+		if got := b.conns.Load(); got != 1 {
+			t.Errorf("backend %d: connections=1, got %d", i, got)
+		}
+	}
+}
+
+func TestWarmupTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	p, err := proxy.New(slow.URL, false)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	if err := p.Warmup(ctx, ""); err == nil {
+		t.Errorf("expected an error for a backend answering too late")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected warmup to stop at the deadline, took %s", elapsed)
+	}
+}